@@ -29,8 +29,10 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"starping/network"
 	"starping/tools"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -48,6 +50,8 @@ var (
 	timeout       = flag.Int("w", 1000, "Report send timeout(ms)")
 	refresh       = flag.Int("f", 3600, "Config update interval(ms)")
 	license       = flag.Bool("license", false, "Show license.")
+	batch         = flag.Int("batch", 0, "ICMP packets sent or received per system call, 0 to disable batching.")
+	batchLatency  = flag.Int("batch-wait", 0, "Longest time(us) an ICMP probe waits to fill its batch.")
 	reportLink    string
 	configLink    string
 	configULink   string
@@ -56,6 +60,8 @@ var (
 	failedChannel chan *ReportContainer
 	fileLogger    *log.Logger
 	congestWarn   = false
+	// current is the *Config in effect, replaced as a whole on update
+	current atomic.Value
 )
 
 const (
@@ -82,6 +88,52 @@ type Config struct {
 	MTRConf     *tools.MTRConfig  `json:"mtr_config"`
 	PingTargets *[]string         `json:"ping_targets"`
 	MTRTargets  *[]string         `json:"mtr_targets"`
+	// path MTU discovery is optional
+	PMTUConf    *tools.PMTUConfig `json:"pmtu_config"`
+	PMTUTargets *[]string         `json:"pmtu_targets"`
+	// TargetOptions overrides options of probes toward some targets, keyed
+	// by the target as listed. Each entry probes the target separately,
+	// e.g. once for each traffic class.
+	TargetOptions map[string][]*TargetOptions `json:"target_options"`
+}
+
+// currentConfig returns the Config in effect. It must not be modified: updates
+// replace it, and work running with it keeps it until its round ends.
+func currentConfig() *Config {
+	return current.Load().(*Config)
+}
+
+// setConfig puts config in effect, warning of what it asks but won't be done
+func setConfig(config *Config) {
+	if config.PMTUTargets != nil {
+		for _, addr := range *config.PMTUTargets {
+			if n := len(config.TargetOptions[addr]); n > 1 {
+				logW("Path MTU discovery toward %s only uses the first of its %d target options.\n", addr, n)
+			}
+		}
+	}
+	current.Store(config)
+}
+
+// TargetOptions are options of probes toward a target, see tools.PingConfig.
+// Fields present override the config of the work, even with zero values,
+// e.g. "tos": 0 probes best effort under a config marking EF. TOS and
+// FlowLabel don't apply to path MTU discovery, which only uses the first
+// entry.
+type TargetOptions struct {
+	Source    *string `json:"source"`
+	Interface *string `json:"interface"`
+	TOS       *int    `json:"tos"`
+	FlowLabel *int    `json:"flow_label"`
+}
+
+// targetOptions returns options to probe addr with, each for a separate
+// report. nil stands for the config of the work as is.
+func (c *Config) targetOptions(addr string) []*TargetOptions {
+	if options := c.TargetOptions[addr]; len(options) != 0 {
+		return options
+	}
+	return []*TargetOptions{nil}
 }
 
 type ErrResponse struct {
@@ -261,10 +313,17 @@ func main() {
 		}
 	}()
 
+	// open ICMP sockets now to know how we reach the network
+	network.SetICMPBatch(network.BatchConfig{
+		Size:    *batch,
+		Latency: time.Duration(*batchLatency) * time.Microsecond,
+	})
+	mode4, mode6 := network.GetICMPManager().Mode()
+	logI("ICMP manager started in %s mode for IPv4, %s mode for IPv6.\n", mode4, mode6)
+
 	// start work goroutine
 	config := getConfig(client)
-	pingInterval := time.Duration(int64(config.PingConf.Frequency) / int64(len(*config.PingTargets)))
-	traceInterval := time.Duration(int64(config.MTRConf.Frequency) / int64(len(*config.MTRTargets)))
+	setConfig(config)
 
 	logI("Aligning ping time.")
 	startTime := time.Unix(0, (time.Now().UnixNano()/int64(config.PingConf.
@@ -273,33 +332,60 @@ func main() {
 		startTime = startTime.Add(config.PingConf.Frequency)
 	}
 	time.Sleep(time.Until(startTime))
-	go runPeriodical(func() {
+	go runRounds(func(config *Config) time.Duration {
+		if config.PingConf == nil || config.PingTargets == nil || len(*config.PingTargets) == 0 {
+			return 0
+		}
+		return config.PingConf.Frequency
+	}, func(config *Config) {
 		logI("Start probing latency data of %d targets.\n", len(*config.PingTargets))
-		ticker := time.NewTicker(pingInterval)
-		pingTargets := make([]string, len(*config.PingTargets))
-		copy(pingTargets, *config.PingTargets)
-		for _, addr := range pingTargets {
-			go pingRoutine(addr, config.PingConf)
+		ticker := time.NewTicker(config.PingConf.Frequency / time.Duration(len(*config.PingTargets)))
+		for _, addr := range *config.PingTargets {
+			for _, options := range config.targetOptions(addr) {
+				go pingRoutine(addr, config.PingConf, options)
+			}
 			<-ticker.C
 		}
 		ticker.Stop()
-	}, config.PingConf.Frequency)
-	go runPeriodical(func() {
+	})
+	go runRounds(func(config *Config) time.Duration {
+		if config.MTRConf == nil || config.MTRTargets == nil || len(*config.MTRTargets) == 0 {
+			return 0
+		}
+		return config.MTRConf.Frequency
+	}, func(config *Config) {
 		logI("Start probing route data of %d targets.\n", len(*config.MTRTargets))
-		ticker := time.NewTicker(traceInterval)
-		mtrTargets := make([]string, len(*config.MTRTargets))
-		copy(mtrTargets, *config.MTRTargets)
-		for _, addr := range mtrTargets {
-			go mtrRoutine(addr, config.MTRConf)
+		ticker := time.NewTicker(config.MTRConf.Frequency / time.Duration(len(*config.MTRTargets)))
+		for _, addr := range *config.MTRTargets {
+			for _, options := range config.targetOptions(addr) {
+				go mtrRoutine(addr, config.MTRConf, options)
+			}
+			<-ticker.C
+		}
+		ticker.Stop()
+	})
+	go runRounds(func(config *Config) time.Duration {
+		if config.PMTUConf == nil || config.PMTUTargets == nil || len(*config.PMTUTargets) == 0 {
+			return 0
+		}
+		return config.PMTUConf.Frequency
+	}, func(config *Config) {
+		logI("Start probing path MTU of %d targets.\n", len(*config.PMTUTargets))
+		ticker := time.NewTicker(config.PMTUConf.Frequency / time.Duration(len(*config.PMTUTargets)))
+		for _, addr := range *config.PMTUTargets {
+			go pmtuRoutine(addr, config.PMTUConf, config.targetOptions(addr)[0])
 			<-ticker.C
 		}
 		ticker.Stop()
-	}, config.MTRConf.Frequency)
+	})
 
 	// update config periodically
 	time.Sleep(time.Duration(*refresh) * time.Second)
 	go runPeriodical(func() {
-		updateConfig(client, config)
+		updateConfig(client)
+		filter4, filter6 := network.GetICMPManager().FilterStats()
+		logD("ICMP socket filter: IPv4 received %d, filtered about %d; IPv6 received %d, filtered about %d.\n",
+			filter4.Received, filter4.FilteredEstimate, filter6.Received, filter6.FilteredEstimate)
 	}, time.Duration(*refresh)*time.Second)
 
 	// block main goroutine
@@ -340,7 +426,9 @@ func getConfig(client *http.Client) *Config {
 	return config
 }
 
-func updateConfig(client *http.Client, config *Config) *Config {
+// updateConfig gets the config from Star and puts it in effect, unless it
+// can't be read. Work already running keeps the config it started with.
+func updateConfig(client *http.Client) {
 	request, _ := http.NewRequest("GET", configULink, nil)
 	request.Header.Set("Content-Type", "application/json;charset=UTF-8")
 	h := hmac.New(sha256.New, secret)
@@ -350,12 +438,12 @@ func updateConfig(client *http.Client, config *Config) *Config {
 	resp, err := client.Do(request)
 	if err != nil {
 		logW("Can't update config from Star: %s\n", err)
-		return config
+		return
 	}
 	configByte, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		logW("Can't update config from Star: Failed reading response body: \n", err)
-		return config
+		return
 	}
 	if resp.StatusCode != http.StatusOK {
 		errSrv := &ErrResponse{}
@@ -365,17 +453,38 @@ func updateConfig(client *http.Client, config *Config) *Config {
 		} else {
 			logW("Can't update config from Star: Server error: %s\n", errSrv.Msg)
 		}
-		return config
+		return
 	}
 	_test := &Config{}
 	err = json.Unmarshal(bytes.Trim(configByte, "\x00"), _test)
 	if err != nil {
 		logW("Can't update config from Star: Bad Config response: %s\n", string(bytes.Trim(configByte, "\x00")))
-		return config
+		return
 	}
-	_ = json.Unmarshal(bytes.Trim(configByte, "\x00"), config)
+	setConfig(_test)
 	logI("Config updated from server.\n")
-	return config
+}
+
+// runRounds starts round with the current config every period of it, so an
+// updated config applies from the next round. period returns 0 if the config
+// has no such work, which is looked for again after the config refresh
+// interval.
+func runRounds(period func(*Config) time.Duration, round func(*Config)) {
+	next := time.Now()
+	for {
+		config := currentConfig()
+		freq := period(config)
+		if freq <= 0 {
+			freq = time.Duration(*refresh) * time.Second
+		} else {
+			go round(config)
+		}
+		// don't catch up on rounds missed while suspended
+		if next = next.Add(freq); next.Before(time.Now()) {
+			next = time.Now()
+		}
+		time.Sleep(time.Until(next))
+	}
 }
 
 func runPeriodical(function func(), freq time.Duration) {
@@ -386,10 +495,34 @@ func runPeriodical(function func(), freq time.Duration) {
 	}
 }
 
-func pingRoutine(addr string, config *tools.PingConfig) {
+// override sets config fields with options present
+func (o *TargetOptions) override(source, iface *string, tos, flowLabel *int) {
+	if o.Source != nil {
+		*source = *o.Source
+	}
+	if o.Interface != nil {
+		*iface = *o.Interface
+	}
+	if o.TOS != nil {
+		*tos = *o.TOS
+	}
+	if o.FlowLabel != nil {
+		*flowLabel = *o.FlowLabel
+	}
+}
+
+func pingRoutine(addr string, config *tools.PingConfig, options *TargetOptions) {
 	logD("Ping IP: %s\n", addr)
+	if options != nil {
+		c := *config
+		options.override(&c.Source, &c.Interface, &c.TOS, &c.FlowLabel)
+		config = &c
+	}
 	t := time.Now().UnixNano()
 	result, err := tools.Ping(addr, config)
+	if err == network.ErrFamilyUnavailable {
+		logW("Ping target %s unsupported: %s.\n", addr, err)
+	}
 	if err == nil {
 		j, err := json.Marshal(Report{
 			Time:   t,
@@ -408,10 +541,18 @@ func pingRoutine(addr string, config *tools.PingConfig) {
 	}
 }
 
-func mtrRoutine(addr string, config *tools.MTRConfig) {
+func mtrRoutine(addr string, config *tools.MTRConfig, options *TargetOptions) {
 	logD("MTR IP: %s\n", addr)
+	if options != nil {
+		c := *config
+		options.override(&c.Source, &c.Interface, &c.TOS, &c.FlowLabel)
+		config = &c
+	}
 	t := time.Now().UnixNano()
 	result, err := tools.MTR(addr, config)
+	if err == network.ErrFamilyUnavailable {
+		logW("MTR target %s unsupported: %s.\n", addr, err)
+	}
 	if err == nil {
 		j, err := json.Marshal(Report{
 			Time:   t,
@@ -430,6 +571,38 @@ func mtrRoutine(addr string, config *tools.MTRConfig) {
 	}
 }
 
+func pmtuRoutine(addr string, config *tools.PMTUConfig, options *TargetOptions) {
+	logD("PMTU IP: %s\n", addr)
+	if options != nil {
+		c := *config
+		// only where probes leave from matters to path MTU
+		tos, flowLabel := 0, 0
+		options.override(&c.Source, &c.Interface, &tos, &flowLabel)
+		config = &c
+	}
+	t := time.Now().UnixNano()
+	result, err := tools.PMTU(addr, config)
+	if err == network.ErrFamilyUnavailable {
+		logW("PMTU target %s unsupported: %s.\n", addr, err)
+	}
+	if err == nil {
+		j, err := json.Marshal(Report{
+			Time:   t,
+			Report: result,
+		})
+		if err != nil {
+			logW("Failed marshalling PMTU report for IP %s: %s", addr, err)
+		}
+		report := ReportContainer{
+			Type:   "pmtu",
+			Target: addr,
+			Report: &j,
+		}
+		report.Sign()
+		reportChannel <- &report
+	}
+}
+
 func (report *ReportContainer) Sign() {
 	h := hmac.New(sha256.New, secret)
 	h.Write(*report.Report)
@@ -586,11 +759,11 @@ func flipFlopSender(client *http.Client, report *ReportContainer,
 
 func DrainTrash(channels ...chan *ReportContainer) {
 	for _, channel := range channels {
-		go func() {
+		go func(channel chan *ReportContainer) {
 			for {
 				report := <-channel
 				logW("Trash %s report of %s. Max retry exceed. Discard.\n", report.Type, report.Target)
 			}
-		}()
+		}(channel)
 	}
 }
@@ -0,0 +1,238 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"golang.org/x/net/ipv4"
+	"io"
+	"net"
+	"time"
+)
+
+// BatchConfig controls how ICMPManager batches packets on transports
+// supporting it, which are raw and datagram sockets on Linux (recvmmsg and
+// sendmmsg).
+//
+// Send errors of batched probes are only delivered as Result, IssueContext
+// doesn't return them.
+type BatchConfig struct {
+	// Size is the most packets sent or received per system call. Batching
+	// is disabled if it's less than 2.
+	Size int
+	// Latency is how long a probe may wait for more probes to fill its
+	// batch. With zero latency only probes already waiting are sent
+	// together, which happens when probes are issued faster than they can be
+	// sent. Probes are stamped as the batch is sent, so the wait doesn't add
+	// to the measured round trip time.
+	Latency time.Duration
+}
+
+// a batchTransport is a PacketTransport moving several packets per system
+// call. Buffers of the messages hold exactly one buffer.
+type batchTransport interface {
+	PacketTransport
+	// readBatch reads at least one message into ms, and stores the kernel
+	// receive time of ms[i] in received[i], or zero time if not available.
+	// Addr of read messages is the source *net.IPAddr, or nil if the
+	// message should be skipped.
+	readBatch(ms []ipv4.Message, received []time.Time) (int, error)
+	// writeBatch sends ms to their Addr, which is *net.IPAddr, with control
+	// messages in OOB. returns the number of messages sent, and the error of
+	// the first message not sent.
+	writeBatch(ms []ipv4.Message) (int, error)
+}
+
+// receiveBatchLoop is receiveLoop reading up to size packets per system call
+func receiveBatchLoop(ctx context.Context, conn batchTransport, wait time.Duration, size int,
+	handle func(b []byte, src net.IP, received time.Time, clock ClockSource)) {
+	ms := make([]ipv4.Message, size)
+	received := make([]time.Time, size)
+	bufs := make([]*[]byte, size)
+	for i := range ms {
+		bufs[i] = packetPool.Get().(*[]byte)
+		ms[i].Buffers = [][]byte{*bufs[i]}
+		// kernel receive timestamp
+		ms[i].OOB = make([]byte, 64)
+	}
+	defer func() {
+		for _, buf := range bufs {
+			packetPool.Put(buf)
+		}
+	}()
+	for ctx.Err() == nil {
+		if err := conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+			return
+		}
+		n, err := conn.readBatch(ms, received)
+		if err != nil {
+			continue
+		}
+		for i := 0; i < n; i++ {
+			src, ok := ms[i].Addr.(*net.IPAddr)
+			if !ok {
+				continue
+			}
+			now, clock := received[i], ClockKernel
+			if now.IsZero() {
+				now, clock = time.Now(), ClockUser
+			}
+			handle(ms[i].Buffers[0][:ms[i].N], src.IP, now, clock)
+		}
+	}
+}
+
+// an outPacket is a probe waiting in batchSender
+type outPacket struct {
+	// build returns the packet of the probe stamped with stamp, which is
+	// taken right before the batch is sent
+	build func(stamp time.Time) []byte
+	dst   *net.IPAddr
+	opts  *WriteOptions
+	// sent takes the time sending the probe returned
+	sent func(time.Time)
+	// fail finishes the probe with the error sending it
+	fail func(error)
+}
+
+// a batchSender sends probes through a batchTransport, several per system
+// call
+type batchSender struct {
+	conn    batchTransport
+	v4      bool
+	size    int
+	latency time.Duration
+	queue   chan *outPacket
+}
+
+// newBatchSender creates a batchSender sending through conn, or returns nil if
+// conn can't send in batches: the transport doesn't support it, or TTL can't
+// be sent as control message.
+func newBatchSender(conn PacketTransport, v4 bool, config BatchConfig) *batchSender {
+	t, ok := conn.(batchTransport)
+	if !ok || config.Size < 2 {
+		return nil
+	}
+	if _, ttl, err := controlMessage(v4, &WriteOptions{TTL: 64}); err != nil || !ttl {
+		return nil
+	}
+	return &batchSender{
+		conn:    t,
+		v4:      v4,
+		size:    config.Size,
+		latency: config.Latency,
+		queue:   make(chan *outPacket, 1024),
+	}
+}
+
+// push queues p to be sent. p is dropped if ctx is done, the requests left
+// pending are drained by the manager.
+func (s *batchSender) push(ctx context.Context, p *outPacket) {
+	select {
+	case s.queue <- p:
+	case <-ctx.Done():
+	}
+}
+
+// run sends queued probes until ctx is done
+func (s *batchSender) run(ctx context.Context) {
+	batch := make([]*outPacket, 0, s.size)
+	ms := make([]ipv4.Message, 0, s.size)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-s.queue:
+			batch = append(batch[:0], p)
+		}
+		batch = s.fill(ctx, batch)
+		// probes not sent are drained by the manager
+		if ctx.Err() != nil {
+			return
+		}
+		s.flush(batch, ms)
+	}
+}
+
+// fill adds queued probes to batch until it's full, or latency passes since
+// the first probe, or ctx is done.
+func (s *batchSender) fill(ctx context.Context, batch []*outPacket) []*outPacket {
+	if s.latency <= 0 {
+		for len(batch) < s.size {
+			select {
+			case p := <-s.queue:
+				batch = append(batch, p)
+			default:
+				return batch
+			}
+		}
+		return batch
+	}
+	timer := time.NewTimer(s.latency)
+	defer timer.Stop()
+	for len(batch) < s.size {
+		select {
+		case p := <-s.queue:
+			batch = append(batch, p)
+		case <-timer.C:
+			return batch
+		case <-ctx.Done():
+			return batch
+		}
+	}
+	return batch
+}
+
+// flush sends batch with ms as buffer. Probes which can't be sent fail.
+func (s *batchSender) flush(batch []*outPacket, ms []ipv4.Message) {
+	ms = ms[:0]
+	pending := batch[:0]
+	// probes are stamped now, not when queued, so the time waiting for the
+	// batch to fill isn't counted in round trip time
+	stamp := time.Now()
+	for _, p := range batch {
+		oob, _, err := controlMessage(s.v4, p.opts)
+		if err != nil {
+			p.fail(err)
+			continue
+		}
+		ms = append(ms, ipv4.Message{Buffers: [][]byte{p.build(stamp)}, OOB: oob, Addr: p.dst})
+		pending = append(pending, p)
+	}
+	for len(ms) != 0 {
+		n, err := s.conn.writeBatch(ms)
+		if n < 0 {
+			n = 0
+		} else if n > len(ms) {
+			n = len(ms)
+		}
+		sent := time.Now()
+		for _, p := range pending[:n] {
+			p.sent(sent)
+		}
+		if n == 0 && err == nil {
+			err = io.ErrShortWrite
+		}
+		// sending stops at the first failed message, skip it and retry.
+		// an error with every message sent has no message to blame.
+		if err != nil && n < len(pending) {
+			pending[n].fail(err)
+			n++
+		}
+		ms, pending = ms[n:], pending[n:]
+	}
+}
@@ -0,0 +1,117 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// readBatch reads messages from the PacketConn of IPv4 (p4) or IPv6 (p6 if p4
+// is nil) with recvmmsg.
+func readBatch(p4 *ipv4.PacketConn, p6 *ipv6.PacketConn, ms []ipv4.Message) (int, error) {
+	if p4 != nil {
+		return p4.ReadBatch(ms, 0)
+	}
+	return p6.ReadBatch(ms, 0)
+}
+
+// writeBatch sends messages through the PacketConn of IPv4 (p4) or IPv6 (p6
+// if p4 is nil) with sendmmsg. x/net reports -1 messages sent on error.
+func writeBatch(p4 *ipv4.PacketConn, p6 *ipv6.PacketConn, ms []ipv4.Message) (int, error) {
+	var n int
+	var err error
+	if p4 != nil {
+		n, err = p4.WriteBatch(ms, 0)
+	} else {
+		n, err = p6.WriteBatch(ms, 0)
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (t *icmpTransport) readBatch(ms []ipv4.Message, received []time.Time) (int, error) {
+	n, err := readBatch(t.p4, t.p6, ms)
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddUint64(&t.received, uint64(n))
+	for i := 0; i < n; i++ {
+		received[i] = time.Time{}
+		if t.timestamp {
+			received[i], _ = rxTimestamp(ms[i].OOB[:ms[i].NN])
+		}
+		// unlike ReadFrom, ReadBatch keeps IPv4 header
+		if t.v4 {
+			l, err := stripIPv4Header(ms[i].Buffers[0][:ms[i].N])
+			if err != nil {
+				ms[i].Addr = nil
+				continue
+			}
+			ms[i].N = l
+		}
+	}
+	return n, nil
+}
+
+func (t *icmpTransport) writeBatch(ms []ipv4.Message) (int, error) {
+	return writeBatch(t.p4, t.p6, ms)
+}
+
+func (t *dgramTransport) readBatch(ms []ipv4.Message, received []time.Time) (int, error) {
+	n, err := readBatch(t.p4, t.p6, ms)
+	if err != nil {
+		// a pending ICMP error is reported as read error, and kernel clears
+		// it once reported. read the error queue now.
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return 0, err
+		}
+		l, from, at, ok := t.readError(ms[0].Buffers[0])
+		if !ok {
+			return 0, err
+		}
+		ms[0].N, ms[0].Addr, received[0] = l, from, at
+		return 1, nil
+	}
+	for i := 0; i < n; i++ {
+		received[i] = time.Time{}
+		if t.timestamp {
+			received[i], _ = rxTimestamp(ms[i].OOB[:ms[i].NN])
+		}
+		if udpAddr, ok := ms[i].Addr.(*net.UDPAddr); ok {
+			ms[i].Addr = &net.IPAddr{IP: udpAddr.IP, Zone: udpAddr.Zone}
+		}
+	}
+	return n, nil
+}
+
+func (t *dgramTransport) writeBatch(ms []ipv4.Message) (int, error) {
+	for i := range ms {
+		if ipAddr, ok := ms[i].Addr.(*net.IPAddr); ok {
+			ms[i].Addr = &net.UDPAddr{IP: ipAddr.IP, Zone: ipAddr.Zone}
+		}
+	}
+	return writeBatch(t.p4, t.p6, ms)
+}
@@ -0,0 +1,147 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/net/ipv4"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// nullBatch is a batchTransport sending every message and reading none
+type nullBatch struct {
+	PacketTransport
+}
+
+func (nullBatch) readBatch([]ipv4.Message, []time.Time) (int, error) {
+	return 0, errors.New("no packet")
+}
+
+func (nullBatch) writeBatch(ms []ipv4.Message) (int, error) {
+	return len(ms), nil
+}
+
+func TestBatchSenderStamp(t *testing.T) {
+	const latency = 30 * time.Millisecond
+	s := newBatchSender(nullBatch{}, true, BatchConfig{Size: 4, Latency: latency})
+	if s == nil {
+		t.Skip("batching unsupported")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx)
+
+	var stamp, sent time.Time
+	done := make(chan struct{})
+	pushed := time.Now()
+	s.push(ctx, &outPacket{
+		build: func(at time.Time) []byte {
+			stamp = at
+			return make([]byte, 8)
+		},
+		dst:  &net.IPAddr{IP: simTarget4},
+		opts: &WriteOptions{TTL: 64},
+		sent: func(at time.Time) {
+			sent = at
+			close(done)
+		},
+		fail: func(err error) { t.Error(err) },
+	})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("probe is not sent")
+	}
+	// the lone probe waits for the batch to fill, which isn't round trip
+	if stamp.Sub(pushed) < latency {
+		t.Fatalf("stamped %v after push, before the batch is sent", stamp.Sub(pushed))
+	}
+	if sent.Before(stamp) {
+		t.Fatal("transmit time before the stamp")
+	}
+}
+
+// scriptBatch is a batchTransport whose writeBatch returns the scripted
+// results in turn, then sends everything
+type scriptBatch struct {
+	nullBatch
+	script []batchResult
+}
+
+type batchResult struct {
+	n   int
+	err error
+}
+
+func (t *scriptBatch) writeBatch(ms []ipv4.Message) (int, error) {
+	if len(t.script) == 0 {
+		return len(ms), nil
+	}
+	r := t.script[0]
+	t.script = t.script[1:]
+	return r.n, r.err
+}
+
+func TestBatchSenderFlush(t *testing.T) {
+	errSend := errors.New("send failed")
+	for _, c := range []struct {
+		name   string
+		script []batchResult
+		// error of each probe, nil if sent
+		want []error
+	}{
+		{"all sent", nil, []error{nil, nil, nil, nil}},
+		{"partial", []batchResult{{1, errSend}}, []error{nil, errSend, nil, nil}},
+		{"first failed", []batchResult{{0, errSend}, {0, errSend}}, []error{errSend, errSend, nil, nil}},
+		{"short write", []batchResult{{0, nil}}, []error{io.ErrShortWrite, nil, nil, nil}},
+		{"partial without error", []batchResult{{2, nil}}, []error{nil, nil, nil, nil}},
+		{"error with all sent", []batchResult{{4, errSend}}, []error{nil, nil, nil, nil}},
+		{"too many sent", []batchResult{{9, nil}}, []error{nil, nil, nil, nil}},
+		{"negative", []batchResult{{-1, errSend}}, []error{errSend, nil, nil, nil}},
+	} {
+		s := newBatchSender(&scriptBatch{script: c.script}, true, BatchConfig{Size: 4})
+		if s == nil {
+			t.Skip("batching unsupported")
+		}
+		got := make([]error, len(c.want))
+		done := make([]int, len(c.want))
+		batch := make([]*outPacket, len(c.want))
+		for i := range batch {
+			i := i
+			batch[i] = &outPacket{
+				build: func(time.Time) []byte { return make([]byte, 8) },
+				dst:   &net.IPAddr{IP: simTarget4},
+				opts:  &WriteOptions{TTL: 64},
+				sent:  func(time.Time) { done[i]++ },
+				fail: func(err error) {
+					got[i] = err
+					done[i]++
+				},
+			}
+		}
+		s.flush(batch, nil)
+		for i := range batch {
+			if done[i] != 1 || got[i] != c.want[i] {
+				t.Fatalf("%s: probe %d finished %d times with %v, want once with %v", c.name, i, done[i], got[i], c.want[i])
+			}
+		}
+	}
+}
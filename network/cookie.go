@@ -0,0 +1,56 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// cookieLen is the length of the cookie carried in echo payload:
+// nonce(8) request ID(8) send time in unix nanoseconds(8)
+const cookieLen = 24
+
+// cookieNonce marks probes sent by this process. Replies carrying another
+// nonce are spoofed or belong to someone else.
+var cookieNonce = newNonce()
+
+func newNonce() uint64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// putCookie writes the cookie of request key sent at sent to the beginning of
+// b, which must hold cookieLen bytes.
+func putCookie(b []byte, key uint64, sent time.Time) {
+	binary.BigEndian.PutUint64(b[0:8], cookieNonce)
+	binary.BigEndian.PutUint64(b[8:16], key)
+	binary.BigEndian.PutUint64(b[16:24], uint64(sent.UnixNano()))
+}
+
+// parseCookie reads the cookie at the beginning of b. ok is false if b is too
+// short or not marked by this process.
+func parseCookie(b []byte) (key uint64, sent int64, ok bool) {
+	if len(b) < cookieLen || binary.BigEndian.Uint64(b[0:8]) != cookieNonce {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint64(b[8:16]), int64(binary.BigEndian.Uint64(b[16:24])), true
+}
@@ -0,0 +1,265 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"encoding/binary"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// dgramTransport is a PacketTransport over unprivileged ICMP datagram socket
+// (ping socket), which is allowed for groups in net.ipv4.ping_group_range.
+//
+// Kernel rewrites echo ID to the socket's local port, and doesn't deliver ICMP
+// errors as packets. With IP_RECVERR they are queued on the socket error queue,
+// from where we rebuild the ICMP error message for ICMPManager.
+type dgramTransport struct {
+	conn *net.UDPConn
+	raw  syscall.RawConn
+	v4   bool
+	id   int
+	p4   *ipv4.PacketConn
+	p6   *ipv6.PacketConn
+	// whether kernel receive timestamp is enabled
+	timestamp bool
+}
+
+func listenICMPDatagram(network string) (PacketTransport, error) {
+	v4 := network == "udp4"
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	level, opt := syscall.IPPROTO_IP, syscall.IP_RECVERR
+	var sa syscall.Sockaddr = &syscall.SockaddrInet4{}
+	if !v4 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR
+		sa = &syscall.SockaddrInet6{}
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.SetsockoptInt(fd, level, opt, 1); err != nil {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	f := os.NewFile(uintptr(fd), "icmp-datagram")
+	c, err := net.FilePacketConn(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := c.(*net.UDPConn)
+	if !ok {
+		_ = c.Close()
+		return nil, syscall.EPROTONOSUPPORT
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	t := &dgramTransport{
+		conn:      conn,
+		raw:       raw,
+		v4:        v4,
+		id:        conn.LocalAddr().(*net.UDPAddr).Port,
+		timestamp: enableRxTimestamp(conn) == nil,
+	}
+	_ = enableDontFragment(conn, v4)
+	if v4 {
+		t.p4 = ipv4.NewPacketConn(conn)
+	} else {
+		t.p6 = ipv6.NewPacketConn(conn)
+	}
+	return t, nil
+}
+
+func (t *dgramTransport) Mode() string {
+	return "datagram"
+}
+
+// EchoID returns the echo ID kernel will set
+func (t *dgramTransport) EchoID() int {
+	return t.id
+}
+
+func (t *dgramTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, src, _, err := t.ReadFromTimestamp(b)
+	return n, src, err
+}
+
+// ReadFromTimestamp is ReadFrom also returning the kernel receive time, or
+// zero time if not available.
+func (t *dgramTransport) ReadFromTimestamp(b []byte) (int, net.Addr, time.Time, error) {
+	buf := oobPool.Get().(*[]byte)
+	defer oobPool.Put(buf)
+	oob := *buf
+	n, oobn, _, src, err := t.conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		// a pending ICMP error is reported as read error
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return 0, nil, time.Time{}, err
+		}
+		if n, from, received, ok := t.readError(b); ok {
+			return n, from, received, nil
+		}
+		return 0, nil, time.Time{}, err
+	}
+	var received time.Time
+	if t.timestamp {
+		received, _ = rxTimestamp(oob[:oobn])
+	}
+	return n, &net.IPAddr{IP: src.IP}, received, nil
+}
+
+// readError reads an ICMP error from socket error queue, and rebuild the ICMP
+// error message into b. Also returns the kernel receive time of the error if
+// available.
+func (t *dgramTransport) readError(b []byte) (int, net.Addr, time.Time, bool) {
+	buf := packetPool.Get().(*[]byte)
+	defer packetPool.Put(buf)
+	quoted := *buf
+	oobBuf := oobPool.Get().(*[]byte)
+	defer oobPool.Put(oobBuf)
+	oob := *oobBuf
+	var n, oobn int
+	var to syscall.Sockaddr
+	var recvErr error
+	err := t.raw.Read(func(fd uintptr) bool {
+		n, oobn, _, to, recvErr = syscall.Recvmsg(int(fd), quoted, oob, syscall.MSG_ERRQUEUE)
+		return true
+	})
+	if err != nil || recvErr != nil {
+		return 0, nil, time.Time{}, false
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, time.Time{}, false
+	}
+	var received time.Time
+	if t.timestamp {
+		received, _ = rxTimestamp(oob[:oobn])
+	}
+	for _, m := range msgs {
+		if !(m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_RECVERR) &&
+			!(m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_RECVERR) {
+			continue
+		}
+		// struct sock_extended_err: errno(4) origin(1) type(1) code(1) pad(1)
+		// info(4) data(4), followed by sockaddr of the offender.
+		ee := m.Data
+		if len(ee) < 16 || (ee[4] != 2 && ee[4] != 3) { // SO_EE_ORIGIN_ICMP, SO_EE_ORIGIN_ICMP6
+			continue
+		}
+		typ, code := int(ee[5]), int(ee[6])
+		// next-hop MTU of Fragmentation Needed or Packet Too Big
+		info := *(*uint32)(unsafe.Pointer(&ee[8]))
+		var offender, target net.IP
+		var msg icmp.Message
+		if t.v4 {
+			// sockaddr_in: family(2) port(2) addr(4)
+			if len(ee) < 16+8 {
+				continue
+			}
+			offender = net.IP(append([]byte(nil), ee[20:24]...))
+			if sa, ok := to.(*syscall.SockaddrInet4); ok {
+				target = net.IP(append([]byte(nil), sa.Addr[:]...))
+			}
+			msg.Type = ipv4.ICMPType(typ)
+		} else {
+			// sockaddr_in6: family(2) port(2) flowinfo(4) addr(16) scope(4)
+			if len(ee) < 16+24 {
+				continue
+			}
+			offender = net.IP(append([]byte(nil), ee[24:40]...))
+			if sa, ok := to.(*syscall.SockaddrInet6); ok {
+				target = net.IP(append([]byte(nil), sa.Addr[:]...))
+			}
+			msg.Type = ipv6.ICMPType(typ)
+		}
+		if target == nil {
+			continue
+		}
+		var data []byte
+		if t.v4 {
+			data = quoteIPv4(nil, target, 1, 0, quoted[:n]) // iana.ProtocolICMP
+		} else {
+			data = quoteIPv6(nil, target, 58, 0, 0, quoted[:n]) // iana.ProtocolIPv6ICMP
+		}
+		msg.Code = code
+		switch msg.Type {
+		case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+			msg.Body = &icmp.TimeExceeded{Data: data}
+		case ipv4.ICMPTypeDestinationUnreachable, ipv6.ICMPTypeDestinationUnreachable:
+			msg.Body = &icmp.DstUnreach{Data: data}
+		case ipv6.ICMPTypePacketTooBig:
+			msg.Body = &icmp.PacketTooBig{MTU: int(info), Data: data}
+		default:
+			continue
+		}
+		r, err := msg.Marshal(nil)
+		if err != nil {
+			continue
+		}
+		if msg.Type == ipv4.ICMPTypeDestinationUnreachable && code == 4 {
+			// icmp package has no field for next-hop MTU. checksum is left
+			// stale as the message is only parsed by our receiver.
+			binary.BigEndian.PutUint16(r[6:8], uint16(info))
+		}
+		return copy(b, r), &net.IPAddr{IP: offender}, received, true
+	}
+	return 0, nil, time.Time{}, false
+}
+
+func (t *dgramTransport) WriteTo(b []byte, dst net.Addr, ttl int) (int, error) {
+	return t.WriteToOptions(b, dst, &WriteOptions{TTL: ttl})
+}
+
+// WriteToOptions is WriteTo with source address and outgoing interface.
+func (t *dgramTransport) WriteToOptions(b []byte, dst net.Addr, opts *WriteOptions) (int, error) {
+	ipAddr, ok := dst.(*net.IPAddr)
+	if !ok {
+		return 0, syscall.EAFNOSUPPORT
+	}
+	to := &net.UDPAddr{IP: ipAddr.IP, Zone: ipAddr.Zone}
+	if t.v4 {
+		return writeControl(t.conn, t.p4, nil, b, to, opts)
+	}
+	return writeControl(t.conn, nil, t.p6, b, to, opts)
+}
+
+func (t *dgramTransport) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+func (t *dgramTransport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,42 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !linux
+// +build !linux
+
+package network
+
+import (
+	"golang.org/x/net/icmp"
+	"math/rand"
+)
+
+// on platforms other than Linux, ICMP datagram socket keeps echo ID and
+// delivers ICMP errors the same as raw socket (if at all).
+func listenICMPDatagram(network string) (PacketTransport, error) {
+	conn, err := icmp.ListenPacket(network, "")
+	if err != nil {
+		return nil, err
+	}
+	return &icmpTransport{
+		conn:     conn,
+		p4:       conn.IPv4PacketConn(),
+		p6:       conn.IPv6PacketConn(),
+		v4:       conn.IPv4PacketConn() != nil,
+		datagram: true,
+		id:       rand.Intn(1 << 16),
+	}, nil
+}
@@ -0,0 +1,88 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"golang.org/x/net/icmp"
+	"net"
+)
+
+// An MPLSLabel is an entry of the MPLS label stack a probe carried when it
+// died, reported in ICMP extension (RFC 4950).
+type MPLSLabel struct {
+	Label int  `json:"label"`
+	TC    int  `json:"tc"`
+	S     bool `json:"s"`
+	TTL   int  `json:"ttl"`
+}
+
+// An InterfaceInfo identifies an interface of the responding router, reported
+// in ICMP extension (RFC 5837).
+type InterfaceInfo struct {
+	// 0: incoming interface, 1: sub-IP component of incoming interface,
+	// 2: outgoing interface, 3: next-hop
+	Role  int    `json:"role"`
+	Index int    `json:"index,omitempty"`
+	Name  string `json:"name,omitempty"`
+	MTU   int    `json:"mtu,omitempty"`
+	IP    net.IP `json:"ip,omitempty"`
+}
+
+// Extensions holds the ICMP extension objects (RFC 4884) we understand
+type Extensions struct {
+	MPLS       []MPLSLabel     `json:"mpls,omitempty"`
+	Interfaces []InterfaceInfo `json:"interfaces,omitempty"`
+}
+
+// newExtensions converts extensions parsed by icmp package. returns nil if
+// none is understood.
+func newExtensions(exts []icmp.Extension) *Extensions {
+	if len(exts) == 0 {
+		return nil
+	}
+	e := &Extensions{}
+	for _, ext := range exts {
+		switch ext := ext.(type) {
+		case *icmp.MPLSLabelStack:
+			for _, l := range ext.Labels {
+				e.MPLS = append(e.MPLS, MPLSLabel{
+					Label: l.Label,
+					TC:    l.TC,
+					S:     l.S,
+					TTL:   l.TTL,
+				})
+			}
+		case *icmp.InterfaceInfo:
+			info := InterfaceInfo{
+				Role: ext.Type >> 6,
+			}
+			if ext.Interface != nil {
+				info.Index = ext.Interface.Index
+				info.Name = ext.Interface.Name
+				info.MTU = ext.Interface.MTU
+			}
+			if ext.Addr != nil {
+				info.IP = ext.Addr.IP
+			}
+			e.Interfaces = append(e.Interfaces, info)
+		}
+	}
+	if e.MPLS == nil && e.Interfaces == nil {
+		return nil
+	}
+	return e
+}
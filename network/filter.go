@@ -0,0 +1,81 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"golang.org/x/net/bpf"
+)
+
+// A FilterStat counts ICMP messages of one address family around the socket
+// filter of a raw ICMP socket.
+type FilterStat struct {
+	// whether the filter is attached
+	Enabled bool
+	// messages passed the filter and read by the manager
+	Received uint64
+	// estimate of messages dropped by the filter. Kernel doesn't count them
+	// per socket, so it's the ICMP messages received by the host since the
+	// socket opened, from the system-wide counters of /proc/net/snmp, less
+	// Received. It also counts messages lost to full socket buffer, and is 0
+	// where the counters can't be read.
+	FilteredEstimate uint64
+}
+
+// accept length of socket filter, large enough for any packet
+const filterAccept = 1 << 18
+
+// icmpFilter builds the socket filter of raw ICMP (v4) or ICMPv6 socket. It
+// passes echo replies carrying id, and ICMP errors ICMPManager handles. IPv4
+// raw socket sees packets from IPv4 header, while IPv6 one from ICMPv6 header.
+func icmpFilter(v4 bool, id int) ([]bpf.RawInstruction, error) {
+	echoReply := uint32(129)
+	// Destination Unreachable, Packet Too Big, Time Exceeded
+	errTypes := []uint32{1, 2, 3}
+	if v4 {
+		// Echo Reply, Destination Unreachable, Time Exceeded
+		echoReply = 0
+		errTypes = []uint32{3, 11}
+	}
+	load := func(off uint32, size int) bpf.Instruction {
+		if v4 {
+			return bpf.LoadIndirect{Off: off, Size: size}
+		}
+		return bpf.LoadAbsolute{Off: off, Size: size}
+	}
+	var prog []bpf.Instruction
+	if v4 {
+		// X = IPv4 header length
+		prog = append(prog, bpf.LoadMemShift{Off: 0})
+	}
+	n := uint8(len(errTypes))
+	prog = append(prog,
+		// type
+		load(0, 1),
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: echoReply, SkipFalse: 2},
+		// echo identifier, accept or drop
+		load(4, 2),
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(uint16(id)), SkipTrue: n + 1, SkipFalse: n},
+	)
+	for i, t := range errTypes {
+		prog = append(prog, bpf.JumpIf{Cond: bpf.JumpEqual, Val: t, SkipTrue: n - uint8(i)})
+	}
+	prog = append(prog,
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: filterAccept},
+	)
+	return bpf.Assemble(prog)
+}
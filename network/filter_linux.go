@@ -0,0 +1,70 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// hostICMPInput returns the number of ICMP (v4) or ICMPv6 messages received
+// by the host, from InMsgs of /proc/net/snmp or Icmp6InMsgs of
+// /proc/net/snmp6.
+func hostICMPInput(v4 bool) (uint64, bool) {
+	if !v4 {
+		b, err := ioutil.ReadFile("/proc/net/snmp6")
+		if err != nil {
+			return 0, false
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "Icmp6InMsgs" {
+				n, err := strconv.ParseUint(fields[1], 10, 64)
+				return n, err == nil
+			}
+		}
+		return 0, false
+	}
+	b, err := ioutil.ReadFile("/proc/net/snmp")
+	if err != nil {
+		return 0, false
+	}
+	// "Icmp:" line of names followed by one of values
+	var names []string
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "Icmp:" {
+			continue
+		}
+		if names == nil {
+			names = fields
+			continue
+		}
+		for i := 1; i < len(fields) && i < len(names); i++ {
+			if names[i] == "InMsgs" {
+				n, err := strconv.ParseUint(fields[i], 10, 64)
+				return n, err == nil
+			}
+		}
+		return 0, false
+	}
+	return 0, false
+}
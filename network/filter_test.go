@@ -0,0 +1,121 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"testing"
+)
+
+// filterVM assembles icmpFilter and loads it back into a bpf.VM
+func filterVM(t *testing.T, v4 bool, id int) *bpf.VM {
+	raw, err := icmpFilter(v4, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog := make([]bpf.Instruction, len(raw))
+	for i, ins := range raw {
+		prog[i] = ins.Disassemble()
+	}
+	vm, err := bpf.NewVM(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
+
+// icmpPacket marshals an ICMP message of typ with body
+func icmpPacket(t *testing.T, typ icmp.Type, body icmp.MessageBody) []byte {
+	b, err := (&icmp.Message{Type: typ, Body: body}).Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// ipv4Packet prefixes b with an IPv4 header of options, as raw IPv4 sockets
+// read packets
+func ipv4Packet(t *testing.T, options []byte, b []byte) []byte {
+	h := &ipv4.Header{
+		Version:  4,
+		Len:      20 + len(options),
+		TotalLen: 20 + len(options) + len(b),
+		TTL:      64,
+		Protocol: 1,
+		Src:      simHop4.To4(),
+		Dst:      simLocal4.To4(),
+		Options:  options,
+	}
+	hb, err := h.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(hb, b...)
+}
+
+func TestICMPFilter(t *testing.T) {
+	const id = 0x1234
+	quote4 := quoteIPv4(simLocal4, simTarget4, 17, 0, udpHeader(40000, 33434))
+	quote6 := quoteIPv6(simLocal6, simTarget6, 17, 0, 0, udpHeader(40000, 33434))
+	// IPv4 No Operation options, padding the header to 24 bytes
+	nop := []byte{1, 1, 1, 1}
+	for _, c := range []struct {
+		name   string
+		v4     bool
+		b      []byte
+		accept bool
+	}{
+		{"v4 echo reply", true, ipv4Packet(t, nil, icmpPacket(t, ipv4.ICMPTypeEchoReply, &icmp.Echo{ID: id, Seq: 1})), true},
+		{"v4 echo reply after options", true, ipv4Packet(t, nop, icmpPacket(t, ipv4.ICMPTypeEchoReply, &icmp.Echo{ID: id, Seq: 1})), true},
+		{"v4 foreign echo reply", true, ipv4Packet(t, nil, icmpPacket(t, ipv4.ICMPTypeEchoReply, &icmp.Echo{ID: id + 1, Seq: 1})), false},
+		{"v4 echo request", true, ipv4Packet(t, nil, icmpPacket(t, ipv4.ICMPTypeEcho, &icmp.Echo{ID: id, Seq: 1})), false},
+		{"v4 time exceeded", true, ipv4Packet(t, nil, icmpPacket(t, ipv4.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: quote4})), true},
+		{"v4 time exceeded after options", true, ipv4Packet(t, nop, icmpPacket(t, ipv4.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: quote4})), true},
+		{"v4 destination unreachable", true, ipv4Packet(t, nil, icmpPacket(t, ipv4.ICMPTypeDestinationUnreachable, &icmp.DstUnreach{Data: quote4})), true},
+		{"v4 redirect", true, ipv4Packet(t, nil, icmpPacket(t, ipv4.ICMPTypeRedirect, &icmp.DefaultMessageBody{Data: make([]byte, 4)})), false},
+		{"v4 header only", true, ipv4Packet(t, nil, nil), false},
+		{"v6 echo reply", false, icmpPacket(t, ipv6.ICMPTypeEchoReply, &icmp.Echo{ID: id, Seq: 1}), true},
+		{"v6 foreign echo reply", false, icmpPacket(t, ipv6.ICMPTypeEchoReply, &icmp.Echo{ID: id + 1, Seq: 1}), false},
+		{"v6 echo request", false, icmpPacket(t, ipv6.ICMPTypeEchoRequest, &icmp.Echo{ID: id, Seq: 1}), false},
+		{"v6 time exceeded", false, icmpPacket(t, ipv6.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: quote6}), true},
+		{"v6 destination unreachable", false, icmpPacket(t, ipv6.ICMPTypeDestinationUnreachable, &icmp.DstUnreach{Data: quote6}), true},
+		{"v6 packet too big", false, icmpPacket(t, ipv6.ICMPTypePacketTooBig, &icmp.PacketTooBig{MTU: 1280, Data: quote6}), true},
+		{"v6 neighbor solicitation", false, icmpPacket(t, ipv6.ICMPTypeNeighborSolicitation, &icmp.DefaultMessageBody{Data: make([]byte, 20)}), false},
+		// ICMPv4 echo reply type means nothing to ICMPv6
+		{"v6 with v4 echo reply type", false, icmpPacket(t, ipv4.ICMPTypeEchoReply, &icmp.Echo{ID: id, Seq: 1}), false},
+		{"v6 empty", false, nil, false},
+	} {
+		n, err := filterVM(t, c.v4, id).Run(c.b)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if accept := n == filterAccept; accept != c.accept || n != 0 && !accept {
+			t.Fatalf("%s: filter returns %d, want accept %v", c.name, n, c.accept)
+		}
+	}
+}
+
+func TestICMPFilterID(t *testing.T) {
+	// the echo ID is 16 bits, higher bits of id are ignored
+	vm := filterVM(t, false, 0x10000+7)
+	if n, _ := vm.Run(icmpPacket(t, ipv6.ICMPTypeEchoReply, &icmp.Echo{ID: 7, Seq: 1})); n != filterAccept {
+		t.Fatal("echo reply of the low 16 bits of id dropped")
+	}
+}
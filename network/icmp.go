@@ -17,14 +17,18 @@
 package network
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
-	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -45,63 +49,72 @@ var IcmpUnreachableMsg = map[int]string{
 	13:  "Communication Administratively Prohibited",
 	14:  "Host precedence violation",
 	15:  "Precedence cutoff in effect",
-	256: "SetTimeout",  // non standard
-	257: "OK",          // non standard
-	258: "Time exceed", // non standard
+	256: "SetTimeout",                 // non standard
+	257: "OK",                         // non standard
+	258: "Time exceed",                // non standard
+	259: "Address family unavailable", // non standard
+	260: "No route to host",           // non standard, send error
+	261: "Network is unreachable",     // non standard, send error
+	262: "No buffer space available",  // non standard, send error
+	263: "Operation not permitted",    // non standard, send error
+	264: "Send failed",                // non standard, send error
+	265: "Cancelled",                  // non standard
+	266: "Message too long",           // non standard, send error
+	267: "Manager closed",             // non standard
+	268: "Packet too big",             // non standard, ICMPv6
 }
 
+// ErrFamilyUnavailable means the manager can't reach the address family
+// (IPv4 or IPv6) of the target.
+var ErrFamilyUnavailable = errors.New("address family unavailable")
+
 // An ICMPRequest represents an ICMPRequest issued by ping or trace for listener
 // to get corresponding Result
 type ICMPRequest struct {
-	// Seq used to identify request, and will be returned in Result to mark
+	// Key used to identify request in queue, carried in the payload cookie
+	Key int
+	// Seq is the low 16 bits of Key, used to identify request when the
+	// cookie is not quoted in ICMP errors
 	Seq int
 	// extend identify field
 	ID int
 	// target ip of the request, extend identify field
 	TargetIP net.IP
-	// return timeout Result if Deadline passed.
-	Deadline time.Time
-	// request issue time
-	IssueTime time.Time
-	// channel to return result
-	delivery chan *Result
-}
-
-func (r *ICMPRequest) SetTimeout(duration time.Duration) {
-	r.IssueTime = time.Now()
-	r.Deadline = r.IssueTime.Add(duration)
+	// echo data sent, to check reply against
+	Payload []byte
+	probeRequest
 }
 
-func (r ICMPRequest) Passed(time time.Time) bool {
-	return r.Deadline.Before(time)
-}
-
-func (r ICMPRequest) Deliver(response Response) bool {
-	if response == nil {
-		r.delivery <- &Result{
-			Code: 256,
+func (r *ICMPRequest) Deliver(response Response) bool {
+	if response != nil {
+		ID, TargetIP := response.GetIdentifier()
+		if ID != r.ID || !TargetIP.Equal(r.TargetIP) {
+			return false
 		}
-		close(r.delivery)
-		return true
-	}
-	ID, TargetIP := response.GetIdentifier()
-	if ID == r.ID && TargetIP.Equal(r.TargetIP) {
-		AddrIP, Received, Code := response.GetInformation()
-		if r.Passed(Received) {
-			r.delivery <- &Result{
-				Code: 256,
-			}
-		} else {
-			r.delivery <- &Result{
-				AddrIP:  AddrIP,
-				Latency: Received.Sub(r.IssueTime),
-				Code:    Code,
+		// reject stale replies of an earlier request with the same key
+		if res, ok := response.(*ICMPResponse); ok {
+			if res.Cookie && res.Sent != atomic.LoadInt64(&r.stamp) || !res.Cookie && res.Seq != r.Seq {
+				return false
 			}
 		}
-		close(r.delivery)
-		return true
 	}
-	return false
+	r.respond(response, r.check(response))
+	return true
+}
+
+// check returns function comparing payload of echo reply with what was sent
+func (r *ICMPRequest) check(response Response) func(*Result) {
+	res, ok := response.(*ICMPResponse)
+	if !ok || res.Data == nil {
+		return nil
+	}
+	return func(result *Result) {
+		if len(res.Data) < len(r.Payload) {
+			result.Truncated = true
+		} else if !bytes.Equal(res.Data[:len(r.Payload)], r.Payload) {
+			result.Corrupted = true
+		}
+	}
 }
 
 // An ICMPResponse represents an ICMPResponse (EchoReply, TimeExceed or DstUnreachable)
@@ -110,16 +123,43 @@ type ICMPResponse struct {
 	Seq int
 	// extend identify field
 	ID int
+	// whether the cookie of request is found. Key and Sent are only valid
+	// if it's set.
+	Cookie bool
+	// Key of the request
+	Key int
+	// send time of the request in unix nanoseconds
+	Sent int64
+	// next-hop MTU of Fragmentation Needed or Packet Too Big
+	MTU int
+	// payload of echo reply, nil for ICMP errors
+	Data []byte
+	// ICMP extensions of ICMP errors
+	Extensions *Extensions
+	// TOS (traffic class) of the probe header quoted in ICMP errors, -1 if
+	// not known
+	QuotedTOS int
 	// response source ip
 	AddrIP net.IP
 	// time passed from request time
 	Received time.Time
+	// clock source of Received
+	Clock ClockSource
 	// target ip of the request
 	TargetIP net.IP
 	// Code of ICMP destination unreachable message response
 	Code int
 }
 
+// setCookie reads the request cookie from echo payload b. return whether found.
+func (I *ICMPResponse) setCookie(b []byte) bool {
+	key, sent, ok := parseCookie(b)
+	if ok {
+		I.Cookie, I.Key, I.Sent = true, int(key), sent
+	}
+	return ok
+}
+
 func (I ICMPResponse) GetIdentifier() (int, net.IP) {
 	return I.ID, I.TargetIP
 }
@@ -128,90 +168,94 @@ func (I ICMPResponse) GetInformation() (net.IP, time.Time, int) {
 	return I.AddrIP, I.Received, I.Code
 }
 
+func (I ICMPResponse) GetClock() ClockSource {
+	return I.Clock
+}
+
+func (I ICMPResponse) annotate(result *Result) {
+	result.MTU = I.MTU
+	result.Extensions = I.Extensions
+}
+
+func (I ICMPResponse) quotedTOS() int {
+	return I.QuotedTOS
+}
+
 // A RawResponse represents an ICMPResponse (TimeExceed or DstUnreachable) of none-ICMP request
 type RawResponse struct {
 	// response source ip
 	AddrIP net.IP
 	// time passed from request time
 	Received time.Time
+	// clock source of Received
+	Clock ClockSource
 	// target ip of the request
 	TargetIP net.IP
+	// source ip of the request
+	SourceIP net.IP
 	// Code of ICMP destination unreachable message response
 	Code int
 	// Protocol is the protocol field recovered from IP Header
 	Protocol int
 	// Fragment is the first 8 bytes fragment of the request
 	Fragment []byte
+	// ICMP extensions of the message
+	Extensions *Extensions
+	// TOS (traffic class) of the quoted header, -1 if not known
+	QuotedTOS int
 }
 
 // An ICMPManager listens on ICMP and ICMPv6 packets and identify them to
 // response of corresponding request.
 type ICMPManager struct {
-	// queue stores the pending requests seq and their response channel.
-	// once it gots ICMPResponse it will send them back to the request owner.
-	// we don't use native map to ensure thread safety
-	//queue map[int]*ICMPRequest
-	queue *ConMapRequest
+	probeManager
 	// extListener stores external ICMP TimeExceed/DstUnreachable listeners
 	// which send other Protocol message(e.g. TCP, UDP) but expect ICMP reply
-	// messages.
-	extListener map[int]chan *RawResponse
-	// counter will fill the sequence field of the request (precisely 16bits)
-	// to identify packet. it will be increased for each call and can hold at
-	// most 65536 concurrent pending requests.
-	counter uint16
-	// l is the mutex to make counter increment thread safe.
-	l sync.Mutex
-	// context to send the manager stop message
-	ctx context.Context
-	// function to call to stop the manager
-	cancel context.CancelFunc
-	// icmp packet conn of related network
-	pConn4 *icmp.PacketConn
-	pConn6 *icmp.PacketConn
+	// messages, indexed by protocol.
+	extListener map[int][]*RawListener
+	// extL guards extListener
+	extL sync.RWMutex
+	// icmp packet transport of related network
+	pConn4 PacketTransport
+	pConn6 PacketTransport
+	// batch senders of IPv4 and IPv6, nil if batching is disabled
+	sender4 *batchSender
+	sender6 *batchSender
 }
 
+// manager is the shared manager returned by GetICMPManager, created with
+// managerBatch. both are guarded by managerL.
 var manager *ICMPManager
-var once sync.Once
+var managerBatch BatchConfig
+var managerL sync.Mutex
 
-// listen to ICMP socket to receive packet
-func ICMPv4Receiver(conn *icmp.PacketConn, wait time.Duration, icmpResponse chan *ICMPResponse,
+// ICMPv4Receiver reads ICMP messages from conn until ctx is done or conn is
+// closed. Replies and errors quoting echo requests are sent to icmpResponse,
+// errors quoting other protocols to rawResponse. Reads time out every wait to
+// check ctx.
+func ICMPv4Receiver(conn PacketTransport, wait time.Duration, icmpResponse chan *ICMPResponse,
 	rawResponse chan *RawResponse, ctx context.Context) {
-	select {
-	case <-ctx.Done():
-		return
-	default:
-	}
-	//conn, err := icmp.ListenPacket("ip4:icmp", "")
-	//if err != nil {
-	//    return
-	//}
-	// wait `wait` to receive some body
-	if err := conn.SetDeadline(time.Now().Add(wait)); err != nil {
-		return
-	}
-	readBytes := make([]byte, 1500) // max MTU
-	n, sAddr, connErr := conn.ReadFrom(readBytes)
-	now := time.Now()
-	go ICMPv4Receiver(conn, wait, icmpResponse, rawResponse, ctx)
-	if connErr != nil || sAddr == nil {
-		return
-	}
-	var ip net.IP
-	if _a, ok := sAddr.(*net.IPAddr); ok {
-		ip = _a.IP
-	} else {
-		return
-	}
+	receiveICMP(ctx, conn, wait, 1, parseICMPv4, func(r *ICMPResponse, raw *RawResponse) {
+		deliverResponse(ctx, r, raw, icmpResponse, rawResponse)
+	})
+}
+
+// parseICMPv4 parses ICMP message b received from ip. Echo replies and errors
+// quoting echo requests are returned as ICMPResponse, errors quoting other
+// protocols as RawResponse, and both are nil for anything else. Nothing
+// returned refers to b.
+func parseICMPv4(b []byte, ip net.IP, now time.Time, clock ClockSource) (*ICMPResponse, *RawResponse) {
 	r := &ICMPResponse{
-		Received: now,
-		AddrIP:   ip,
-		Code:     257,
+		Received:  now,
+		Clock:     clock,
+		AddrIP:    ip,
+		Code:      257,
+		QuotedTOS: -1,
 	}
-	// read the body received
-	msg, err := icmp.ParseMessage(1, readBytes[:n]) // iana.ProtocolICMP
+	// read the body received, icmp package copies what it keeps
+	msg, err := icmp.ParseMessage(1, b) // iana.ProtocolICMP
 	if err != nil {
-		return
+		return nil, nil
 	}
 	var bodyData []byte
 	switch body := msg.Body.(type) {
@@ -220,22 +264,34 @@ func ICMPv4Receiver(conn *icmp.PacketConn, wait time.Duration, icmpResponse chan
 		r.TargetIP = r.AddrIP
 		r.ID = body.ID
 		r.Seq = body.Seq
-		icmpResponse <- r
-		return
+		// echo reply carries back the whole payload. without our cookie
+		// it's not a reply of ours.
+		if !r.setCookie(body.Data) {
+			return nil, nil
+		}
+		r.Data = body.Data
+		return r, nil
 	case *icmp.TimeExceeded:
 		if msg.Code != 0 {
-			return
+			return nil, nil
 		} // We don't care Code 1: Fragment reassembly time exceeded.
 		r.Code = 258
 		bodyData = body.Data
+		r.Extensions = newExtensions(body.Extensions)
 		// let code below process
 	case *icmp.DstUnreach:
 		r.Code = msg.Code
 		bodyData = body.Data
+		r.Extensions = newExtensions(body.Extensions)
+		// Fragmentation Needed carries next-hop MTU in the low 16 bits of
+		// the unused field (RFC 1191)
+		if msg.Code == 4 && len(b) >= 8 {
+			r.MTU = int(binary.BigEndian.Uint16(b[6:8]))
+		}
 		// let code below process
 	// this message may not be icmpResponse of our request.
 	default:
-		return
+		return nil, nil
 	}
 	// Recover identification from response body which contains request header.
 	// ICMP type 11 Data Structure, From IANA:
@@ -243,75 +299,67 @@ func ICMPv4Receiver(conn *icmp.PacketConn, wait time.Duration, icmpResponse chan
 	// 20 bytes (In our case) IP Header of source message
 	// 8 bytes  Head of Payload msg (full Echo msg in our case)
 	if len(bodyData) < 28 {
-		return
+		return nil, nil
 	}
 	head, err := ipv4.ParseHeader(bodyData[:20])
 	if err != nil {
-		return
+		return nil, nil
 	}
 	r.TargetIP = head.Dst.To16()
+	// header rebuilt from socket error queue has no source
+	if !head.Src.IsUnspecified() {
+		r.QuotedTOS = head.TOS
+	}
 	if head.Protocol == 1 { // iana.ProtocolICMP
-		msgSend, err := icmp.ParseMessage(1, bodyData[20:28]) // iana.ProtocolICMP
+		msgSend, err := icmp.ParseMessage(1, bodyData[20:]) // iana.ProtocolICMP
 		if err != nil {
-			return
+			return nil, nil
 		}
 		// discard ICMP but not Echo message. That can't be response of our packets
 		if sendBody, ok := msgSend.Body.(*icmp.Echo); ok {
 			r.ID = sendBody.ID
 			r.Seq = sendBody.Seq
-			icmpResponse <- r
-		}
-	} else {
-		// request not ICMP Protocol. Let rawResponse dispatcher process it.
-		rawResponse <- &RawResponse{
-			AddrIP:   r.AddrIP,
-			Received: r.Received,
-			TargetIP: r.TargetIP,
-			Protocol: head.Protocol,
-			Code:     r.Code,
-			Fragment: bodyData[20:],
+			r.setCookie(sendBody.Data)
+			return r, nil
 		}
+		return nil, nil
+	}
+	// request not ICMP Protocol. Let rawResponse dispatcher process it.
+	return nil, &RawResponse{
+		AddrIP:     r.AddrIP,
+		Received:   r.Received,
+		Clock:      r.Clock,
+		TargetIP:   r.TargetIP,
+		SourceIP:   head.Src.To16(),
+		Protocol:   head.Protocol,
+		Code:       r.Code,
+		Fragment:   bodyData[20:],
+		Extensions: r.Extensions,
+		QuotedTOS:  r.QuotedTOS,
 	}
 }
 
-// listen to ICMPv6 socket to receive packet
-func ICMPv6Receiver(conn *icmp.PacketConn, wait time.Duration, icmpResponse chan *ICMPResponse,
+// ICMPv6Receiver is ICMPv4Receiver of ICMPv6
+func ICMPv6Receiver(conn PacketTransport, wait time.Duration, icmpResponse chan *ICMPResponse,
 	rawResponse chan *RawResponse, ctx context.Context) {
-	select {
-	case <-ctx.Done():
-		return
-	default:
-	}
-	//conn, err := icmp.ListenPacket("ip6:ipv6-icmp", "")
-	//if err != nil {
-	//    return
-	//}
-	// wait `wait` to receive some body
-	if err := conn.SetDeadline(time.Now().Add(wait)); err != nil {
-		return
-	}
-	readBytes := make([]byte, 1500) // max MTU
-	n, sAddr, connErr := conn.ReadFrom(readBytes)
-	now := time.Now()
-	go ICMPv6Receiver(conn, wait, icmpResponse, rawResponse, ctx)
-	if connErr != nil || sAddr == nil {
-		return
-	}
-	var ip net.IP
-	if _a, ok := sAddr.(*net.IPAddr); ok {
-		ip = _a.IP
-	} else {
-		return
-	}
+	receiveICMP(ctx, conn, wait, 1, parseICMPv6, func(r *ICMPResponse, raw *RawResponse) {
+		deliverResponse(ctx, r, raw, icmpResponse, rawResponse)
+	})
+}
+
+// parseICMPv6 is parseICMPv4 of ICMPv6
+func parseICMPv6(b []byte, ip net.IP, now time.Time, clock ClockSource) (*ICMPResponse, *RawResponse) {
 	r := &ICMPResponse{
-		Received: now,
-		AddrIP:   ip,
-		Code:     257,
+		Received:  now,
+		Clock:     clock,
+		AddrIP:    ip,
+		Code:      257,
+		QuotedTOS: -1,
 	}
-	// read the body received
-	msg, err := icmp.ParseMessage(58, readBytes[:n]) // iana.ProtocolIPv6ICMP
+	// read the body received, icmp package copies what it keeps
+	msg, err := icmp.ParseMessage(58, b) // iana.ProtocolIPv6ICMP
 	if err != nil {
-		return
+		return nil, nil
 	}
 	var bodyData []byte
 	switch body := msg.Body.(type) {
@@ -320,22 +368,34 @@ func ICMPv6Receiver(conn *icmp.PacketConn, wait time.Duration, icmpResponse chan
 		r.TargetIP = r.AddrIP
 		r.ID = body.ID
 		r.Seq = body.Seq
-		icmpResponse <- r
-		return
+		// echo reply carries back the whole payload. without our cookie
+		// it's not a reply of ours.
+		if !r.setCookie(body.Data) {
+			return nil, nil
+		}
+		r.Data = body.Data
+		return r, nil
 	case *icmp.TimeExceeded:
 		if msg.Code != 0 {
-			return
+			return nil, nil
 		} // We don't care Code 1: Fragment reassembly time exceeded.
 		r.Code = 258
 		bodyData = body.Data
+		r.Extensions = newExtensions(body.Extensions)
 		// let code below process
 	case *icmp.DstUnreach:
 		r.Code = msg.Code
 		bodyData = body.Data
+		r.Extensions = newExtensions(body.Extensions)
 		// let code below process
+	case *icmp.PacketTooBig:
+		// code 4 is Port Unreachable in ICMPv6 destination unreachable
+		r.Code = CodePacketTooBig
+		r.MTU = body.MTU
+		bodyData = body.Data
 	// this message may not be icmpResponse of our request.
 	default:
-		return
+		return nil, nil
 	}
 	// Recover identification from response body which contains request header.
 	// ICMPv6 type 3 Data Part Structure, From IANA:
@@ -343,80 +403,236 @@ func ICMPv6Receiver(conn *icmp.PacketConn, wait time.Duration, icmpResponse chan
 	// 40 bytes (In our case) IPv6 Header of source message
 	// 8 bytes  Head of Payload msg (full Echo msg in our case)
 	if len(bodyData) < 48 {
-		return
+		return nil, nil
 	}
 	head, err := ipv6.ParseHeader(bodyData[:40])
 	if err != nil {
-		return
+		return nil, nil
 	}
 	r.TargetIP = head.Dst.To16()
+	// header rebuilt from socket error queue has no source
+	if !head.Src.IsUnspecified() {
+		r.QuotedTOS = head.TrafficClass
+	}
 	if head.NextHeader == 58 { // iana.ProtocolIPv6ICMP
-		msgSend, err := icmp.ParseMessage(58, bodyData[40:48]) // iana.ProtocolIPv6ICMP
+		msgSend, err := icmp.ParseMessage(58, bodyData[40:]) // iana.ProtocolIPv6ICMP
 		if err != nil {
-			return
+			return nil, nil
 		}
 		// discard ICMPv6 but not Echo message. That can't be response of our packets
 		if sendBody, ok := msgSend.Body.(*icmp.Echo); ok {
 			r.ID = sendBody.ID
 			r.Seq = sendBody.Seq
-			icmpResponse <- r
+			r.setCookie(sendBody.Data)
+			return r, nil
 		}
-	} else {
-		// request not ICMPv6 Protocol. Let rawResponse icmpDispatcher process it.
-		rawResponse <- &RawResponse{
-			AddrIP:   r.AddrIP,
-			Received: r.Received,
-			TargetIP: r.TargetIP,
-			Protocol: head.NextHeader,
-			Code:     r.Code,
-			Fragment: bodyData[40:],
+		return nil, nil
+	}
+	// request not ICMPv6 Protocol. Let rawResponse dispatcher process it.
+	return nil, &RawResponse{
+		AddrIP:     r.AddrIP,
+		Received:   r.Received,
+		Clock:      r.Clock,
+		TargetIP:   r.TargetIP,
+		SourceIP:   head.Src.To16(),
+		Protocol:   head.NextHeader,
+		Code:       r.Code,
+		Fragment:   bodyData[40:],
+		Extensions: r.Extensions,
+		QuotedTOS:  r.QuotedTOS,
+	}
+}
+
+// receiveICMP reads ICMP messages from conn, up to batch messages per system
+// call if conn supports it, and passes what parse returns to deliver.
+func receiveICMP(ctx context.Context, conn PacketTransport, wait time.Duration, batch int,
+	parse func([]byte, net.IP, time.Time, ClockSource) (*ICMPResponse, *RawResponse),
+	deliver func(*ICMPResponse, *RawResponse)) {
+	handle := func(b []byte, ip net.IP, now time.Time, clock ClockSource) {
+		deliver(parse(b, ip, now, clock))
+	}
+	if t, ok := conn.(batchTransport); ok && batch > 1 {
+		receiveBatchLoop(ctx, t, wait, batch, handle)
+		return
+	}
+	receiveLoop(ctx, conn, wait, handle)
+}
+
+// deliverResponse sends the parsed response to its dispatcher, giving up when
+// ctx is done as the dispatcher may have exited.
+func deliverResponse(ctx context.Context, r *ICMPResponse, raw *RawResponse,
+	icmpResponse chan *ICMPResponse, rawResponse chan *RawResponse) {
+	switch {
+	case r != nil:
+		select {
+		case icmpResponse <- r:
+		case <-ctx.Done():
+		}
+	case raw != nil:
+		select {
+		case rawResponse <- raw:
+		case <-ctx.Done():
 		}
 	}
 }
 
+// NewICMPManager creates an ICMPManager sending and receiving through the
+// transports. Either transport can be nil if that address family isn't
+// available. Most callers want GetICMPManager instead.
+func NewICMPManager(v4, v6 PacketTransport) *ICMPManager {
+	return NewICMPManagerBatch(v4, v6, BatchConfig{})
+}
+
+// NewICMPManagerBatch is NewICMPManager batching packets as configured by
+// batch, on transports supporting it.
+//
+// Batched probes are sent after IssueContext returns, so it returns nil error
+// for them even if sending fails. The send error is delivered as the Result
+// instead, with a send error code like CodeSendFailed.
+func NewICMPManagerBatch(v4, v6 PacketTransport, batch BatchConfig) *ICMPManager {
+	mgr := &ICMPManager{
+		extListener: make(map[int][]*RawListener),
+		pConn4:      v4,
+		pConn6:      v6,
+	}
+	mgr.init()
+	result := make(chan Response, 1024)
+	raw := make(chan *RawResponse, 1024)
+	deliver := func(r *ICMPResponse, rawResponse *RawResponse) {
+		switch {
+		case r != nil:
+			mgr.forward(result, r)
+		case rawResponse != nil:
+			select {
+			case raw <- rawResponse:
+			case <-mgr.ctx.Done():
+			}
+		}
+	}
+	if v4 != nil {
+		spawn(&mgr.wg, func() { receiveICMP(mgr.ctx, v4, 1000*time.Millisecond, batch.Size, parseICMPv4, deliver) })
+		if mgr.sender4 = newBatchSender(v4, true, batch); mgr.sender4 != nil {
+			spawn(&mgr.wg, func() { mgr.sender4.run(mgr.ctx) })
+		}
+	}
+	if v6 != nil {
+		spawn(&mgr.wg, func() { receiveICMP(mgr.ctx, v6, 1000*time.Millisecond, batch.Size, parseICMPv6, deliver) })
+		if mgr.sender6 = newBatchSender(v6, false, batch); mgr.sender6 != nil {
+			spawn(&mgr.wg, func() { mgr.sender6.run(mgr.ctx) })
+		}
+	}
+	spawn(&mgr.wg, func() { mgr.dispatcher(result, mgr.dispatchICMP) })
+	spawn(&mgr.wg, func() { mgr.rawDispatcher(raw) })
+	return mgr
+}
+
 // return ICMPManager to caller. As listening to ICMP will receive all ICMP
-// packet, there will be only one manager in the whole process.
+// packet, there will be only one manager in the whole process. The manager
+// serves whichever address families are available, and panics only if
+// neither is. Once the manager is closed, the next call creates a new one.
 func GetICMPManager() *ICMPManager {
-	once.Do(func() {
-		ctx, cancel := context.WithCancel(context.Background())
-		manager = &ICMPManager{
-			queue:   NewCMap(32),
-			counter: 0,
-			ctx:     ctx,
-			cancel:  cancel,
-		}
-		result4 := make(chan *ICMPResponse, 1024)
-		result6 := make(chan *ICMPResponse, 1024)
-		raw4 := make(chan *RawResponse, 1024)
-		raw6 := make(chan *RawResponse, 1024)
-		conn4, err := icmp.ListenPacket("ip4:icmp", "")
-		if err != nil {
-			panic(fmt.Sprintf("Can't listen to ICMP: %s", err))
+	managerL.Lock()
+	defer managerL.Unlock()
+	if manager == nil || manager.closed() {
+		manager = listenICMPManager()
+	}
+	return manager
+}
+
+// listenICMPManager creates an ICMPManager on ICMP sockets
+func listenICMPManager() *ICMPManager {
+	// fallback to unprivileged datagram socket if we can't open raw socket
+	conn4, err4 := ListenICMP("ip4:icmp")
+	if err4 != nil {
+		var errD error
+		if conn4, errD = ListenICMP("udp4"); errD != nil {
+			err4 = fmt.Errorf("%s, %s", err4, errD)
+		} else {
+			err4 = nil
 		}
-		manager.pConn4 = conn4
-		conn6, err := icmp.ListenPacket("ip6:ipv6-icmp", "")
-		if err != nil {
-			panic(fmt.Sprintf("Can't listen to ICMPv6: %s", err))
+	}
+	conn6, err6 := ListenICMP("ip6:ipv6-icmp")
+	if err6 != nil {
+		var errD error
+		if conn6, errD = ListenICMP("udp6"); errD != nil {
+			err6 = fmt.Errorf("%s, %s", err6, errD)
+		} else {
+			err6 = nil
 		}
-		manager.pConn6 = conn6
-		go ICMPv4Receiver(conn4, 1000*time.Millisecond, result4, raw4, ctx)
-		go ICMPv6Receiver(conn6, 1000*time.Millisecond, result6, raw6, ctx)
-		go manager.icmpDispatcher(result4, result6)
-		go manager.rawDispatcher(raw4, raw6)
-		// warm-up
+	}
+	if err4 != nil && err6 != nil {
+		panic(fmt.Sprintf("Can't listen to ICMP: %s; ICMPv6: %s", err4, err6))
+	}
+	mgr := NewICMPManagerBatch(conn4, conn6, managerBatch)
+	// warm-up
+	if conn4 != nil {
 		addr, _ := net.ResolveIPAddr("", "127.0.0.1")
-		manager.Issue(addr, 100, time.Second)
-		addr, _ = net.ResolveIPAddr("", "::1")
-		manager.Issue(addr, 100, time.Second)
-	})
-	return manager
+		mgr.Issue(addr, 100, time.Second)
+	}
+	if conn6 != nil {
+		addr, _ := net.ResolveIPAddr("", "::1")
+		mgr.Issue(addr, 100, time.Second)
+	}
+	return mgr
+}
+
+// Mode returns how the manager reaches IPv4 and IPv6 network, "raw" for raw
+// socket, "datagram" for unprivileged ICMP datagram socket, "disabled" if the
+// family is unavailable.
+func (mgr *ICMPManager) Mode() (v4, v6 string) {
+	return transportMode(mgr.pConn4), transportMode(mgr.pConn6)
+}
+
+// Families returns whether IPv4 and IPv6 are enabled
+func (mgr *ICMPManager) Families() (v4, v6 bool) {
+	return mgr.pConn4 != nil, mgr.pConn6 != nil
+}
+
+// FilterStats returns counters of the socket filters on IPv4 and IPv6
+// transports. Transports without filter, e.g. datagram sockets which only
+// receive their own echo replies, report a disabled FilterStat.
+func (mgr *ICMPManager) FilterStats() (v4, v6 FilterStat) {
+	return filterStat(mgr.pConn4), filterStat(mgr.pConn6)
+}
+
+func filterStat(t PacketTransport) FilterStat {
+	if f, ok := t.(interface{ FilterStat() FilterStat }); ok {
+		return f.FilterStat()
+	}
+	return FilterStat{}
+}
+
+// CheckFamily returns ErrFamilyUnavailable if the manager can't reach ip
+func (mgr *ICMPManager) CheckFamily(ip net.IP) error {
+	return checkFamily(ip, mgr.pConn4 != nil, mgr.pConn6 != nil)
+}
+
+// SetICMPBatch sets how managers created by GetICMPManager afterwards batch
+// packets. Batching is disabled by default.
+func SetICMPBatch(batch BatchConfig) {
+	managerL.Lock()
+	managerBatch = batch
+	managerL.Unlock()
+}
+
+// SetICMPManager makes GetICMPManager return mgr, e.g. one created on a
+// SimNetwork, until mgr is closed. The manager it replaces is left open.
+func SetICMPManager(mgr *ICMPManager) {
+	managerL.Lock()
+	manager = mgr
+	managerL.Unlock()
 }
 
 // Issue an ICMP echo request. return a channel to send result back
-func (mgr *ICMPManager) Issue(ip net.Addr, ttl int, timeout time.Duration) (delivery chan *Result) {
+func (mgr *ICMPManager) Issue(ip net.Addr, ttl int, timeout time.Duration) chan *Result {
+	return resolved(mgr.IssueContext(context.Background(), ip, &Probe{TTL: ttl, Timeout: timeout}))
+}
+
+// IssueContext issue an ICMP Echo probe to ip, which must be *net.IPAddr.
+func (mgr *ICMPManager) IssueContext(ctx context.Context, ip net.Addr, probe *Probe) (chan *Result, error) {
 	ipAddr, ok := ip.(*net.IPAddr)
 	if !ok {
-		return nil
+		return nil, fmt.Errorf("unsupported address type %T", ip)
 	}
 	dest := ipAddr.IP.To4()
 	v4 := true
@@ -424,122 +640,198 @@ func (mgr *ICMPManager) Issue(ip net.Addr, ttl int, timeout time.Duration) (deli
 		v4 = false
 	}
 	dest = ipAddr.IP.To16()
+	if v4 && mgr.pConn4 == nil || !v4 && mgr.pConn6 == nil {
+		return unavailable(), ErrFamilyUnavailable
+	}
+	if probe.Source != nil && (probe.Source.To4() != nil) != v4 {
+		return nil, ErrSourceFamily
+	}
+	ifIndex, err := probeInterface(probe)
+	if err != nil {
+		return nil, err
+	}
+	if probe.Size > MaxPacketSize {
+		return nil, fmt.Errorf("probe size %d exceeds %d: %w", probe.Size, MaxPacketSize, syscall.EMSGSIZE)
+	}
 
-	mgr.l.Lock()
-	count := mgr.counter
-	mgr.counter++
-	mgr.l.Unlock()
+	// Key is carried in payload cookie to identify packet. Its low 16 bits
+	// fill the sequence field, which identifies packet when ICMP errors
+	// quote only 8 bytes of our request.
+	count := mgr.nextKey()
 
-	id := rand.Intn(1 << 16)
-	var msg []byte
+	var id int
 	if v4 {
-		echo := icmp.Message{
-			Type: ipv4.ICMPTypeEcho,
-			Code: 0,
-			Body: &icmp.Echo{
-				ID:   id,
-				Seq:  int(count),
-				Data: nil,
-			}}
-		msg, _ = echo.Marshal(nil)
+		id = echoID(mgr.pConn4)
 	} else {
+		id = echoID(mgr.pConn6)
+	}
+	request := &ICMPRequest{
+		Key:      int(count),
+		Seq:      int(uint16(count)),
+		ID:       id,
+		TargetIP: dest,
+	}
+	request.init(ctx, probe)
+	// the cookie is filled in right before writing, see build
+	data := make([]byte, cookieLen)
+	// pad to the requested size: IP header, ICMP header(8) and payload
+	header := 20 + 8
+	if !v4 {
+		header = 40 + 8
+	}
+	if probe.Size > header+len(data) {
+		pad := make([]byte, probe.Size-header-len(data))
+		if len(probe.Fill) != 0 {
+			for i := range pad {
+				pad[i] = probe.Fill[i%len(probe.Fill)]
+			}
+		}
+		data = append(data, pad...)
+	}
+	request.Payload = data
+	request.duplicate = probe.Duplicate
+	// build fills the cookie with stamp, which replies are checked against,
+	// and returns the message
+	build := func(stamp time.Time) []byte {
+		putCookie(data, count, stamp)
 		echo := icmp.Message{
-			Type: ipv6.ICMPTypeEchoRequest,
+			Type: ipv4.ICMPTypeEcho,
 			Code: 0,
 			Body: &icmp.Echo{
 				ID:   id,
-				Seq:  int(count),
-				Data: nil,
+				Seq:  request.Seq,
+				Data: data,
 			}}
-		msg, _ = echo.Marshal(nil)
+		if !v4 {
+			echo.Type = ipv6.ICMPTypeEchoRequest
+		}
+		msg, _ := echo.Marshal(nil)
+		return msg
 	}
 
-	delivery = make(chan *Result, 1)
-	mgr.queue.Set(int(count), &ICMPRequest{
-		Seq:      int(count),
-		ID:       id,
-		TargetIP: dest,
-		delivery: delivery,
-	}, timeout)
+	if !mgr.enqueue(ctx, request.Key, request, &request.probeRequest, probe.Timeout) {
+		return request.delivery, ErrClosed
+	}
 
-	if v4 {
-		if err := mgr.pConn4.IPv4PacketConn().SetTTL(ttl); err != nil {
-			return nil
-		}
-		_, _ = mgr.pConn4.WriteTo(msg, ipAddr)
-	} else {
-		if err := mgr.pConn6.IPv6PacketConn().SetHopLimit(ttl); err != nil {
-			return nil
-		}
-		_, _ = mgr.pConn6.WriteTo(msg, ipAddr)
+	conn, sender := mgr.pConn4, mgr.sender4
+	if !v4 {
+		conn, sender = mgr.pConn6, mgr.sender6
 	}
+	opts := &WriteOptions{
+		TTL:       probe.TTL,
+		Source:    probe.Source,
+		IfIndex:   ifIndex,
+		TOS:       probe.TOS,
+		FlowLabel: probe.FlowLabel,
+	}
+	if sender != nil {
+		sender.push(mgr.ctx, &outPacket{
+			build: func(stamp time.Time) []byte {
+				request.stamped(stamp)
+				return build(stamp)
+			},
+			dst:  ipAddr,
+			opts: opts,
+			sent: request.transmitted,
+			fail: func(err error) {
+				sendFailed(mgr.queue, request.Key, request, err)
+			},
+		})
+		return request.delivery, nil
+	}
+	err = send(mgr.queue, request.Key, request, &request.probeRequest, func(stamp time.Time) error {
+		_, err := writeTo(conn, build(stamp), ipAddr, opts)
+		return err
+	})
+	return request.delivery, err
+}
 
-	return
+// dispatchICMP delivers response to the request carried in its cookie, or
+// by its Seq without cookie.
+func (mgr *ICMPManager) dispatchICMP(r Response) {
+	response := r.(*ICMPResponse)
+	if response.Cookie {
+		dispatch(mgr.queue, response.Key, response)
+	} else {
+		mgr.dispatchLow(uint16(response.Seq), response)
+	}
 }
 
-// icmpDispatcher send Result back to their caller
-func (mgr *ICMPManager) icmpDispatcher(v4, v6 chan *ICMPResponse) {
-	ticker := time.NewTicker(10 * time.Millisecond)
+// rawDispatcher send RawResponse back to registered listener
+func (mgr *ICMPManager) rawDispatcher(raw chan *RawResponse) {
 	for {
-		now := time.Now()
-		var response *ICMPResponse = nil
+		var response *RawResponse = nil
 		select {
-		case response = <-v4:
-		case response = <-v6:
-		case <-ticker.C:
+		case <-mgr.ctx.Done():
+			return
+		case response = <-raw:
 		}
-
-		if response != nil {
-			if request, exists := mgr.queue.Get(response.Seq); exists {
-				if request.Deliver(response) {
-					mgr.queue.Remove(response.Seq)
+		// send to every listener of such protocol interested in it
+		mgr.extL.RLock()
+		for _, listener := range mgr.extListener[response.Protocol] {
+			if listener.Filter.Match(response) {
+				select {
+				case listener.C <- response:
+				default: // listener is congested, don't block others
 				}
 			}
 		}
+		mgr.extL.RUnlock()
+	}
+}
 
-		timeout := make([]int, 0)
-		for t := range mgr.queue.IterBuffered() {
-			if t.Val.Passed(now) {
-				timeout = append(timeout, t.Key)
-				t.Val.Deliver(nil)
-			}
-		}
-		for _, key := range timeout {
-			mgr.queue.Remove(key)
-		}
-		// just cleaned. No need to do it again.
-		select {
-		case <-ticker.C:
-		default:
-		}
+// RegisterListener subscribes ICMP errors quoting packets matching filter.
+// Matched RawResponse will be sent to channel, and dropped if channel is full.
+// Call UnregisterListener with the returned RawListener to unsubscribe.
+func (mgr *ICMPManager) RegisterListener(filter RawFilter, channel chan *RawResponse) *RawListener {
+	listener := &RawListener{
+		Filter: filter,
+		C:      channel,
 	}
+	mgr.extL.Lock()
+	mgr.extListener[filter.Protocol] = append(mgr.extListener[filter.Protocol], listener)
+	mgr.extL.Unlock()
+	return listener
 }
 
-// rawDispatcher send RawResponse back to registered listener
-func (mgr *ICMPManager) rawDispatcher(v4, v6 chan *RawResponse) {
-	for {
-		var response *RawResponse = nil
-		select {
-		case response = <-v4:
-		case response = <-v6:
-		}
-		// if listener for such protocol is presented
-		if channel, ok := mgr.extListener[response.Protocol]; ok {
-			channel <- response
+// UnregisterListener removes the listener. Once it returns no more RawResponse
+// will be sent to the listener's channel, and the channel can be safely closed.
+func (mgr *ICMPManager) UnregisterListener(listener *RawListener) {
+	mgr.extL.Lock()
+	defer mgr.extL.Unlock()
+	listeners := mgr.extListener[listener.Filter.Protocol]
+	for i, l := range listeners {
+		if l == listener {
+			listeners = append(listeners[:i:i], listeners[i+1:]...)
+			break
 		}
 	}
+	if len(listeners) == 0 {
+		delete(mgr.extListener, listener.Filter.Protocol)
+	} else {
+		mgr.extListener[listener.Filter.Protocol] = listeners
+	}
 }
 
+// Finish closes the manager, see Close
 func (mgr *ICMPManager) Finish() {
-	mgr.cancel()
+	_ = mgr.Close()
+}
+
+// Close stops the manager. It closes the transports, waits for receivers and
+// dispatchers to exit, and finishes pending requests with CodeShutdown.
+// Probes issued afterwards fail with ErrClosed. Close returns the error of
+// closing the transports, and is a no-op once called.
+func (mgr *ICMPManager) Close() error {
+	return mgr.shutdown(mgr.pConn4, mgr.pConn6)
 }
 
+// FinishICMPManager closes the manager returned by GetICMPManager
 func FinishICMPManager() {
-	if manager != nil && manager.ctx.Done() != nil {
-		select {
-		case <-manager.ctx.Done():
-		default:
-			manager.cancel()
-		}
+	managerL.Lock()
+	mgr := manager
+	managerL.Unlock()
+	if mgr != nil {
+		_ = mgr.Close()
 	}
 }
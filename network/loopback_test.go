@@ -0,0 +1,103 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux && loopback
+// +build linux,loopback
+
+package network
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// BenchmarkLoopback measures echo round trips to loopback on real sockets,
+// one packet per system call and batched with and without waiting for the
+// batch to fill, with 64 probes in flight. It reports packets per second and
+// CPU time per probe. Raw sockets need root, datagram
+// sockets net.ipv4.ping_group_range covering the user.
+//
+//	go test -tags loopback -run - -bench Loopback -benchtime 100000x ./network
+func BenchmarkLoopback(b *testing.B) {
+	const inflight = 64
+	for _, tt := range []struct {
+		network string
+		ip      net.IP
+	}{
+		{"ip4:icmp", net.IPv4(127, 0, 0, 1)},
+		{"ip6:ipv6-icmp", net.IPv6loopback},
+		{"udp4", net.IPv4(127, 0, 0, 1)},
+		{"udp6", net.IPv6loopback},
+	} {
+		for _, batch := range []BatchConfig{
+			{},
+			{Size: 32},
+			{Size: 32, Latency: 200 * time.Microsecond},
+		} {
+			b.Run(fmt.Sprintf("%s/batch=%d/wait=%v", tt.network, batch.Size, batch.Latency), func(b *testing.B) {
+				conn, err := ListenICMP(tt.network)
+				if err != nil {
+					b.Skipf("%s: %v", tt.network, err)
+				}
+				var mgr *ICMPManager
+				if tt.ip.To4() != nil {
+					mgr = NewICMPManagerBatch(conn, nil, batch)
+				} else {
+					mgr = NewICMPManagerBatch(nil, conn, batch)
+				}
+				defer mgr.Close()
+				target := &net.IPAddr{IP: tt.ip}
+
+				var timeouts int64
+				jobs := make(chan struct{}, inflight)
+				var wg sync.WaitGroup
+				for i := 0; i < inflight; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for range jobs {
+							if result := <-mgr.Issue(target, 64, time.Second); result.Code != CodeOK {
+								atomic.AddInt64(&timeouts, 1)
+							}
+						}
+					}()
+				}
+				var before, after syscall.Rusage
+				_ = syscall.Getrusage(syscall.RUSAGE_SELF, &before)
+				b.ResetTimer()
+				start := time.Now()
+				for i := 0; i < b.N; i++ {
+					jobs <- struct{}{}
+				}
+				close(jobs)
+				wg.Wait()
+				elapsed := time.Since(start)
+				b.StopTimer()
+				_ = syscall.Getrusage(syscall.RUSAGE_SELF, &after)
+
+				cpu := time.Duration(after.Utime.Nano() + after.Stime.Nano() - before.Utime.Nano() - before.Stime.Nano())
+				b.ReportMetric(float64(b.N)/elapsed.Seconds(), "pps")
+				b.ReportMetric(float64(cpu.Nanoseconds())/float64(b.N), "cpu-ns/probe")
+				b.ReportMetric(float64(timeouts)/float64(b.N), "lost/probe")
+			})
+		}
+	}
+}
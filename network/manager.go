@@ -17,12 +17,55 @@
 package network
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"io"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// Result codes besides ICMP Destination Unreachable codes (0-15).
+const (
+	// no response before deadline
+	CodeTimeout = 256
+	// target reached
+	CodeOK = 257
+	// TTL exceeded in transit
+	CodeTimeExceeded = 258
+	// manager can't reach the address family of target
+	CodeFamilyUnavailable = 259
+	// probe not sent: no route to host (EHOSTUNREACH)
+	CodeHostUnreachable = 260
+	// probe not sent: network unreachable (ENETUNREACH)
+	CodeNetUnreachable = 261
+	// probe not sent: no buffer space available (ENOBUFS)
+	CodeNoBuffer = 262
+	// probe not sent: operation not permitted, e.g. by firewall (EPERM)
+	CodePermission = 263
+	// probe not sent for other reasons
+	CodeSendFailed = 264
+	// request cancelled by its context
+	CodeCancelled = 265
+	// probe not sent: larger than the MTU of outgoing interface (EMSGSIZE)
+	CodeMessageSize = 266
+	// request dropped as the manager is closed
+	CodeShutdown = 267
+	// ICMPv6 Packet Too Big, the counterpart of Fragmentation Needed(4),
+	// which is Port Unreachable in ICMPv6
+	CodePacketTooBig = 268
+)
+
+// ErrClosed is returned when issuing probes on a closed manager
+var ErrClosed = errors.New("manager closed")
+
 // An Result represents an Result (EchoReply, TimeExceed or SetTimeout
 // without response)
 type Result struct {
@@ -32,26 +75,693 @@ type Result struct {
 	Latency time.Duration `json:"latency"`
 	// ICMP code
 	Code int `json:"code"`
+	// where the receive time comes from
+	Clock ClockSource `json:"clock"`
+	// next-hop MTU reported by Fragmentation Needed or Packet Too Big
+	MTU int `json:"mtu,omitempty"`
+	// echo reply payload is shorter than sent
+	Truncated bool `json:"truncated,omitempty"`
+	// echo reply payload differs from sent
+	Corrupted bool `json:"corrupted,omitempty"`
+	// ICMP extensions of the response, e.g. MPLS labels
+	Extensions *Extensions `json:"extensions,omitempty"`
+	// Remarked is set if the probe header quoted in ICMP error shows its
+	// DSCP was changed in transit, to QuotedTOS.
+	Remarked  bool `json:"remarked,omitempty"`
+	QuotedTOS int  `json:"quoted_tos,omitempty"`
+	// responses to the probe after the first one, counted by the issuer
+	// through Probe.Duplicate. Managers leave it 0.
+	Duplicates int `json:"duplicates,omitempty"`
+	// transmit time of the probe, which Latency counts from
+	IssueTime time.Time `json:"-"`
+}
+
+// ClockSource tells how the receive time of a response is taken
+type ClockSource int
+
+const (
+	// taken in user space after the response is read
+	ClockUser ClockSource = iota
+	// taken by kernel when the response arrives
+	ClockKernel
+)
+
+func (c ClockSource) String() string {
+	if c == ClockKernel {
+		return "kernel"
+	}
+	return "user"
+}
+
+// Replied reports whether the Result comes from a response in network, rather
+// than timeout or local failure.
+func (r *Result) Replied() bool {
+	return r.Code < CodeTimeout || r.Code == CodeOK || r.Code == CodeTimeExceeded
 }
 
+// A Probe describes how to send a probe.
+type Probe struct {
+	// TTL (hop limit) of the probe
+	TTL int
+	// time to wait for the response
+	Timeout time.Duration
+	// total size of the IP packet, padded if larger than the minimum.
+	// Only ICMPManager supports it, whose probes don't fragment.
+	Size int
+	// pattern repeated to fill the padding, zeros if empty
+	Fill []byte
+	// TOS (traffic class for IPv6) byte of the probe: DSCP << 2 | ECN
+	TOS int
+	// IPv6 flow label of the probe, 0 to let kernel choose
+	FlowLabel int
+	// source address of the probe, nil to let kernel choose
+	Source net.IP
+	// name of the outgoing interface, empty to let kernel route. A VRF
+	// device selects its routing table.
+	Interface string
+	// If Duplicate is set, the Result of the first response is delivered
+	// right away, but the request is kept until Timeout to count duplicate
+	// responses, whose Result is passed to Duplicate. The channel is closed
+	// only then. Duplicate is called from the dispatcher and must not
+	// block. Only ICMPManager supports it.
+	Duplicate func(*Result)
+}
+
+// MaxPacketSize is the largest packet managers send and receive
+const MaxPacketSize = 9216
+
 // Manager represents a manager to send and recv packet of a specific network
 type Manager interface {
 	// Issue submit a probe to the manager and return a channel. A Result will
-	// be sent through the channel and the channel will be closed then.
+	// be sent through the channel and the channel will be closed then. A probe
+	// the manager doesn't take is reported by the Result code as well.
 	Issue(net.Addr, int, time.Duration) chan *Result
-	// Finish stops the manager from continue serving the requests.
+	// IssueContext submit a probe to the manager. Pending request is removed
+	// and a Result of CodeCancelled is delivered when ctx is cancelled. If the
+	// probe can't be sent, the error is returned along with a channel
+	// delivering the Result of that failure, or nil channel when the address
+	// is not supported by the manager.
+	IssueContext(context.Context, net.Addr, *Probe) (chan *Result, error)
+	// Finish stops the manager from continue serving the requests. Pending
+	// requests are finished with CodeShutdown.
 	Finish()
 }
 
+// failed returns a channel with a Result of code
+func failed(code int) chan *Result {
+	delivery := make(chan *Result, 1)
+	delivery <- &Result{
+		Code: code,
+	}
+	close(delivery)
+	return delivery
+}
+
+// unavailable returns a channel with a Result of unavailable address family
+func unavailable() chan *Result {
+	return failed(CodeFamilyUnavailable)
+}
+
+// resolved returns delivery of a probe issued by IssueContext, or a channel
+// with a Result of err if the probe isn't taken, so Issue always resolves.
+func resolved(delivery chan *Result, err error) chan *Result {
+	if delivery == nil {
+		return failed(sendErrorCode(err))
+	}
+	return delivery
+}
+
+// sendErrorCode translate error of sending probe to Result code
+func sendErrorCode(err error) int {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return CodeSendFailed
+	}
+	switch errno {
+	case syscall.EHOSTUNREACH:
+		return CodeHostUnreachable
+	case syscall.ENETUNREACH:
+		return CodeNetUnreachable
+	case syscall.ENOBUFS:
+		return CodeNoBuffer
+	case syscall.EPERM, syscall.EACCES:
+		return CodePermission
+	case syscall.EMSGSIZE:
+		return CodeMessageSize
+	}
+	return CodeSendFailed
+}
+
+func checkFamily(ip net.IP, v4, v6 bool) error {
+	if ip.To4() != nil && !v4 || ip.To4() == nil && !v6 {
+		return ErrFamilyUnavailable
+	}
+	return nil
+}
+
+// CheckFamily returns ErrFamilyUnavailable if the manager is known to be unable
+// to reach the address family of ip.
+func CheckFamily(m Manager, ip net.IP) error {
+	if c, ok := m.(interface{ CheckFamily(net.IP) error }); ok {
+		return c.CheckFamily(ip)
+	}
+	return nil
+}
+
+// A FlowAddr is a probe target with a flow identifier. Probes of the same flow
+// keep the header fields load balancers hash on (e.g. ports) unchanged, so they
+// follow the same path. Probes of different flows may take different paths.
+type FlowAddr struct {
+	IP net.IP
+	// destination port. 0 means the manager default.
+	Port int
+	// flow identifier
+	Flow int
+}
+
+func (a *FlowAddr) Network() string {
+	return "flow"
+}
+
+func (a *FlowAddr) String() string {
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port)) + "#" + strconv.Itoa(a.Flow)
+}
+
 type Request interface {
 	SetTimeout(time.Duration)
 	Passed(time.Time) bool
 	Deliver(Response) bool
+	// Fail finishes the request with a Result of code
+	Fail(code int)
+}
+
+// annotator is implemented by responses carrying protocol specific information
+// for Result
+type annotator interface {
+	annotate(*Result)
+}
+
+// quoter is implemented by responses which may be ICMP errors quoting the
+// probe header
+type quoter interface {
+	// quotedTOS returns TOS (traffic class) of the quoted header, -1 if
+	// unknown
+	quotedTOS() int
 }
 
 type Response interface {
 	GetIdentifier() (int, net.IP)
 	GetInformation() (net.IP, time.Time, int)
+	// GetClock returns the clock source of receive time
+	GetClock() ClockSource
+}
+
+// probeRequest holds what requests of all managers share. A request is
+// finished only once, whichever of response, timeout, cancellation or send
+// failure comes first. A request counting duplicates is replied before it's
+// finished, see Probe.Duplicate.
+type probeRequest struct {
+	// return timeout Result if Deadline passed.
+	Deadline time.Time
+	// request issue time, Deadline counts from it
+	issued time.Time
+	// stamp is taken right before writing the probe, sent right after
+	// writing it succeeded, both in unix nanoseconds and 0 until then.
+	// Written by the issuer and read by the dispatcher, accessed atomically.
+	stamp int64
+	sent  int64
+	// channel to return result
+	delivery chan *Result
+	// closed when finished, only if the request is cancellable
+	done chan struct{}
+	// state of delivery, guarded by l
+	state requestState
+	l     sync.Mutex
+	// TOS the probe is sent with, to detect re-marking
+	tos int
+	// Probe.Duplicate, called with responses after the first one
+	duplicate func(*Result)
+}
+
+// requestState tells whether a request has delivered its Result, and whether
+// delivery is closed
+type requestState int
+
+const (
+	requestPending requestState = iota
+	// Result delivered, duplicates still counted
+	requestReplied
+	requestFinished
+)
+
+// init sets r up for probe, cancellable if ctx is
+func (r *probeRequest) init(ctx context.Context, probe *Probe) {
+	r.delivery = make(chan *Result, 1)
+	r.tos = probe.TOS
+	if ctx.Done() != nil {
+		r.done = make(chan struct{})
+	}
+}
+
+// SetTimeout sets Deadline from the issue time, which is now if not set yet.
+func (r *probeRequest) SetTimeout(duration time.Duration) {
+	if r.issued.IsZero() {
+		r.issued = time.Now()
+	}
+	r.Deadline = r.issued.Add(duration)
+}
+
+// IssueTime returns the transmit time of the probe, taken right after writing
+// it succeeded, or zero time if it's not sent yet.
+func (r *probeRequest) IssueTime() time.Time {
+	if sent := atomic.LoadInt64(&r.sent); sent != 0 {
+		return time.Unix(0, sent)
+	}
+	return time.Time{}
+}
+
+// transmitTime returns the time a response received at received is measured
+// from. A response may be received before writing the probe returns, then it's
+// measured from stamp.
+func (r *probeRequest) transmitTime(received time.Time) time.Time {
+	sent := atomic.LoadInt64(&r.sent)
+	if sent == 0 || sent > received.UnixNano() {
+		sent = atomic.LoadInt64(&r.stamp)
+	}
+	return time.Unix(0, sent)
+}
+
+// transmit writes the probe by write, passing it the time stamp is taken at,
+// and takes the transmit time once it's written.
+func (r *probeRequest) transmit(write func(stamp time.Time) error) error {
+	stamp := time.Now()
+	r.stamped(stamp)
+	if err := write(stamp); err != nil {
+		return err
+	}
+	r.transmitted(time.Now())
+	return nil
+}
+
+// stamped sets stamp, taken right before writing the probe
+func (r *probeRequest) stamped(at time.Time) {
+	atomic.StoreInt64(&r.stamp, at.UnixNano())
+}
+
+// transmitted sets the transmit time, when writing the probe returned
+func (r *probeRequest) transmitted(at time.Time) {
+	atomic.StoreInt64(&r.sent, at.UnixNano())
+}
+
+func (r *probeRequest) Passed(time time.Time) bool {
+	return r.Deadline.Before(time)
+}
+
+func (r *probeRequest) Fail(code int) {
+	r.finish(&Result{
+		Code: code,
+	})
+}
+
+// respond finishes the request with response, or timeout if no response.
+// check, if not nil, inspects the Result built from response. A request
+// counting duplicates is replied with the Result of the first response
+// instead, passes later ones to duplicate, and is finished at timeout.
+func (r *probeRequest) respond(response Response, check func(*Result)) {
+	var Received time.Time
+	if response != nil {
+		_, Received, _ = response.GetInformation()
+	}
+	if response == nil || r.Passed(Received) {
+		// a replied request is only closed
+		r.Fail(CodeTimeout)
+		return
+	}
+	AddrIP, _, Code := response.GetInformation()
+	issued := r.transmitTime(Received)
+	result := &Result{
+		AddrIP:    AddrIP,
+		IssueTime: issued,
+		Latency:   Received.Sub(issued),
+		Code:      Code,
+		Clock:     response.GetClock(),
+	}
+	if a, ok := response.(annotator); ok {
+		a.annotate(result)
+	}
+	// ECN bits may be legitimately changed by routers, compare DSCP only
+	if q, ok := response.(quoter); ok {
+		if tos := q.quotedTOS(); tos >= 0 && tos>>2 != r.tos>>2 {
+			result.Remarked, result.QuotedTOS = true, tos
+		}
+	}
+	if check != nil {
+		check(result)
+	}
+	if r.duplicate == nil {
+		r.finish(result)
+		return
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	switch r.state {
+	case requestPending:
+		r.delivery <- result
+		r.state = requestReplied
+	case requestReplied:
+		r.duplicate(result)
+	}
+}
+
+// lingering reports whether the request is replied while counting
+// duplicates, so it must stay in queue.
+func (r *probeRequest) lingering() bool {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.state == requestReplied
+}
+
+// finish delivers result, unless the request is replied already, and closes
+// delivery.
+func (r *probeRequest) finish(result *Result) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.state == requestFinished {
+		return
+	}
+	if r.state == requestPending {
+		r.delivery <- result
+	}
+	r.state = requestFinished
+	close(r.delivery)
+	if r.done != nil {
+		close(r.done)
+	}
+}
+
+// watch removes request stored in queue under key when ctx is cancelled
+// before it finishes.
+func (r *probeRequest) watch(ctx context.Context, queue *ConMapRequest, key int, request Request) {
+	if r.done == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			if queue.RemoveIf(key, request) {
+				request.Fail(CodeCancelled)
+			}
+		case <-r.done:
+		}
+	}()
+}
+
+// send writes the probe of request, whose shared part is r, by write after
+// request is stored in queue under key, see probeRequest.transmit. On failure
+// the request is removed and finished with the error.
+func send(queue *ConMapRequest, key int, request Request, r *probeRequest, write func(time.Time) error) error {
+	if err := r.transmit(write); err != nil {
+		sendFailed(queue, key, request, err)
+		return err
+	}
+	return nil
+}
+
+// sendFailed removes request stored in queue under key and finishes it with
+// err of sending the probe.
+func sendFailed(queue *ConMapRequest, key int, request Request, err error) {
+	if queue.RemoveIf(key, request) {
+		request.Fail(sendErrorCode(err))
+	}
+}
+
+// spawn runs f in a goroutine tracked by wg
+func spawn(wg *sync.WaitGroup, f func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		f()
+	}()
+}
+
+// admit checks the manager is still open after request is stored in queue
+// under key. Otherwise the request is removed and finished with CodeShutdown,
+// as the manager may have drained its queue already.
+func admit(ctx context.Context, queue *ConMapRequest, key int, request Request) bool {
+	if ctx.Err() == nil {
+		return true
+	}
+	if queue.RemoveIf(key, request) {
+		request.Fail(CodeShutdown)
+	}
+	return false
+}
+
+// drain removes all requests from queue and finishes them with code
+func drain(queue *ConMapRequest, code int) {
+	for item := range queue.IterBuffered() {
+		if queue.RemoveIf(item.Key, item.Val) {
+			item.Val.Fail(code)
+		}
+	}
+}
+
+// dispatch delivers response to the matching request in queue. return whether
+// delivered.
+func dispatch(queue *ConMapRequest, key int, response Response) bool {
+	if request, exists := queue.Get(key); exists {
+		if request.Deliver(response) {
+			if l, ok := request.(interface{ lingering() bool }); !ok || !l.lingering() {
+				queue.RemoveIf(key, request)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// probeManager holds what TCPManager, UDPManager and ICMPManager share: the
+// pending requests, their deadlines, and the lifecycle of the goroutines
+// serving them.
+type probeManager struct {
+	// queue stores the pending requests and their response channel.
+	queue *ConMapRequest
+	// timeouts orders requests in queue by deadline
+	timeouts *deadlineQueue
+	// context to send the manager stop message
+	ctx context.Context
+	// function to call to stop the manager
+	cancel context.CancelFunc
+	// counter is the Key of next request. Probes may carry only its low 16
+	// bits, see dispatchLow.
+	counter uint64
+	// l is the mutex to make counter increment thread safe.
+	l sync.Mutex
+	// floor is the oldest Key which may be pending, see dispatchLow
+	floor uint64
+	// wg tracks receivers and dispatchers, which Close waits for
+	wg sync.WaitGroup
+	// closeOnce guards shutdown, closeErr is what it returns
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (m *probeManager) init() {
+	m.queue = NewCMap(32)
+	m.timeouts = newDeadlineQueue()
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+}
+
+// enqueue stores request, whose shared part is r, under key with timeout, and
+// removes it when ctx is cancelled. It returns false if the manager is closed,
+// in which case the request is finished with CodeShutdown.
+func (m *probeManager) enqueue(ctx context.Context, key int, request Request, r *probeRequest, timeout time.Duration) bool {
+	m.queue.Set(key, request, timeout)
+	if !admit(m.ctx, m.queue, key, request) {
+		return false
+	}
+	m.timeouts.Push(key, request, r.Deadline)
+	r.watch(ctx, m.queue, key, request)
+	return true
+}
+
+// nextKey returns the Key of a new request
+func (m *probeManager) nextKey() uint64 {
+	m.l.Lock()
+	defer m.l.Unlock()
+	key := m.counter
+	m.counter++
+	return key
+}
+
+// dispatchLow delivers response identified only by the low 16 bits of Key,
+// low. Candidates are pending requests whose Key has the same low 16 bits,
+// tried from the newest down to the oldest pending request. Only called by the
+// dispatcher.
+func (m *probeManager) dispatchLow(low uint16, response Response) bool {
+	m.l.Lock()
+	next := m.counter
+	m.l.Unlock()
+	if next == 0 {
+		return false
+	}
+	last := next - 1
+	// Keys which are no longer pending are never candidates again. Recent
+	// ones may still be on their way to queue, so floor stays behind.
+	for m.floor+1<<16 <= last {
+		if _, ok := m.queue.Get(int(m.floor)); ok {
+			break
+		}
+		m.floor++
+	}
+	for key := last - uint64(uint16(last)-low); key >= m.floor && key <= last; key -= 1 << 16 {
+		if dispatch(m.queue, int(key), response) {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatcher passes responses to deliver, and finishes pending requests with
+// timeout right at their deadline, until the manager is closed.
+func (m *probeManager) dispatcher(responses <-chan Response, deliver func(Response)) {
+	// fires at the earliest deadline of pending requests
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		var response Response
+		select {
+		case <-m.ctx.Done():
+			return
+		case response = <-responses:
+		case <-m.timeouts.wake:
+		case <-timer.C:
+		}
+
+		if response != nil {
+			deliver(response)
+		}
+		resetTimer(timer, m.timeouts.expire(m.queue, time.Now()))
+	}
+}
+
+// forward sends response to the dispatcher, giving up when the manager is
+// closed as the dispatcher may have exited. return whether sent.
+func (m *probeManager) forward(responses chan<- Response, response Response) bool {
+	select {
+	case responses <- response:
+		return true
+	case <-m.ctx.Done():
+		return false
+	}
+}
+
+// shutdown stops the manager. It closes conns to unblock pending reads, waits
+// for goroutines in wg to exit, and finishes pending requests with
+// CodeShutdown. It returns the first error of closing conns, and is a no-op
+// once called.
+func (m *probeManager) shutdown(conns ...io.Closer) error {
+	m.closeOnce.Do(func() {
+		m.cancel()
+		for _, conn := range conns {
+			if conn == nil {
+				continue
+			}
+			if err := conn.Close(); err != nil && m.closeErr == nil {
+				m.closeErr = err
+			}
+		}
+		m.wg.Wait()
+		drain(m.queue, CodeShutdown)
+	})
+	return m.closeErr
+}
+
+// closed returns whether the manager is closed
+func (m *probeManager) closed() bool {
+	return m.ctx.Err() != nil
+}
+
+// An ipManager sends probes of a transport protocol on raw IP sockets, and
+// receives ICMP errors quoting them from an ICMPManager. TCPManager and
+// UDPManager are built on it.
+type ipManager struct {
+	probeManager
+	// raw conn of related network, nil if the family is unavailable
+	conn4  *net.IPConn
+	conn6  *net.IPConn
+	pConn4 *ipv4.PacketConn
+	pConn6 *ipv6.PacketConn
+	// subscription of ICMP errors quoting our probes, registered on icmp
+	listener *RawListener
+	icmp     *ICMPManager
+}
+
+// listen opens raw sockets of protocol (e.g. "tcp") for whichever address
+// family is available, and subscribes ICMP errors matching filter to raw.
+func (m *ipManager) listen(protocol string, filter RawFilter, raw chan *RawResponse) error {
+	conn4, err4 := net.ListenIP("ip4:"+protocol, nil)
+	conn6, err6 := net.ListenIP("ip6:"+protocol, nil)
+	if err4 != nil && err6 != nil {
+		return fmt.Errorf("%s; v6: %s", err4, err6)
+	}
+	if err4 == nil {
+		m.conn4, m.pConn4 = conn4, ipv4.NewPacketConn(conn4)
+	}
+	if err6 == nil {
+		m.conn6, m.pConn6 = conn6, ipv6.NewPacketConn(conn6)
+	}
+	m.listener = m.icmp.RegisterListener(filter, raw)
+	return nil
+}
+
+// available reports whether the family of ip (v4 or not) can be reached
+func (m *ipManager) available(v4 bool) bool {
+	return v4 && m.conn4 != nil || !v4 && m.conn6 != nil
+}
+
+// write sends msg to dest on the conn of its family
+func (m *ipManager) write(v4 bool, msg []byte, dest net.IP, opts *WriteOptions) error {
+	if v4 {
+		_, err := writeControl(m.conn4, m.pConn4, nil, msg, &net.IPAddr{IP: dest}, opts)
+		return err
+	}
+	_, err := writeControl(m.conn6, nil, m.pConn6, msg, &net.IPAddr{IP: dest}, opts)
+	return err
+}
+
+// CheckFamily returns ErrFamilyUnavailable if the manager can't reach ip
+func (m *ipManager) CheckFamily(ip net.IP) error {
+	return checkFamily(ip, m.conn4 != nil, m.conn6 != nil)
+}
+
+// Finish closes the manager, see Close
+func (m *ipManager) Finish() {
+	_ = m.Close()
+}
+
+// Close stops the manager like ICMPManager.Close. The ICMPManager it receives
+// ICMP errors from is left open.
+func (m *ipManager) Close() error {
+	// unregistering is a no-op once done
+	m.icmp.UnregisterListener(m.listener)
+	var conns []io.Closer
+	for _, conn := range []*net.IPConn{m.conn4, m.conn6} {
+		if conn != nil {
+			conns = append(conns, conn)
+		}
+	}
+	return m.shutdown(conns...)
+}
+
+// stale reports whether the shared manager must be replaced: it's closed, or
+// the ICMPManager it receives ICMP errors from is, in which case it's closed
+// too.
+func (m *ipManager) stale() bool {
+	if !m.closed() && m.icmp.closed() {
+		_ = m.Close()
+	}
+	return m.closed()
 }
 
 // Concurrent map implementation by orcaman(https://github.com/orcaman)
@@ -206,6 +916,18 @@ func (m *ConMapRequest) Pop(key int) (v Request, exists bool) {
 	return v, exists
 }
 
+// Removes the element under key only if it is value. Returns whether removed.
+func (m *ConMapRequest) RemoveIf(key int, value Request) bool {
+	shard := m.GetShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	if v, exists := shard.items[key]; !exists || v != value {
+		return false
+	}
+	delete(shard.items, key)
+	return true
+}
+
 func fnv32(key []byte) uint32 {
 	hash := uint32(2166136261)
 	const prime32 = uint32(16777619)
@@ -0,0 +1,416 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIssueCancelled(t *testing.T) {
+	// no route: the probe is lost and only cancellation finishes it
+	mgr := newSimManager(1, &SimRoute{Loss: 1})
+	defer mgr.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	delivery, err := mgr.IssueContext(ctx, &net.IPAddr{IP: simTarget4}, &Probe{TTL: 64, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case result := <-delivery:
+		if result.Code != CodeCancelled {
+			t.Fatalf("code = %d, want cancelled", result.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelled request is not finished")
+	}
+	if n := mgr.queue.Count(); n != 0 {
+		t.Fatalf("%d requests left in queue", n)
+	}
+}
+
+func TestIssueShutdown(t *testing.T) {
+	mgr := newSimManager(1, &SimRoute{Loss: 1})
+	pending, err := mgr.IssueContext(context.Background(), &net.IPAddr{IP: simTarget4}, &Probe{TTL: 64, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mgr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if result := <-pending; result.Code != CodeShutdown {
+		t.Fatalf("pending request: code %d, want shutdown", result.Code)
+	}
+	delivery, err := mgr.IssueContext(context.Background(), &net.IPAddr{IP: simTarget4}, &Probe{TTL: 64, Timeout: time.Minute})
+	if err != ErrClosed {
+		t.Fatalf("issue after close: %v, want ErrClosed", err)
+	}
+	if result := <-delivery; result.Code != CodeShutdown {
+		t.Fatalf("issue after close: code %d, want shutdown", result.Code)
+	}
+	// Close is a no-op once called
+	if err = mgr.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIssueUnavailable(t *testing.T) {
+	v4, _ := NewSimNetwork(1).Transports()
+	mgr := NewICMPManager(v4, nil)
+	defer mgr.Close()
+	if err := CheckFamily(mgr, simTarget6); err != ErrFamilyUnavailable {
+		t.Fatalf("CheckFamily = %v, want ErrFamilyUnavailable", err)
+	}
+	delivery, err := mgr.IssueContext(context.Background(), &net.IPAddr{IP: simTarget6}, &Probe{TTL: 64, Timeout: time.Second})
+	if err != ErrFamilyUnavailable {
+		t.Fatalf("issue: %v, want ErrFamilyUnavailable", err)
+	}
+	if result := <-delivery; result.Code != CodeFamilyUnavailable {
+		t.Fatalf("code = %d, want family unavailable", result.Code)
+	}
+	// probes the manager can't take at all have no Result
+	delivery, err = mgr.IssueContext(context.Background(), &net.UDPAddr{IP: simTarget4}, &Probe{TTL: 64, Timeout: time.Second})
+	if err == nil || delivery != nil {
+		t.Fatalf("issue to UDP address: %v, %v", delivery, err)
+	}
+}
+
+func TestIssueRejected(t *testing.T) {
+	mgr := newSimManager(1, &SimRoute{})
+	defer mgr.Close()
+	key := func() uint64 {
+		mgr.l.Lock()
+		defer mgr.l.Unlock()
+		return mgr.counter
+	}
+	// Issue resolves probes IssueContext doesn't take
+	select {
+	case result := <-mgr.Issue(&net.UDPAddr{IP: simTarget4}, 64, time.Second):
+		if result.Code != CodeSendFailed {
+			t.Fatalf("issue to UDP address: code %d", result.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("issue to UDP address never resolves")
+	}
+	tests := []struct {
+		name  string
+		probe *Probe
+		err   error
+		code  int
+	}{
+		{"source family", &Probe{TTL: 64, Timeout: time.Second, Source: simLocal6}, ErrSourceFamily, CodeSendFailed},
+		{"size", &Probe{TTL: 64, Timeout: time.Second, Size: MaxPacketSize + 1}, syscall.EMSGSIZE, CodeMessageSize},
+	}
+	for _, tt := range tests {
+		before := key()
+		delivery, err := mgr.IssueContext(context.Background(), &net.IPAddr{IP: simTarget4}, tt.probe)
+		if delivery != nil || !errors.Is(err, tt.err) {
+			t.Fatalf("%s: %v, %v, want %v", tt.name, delivery, err, tt.err)
+		}
+		// input is checked before taking a key
+		if after := key(); after != before {
+			t.Fatalf("%s: key %d taken", tt.name, before)
+		}
+		if result := <-resolved(delivery, err); result.Code != tt.code {
+			t.Fatalf("%s: code %d, want %d", tt.name, result.Code, tt.code)
+		}
+	}
+}
+
+// failingTransport is a PacketTransport failing to send with err
+type failingTransport struct {
+	PacketTransport
+	err error
+}
+
+func (t failingTransport) WriteTo([]byte, net.Addr, int) (int, error) {
+	return 0, t.err
+}
+
+func TestIssueSendError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{&net.OpError{Op: "write", Err: os.NewSyscallError("sendto", syscall.EHOSTUNREACH)}, CodeHostUnreachable},
+		{os.NewSyscallError("sendmsg", syscall.ENETUNREACH), CodeNetUnreachable},
+		{syscall.ENOBUFS, CodeNoBuffer},
+		{syscall.EPERM, CodePermission},
+		{syscall.EACCES, CodePermission},
+		{syscall.EMSGSIZE, CodeMessageSize},
+		{syscall.EINVAL, CodeSendFailed},
+		{errors.New("not an errno"), CodeSendFailed},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.err), func(t *testing.T) {
+			v4, _ := NewSimNetwork(1).Transports()
+			mgr := NewICMPManager(failingTransport{v4, tt.err}, nil)
+			defer mgr.Close()
+			delivery, err := mgr.IssueContext(context.Background(), &net.IPAddr{IP: simTarget4}, &Probe{TTL: 64, Timeout: time.Second})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("issue: %v, want %v", err, tt.err)
+			}
+			if result := <-delivery; result.Code != tt.code || result.Replied() {
+				t.Fatalf("code = %d, want %d", result.Code, tt.code)
+			}
+			if n := mgr.queue.Count(); n != 0 {
+				t.Fatalf("%d requests left in queue", n)
+			}
+		})
+	}
+}
+
+// keyedRequest is a Request accepting responses carrying its id
+type keyedRequest struct {
+	countingRequest
+	id        int
+	delivered bool
+}
+
+func (r *keyedRequest) Deliver(response Response) bool {
+	if id, _ := response.GetIdentifier(); id != r.id {
+		return false
+	}
+	r.delivered = true
+	return true
+}
+
+func TestDispatchLow(t *testing.T) {
+	var m probeManager
+	m.init()
+	m.counter = 3<<16 + 10
+	older := &keyedRequest{id: 1}
+	newer := &keyedRequest{id: 2}
+	m.queue.Set(1<<16+5, older, 0)
+	m.queue.Set(2<<16+5, newer, 0)
+	// not issued yet, never a candidate
+	m.queue.Set(3<<16+20, &keyedRequest{id: 3}, 0)
+
+	if !m.dispatchLow(5, TCPResponse{Seq: 2}) || !newer.delivered {
+		t.Fatal("response is not delivered to the newest request of the same low bits")
+	}
+	if _, ok := m.queue.Get(2<<16 + 5); ok {
+		t.Fatal("delivered request is left in queue")
+	}
+	// older requests are tried, even though newer keys are finished
+	if !m.dispatchLow(5, TCPResponse{Seq: 1}) || !older.delivered {
+		t.Fatal("response is not delivered to the older request")
+	}
+	if m.floor != 1<<16+5 {
+		t.Fatalf("floor = %#x, want the oldest pending key", m.floor)
+	}
+	if m.dispatchLow(20, TCPResponse{Seq: 3}) {
+		t.Fatal("delivered to a key not issued yet")
+	}
+}
+
+// TestIPManagerWideKeys sends TCP and UDP probes to loopback with Key crossing
+// 16 bits, which only the low 16 bits of are carried back.
+func TestIPManagerWideKeys(t *testing.T) {
+	for _, protocol := range []string{"tcp", "udp"} {
+		conn, err := net.ListenIP("ip4:"+protocol, nil)
+		if err != nil {
+			t.Skipf("raw socket unavailable: %v", err)
+		}
+		_ = conn.Close()
+	}
+	conn, err := ListenICMP("ip4:icmp")
+	if err != nil {
+		t.Skipf("raw ICMP socket unavailable: %v", err)
+	}
+	icmp := NewICMPManager(conn, nil)
+	defer icmp.Close()
+	tcp, udp := newTCPManager(icmp), newUDPManager(icmp)
+	managers := []struct {
+		name string
+		Manager
+		*probeManager
+	}{
+		{"tcp", tcp, &tcp.probeManager},
+		{"udp", udp, &udp.probeManager},
+	}
+	loopback := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	for _, mgr := range managers {
+		mgr.counter, mgr.floor = 1<<32-2, 1<<32-2
+		for i := 0; i < 4; i++ {
+			result := <-mgr.Issue(loopback, 64, time.Second)
+			if result.Code != CodeOK {
+				t.Errorf("%s probe %d: code %d, want reached", mgr.name, i, result.Code)
+			}
+		}
+		if mgr.counter>>16 != 1<<16 {
+			t.Errorf("%s: key %#x doesn't cross 32 bits", mgr.name, mgr.counter)
+		}
+		mgr.Finish()
+	}
+}
+
+// slowTransport is a PacketTransport taking delay to write a packet before
+// it's sent
+type slowTransport struct {
+	PacketTransport
+	delay time.Duration
+}
+
+func (t slowTransport) WriteTo(b []byte, dst net.Addr, ttl int) (int, error) {
+	time.Sleep(t.delay)
+	return t.PacketTransport.WriteTo(b, dst, ttl)
+}
+
+func TestIssueTransmitTime(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.Route(simTarget4, &SimRoute{Latency: 10 * time.Millisecond})
+	v4, _ := sim.Transports()
+	mgr := NewICMPManager(slowTransport{v4, 50 * time.Millisecond}, nil)
+	defer mgr.Close()
+	// latency counts from when the probe is sent, not issued
+	result := probeSim(t, mgr, simTarget4, &Probe{TTL: 64})
+	if result.Code != CodeOK {
+		t.Fatalf("code = %d, want reached", result.Code)
+	}
+	checkLatency(t, result, 10*time.Millisecond)
+}
+
+func TestICMPDeliverStamp(t *testing.T) {
+	request := &ICMPRequest{Key: 1, ID: 7, TargetIP: simTarget4}
+	request.init(context.Background(), &Probe{})
+	request.SetTimeout(time.Minute)
+	stamp := time.Now()
+	if err := request.transmit(func(at time.Time) error { stamp = at; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if sent := request.IssueTime(); sent.Before(stamp) {
+		t.Fatalf("transmit time %v before the stamp %v", sent, stamp)
+	}
+	reply := func(sent time.Time) *ICMPResponse {
+		return &ICMPResponse{ID: 7, Cookie: true, Key: 1, Sent: sent.UnixNano(), AddrIP: simTarget4, TargetIP: simTarget4, Received: time.Now(), Code: CodeOK}
+	}
+	// a reply of an earlier request under the same Key
+	if request.Deliver(reply(stamp.Add(-time.Second))) {
+		t.Fatal("delivered a reply carrying another stamp")
+	}
+	if !request.Deliver(reply(stamp)) {
+		t.Fatal("reply carrying the stamp is not delivered")
+	}
+	if result := <-request.delivery; result.Code != CodeOK || result.Latency < 0 {
+		t.Fatalf("code %d latency %v", result.Code, result.Latency)
+	}
+}
+
+// recordingTransport is a PacketTransport keeping the last packet written
+type recordingTransport struct {
+	PacketTransport
+	last *[]byte
+}
+
+func (t recordingTransport) WriteTo(b []byte, dst net.Addr, ttl int) (int, error) {
+	*t.last = append([]byte(nil), b...)
+	return t.PacketTransport.WriteTo(b, dst, ttl)
+}
+
+func TestIssuePayload(t *testing.T) {
+	sim := NewSimNetwork(1)
+	sim.Route(simTarget4, &SimRoute{Latency: time.Millisecond})
+	sim.Route(simTarget6, &SimRoute{Latency: time.Millisecond})
+	v4, v6 := sim.Transports()
+	var last []byte
+	mgr := NewICMPManager(recordingTransport{v4, &last}, recordingTransport{v6, &last})
+	defer mgr.Close()
+	fill := []byte{0xde, 0xad, 0xbe, 0xef}
+	tests := []struct {
+		ip   net.IP
+		size int
+		data int
+	}{
+		{simTarget4, 0, cookieLen},
+		{simTarget4, 200, 200 - 20 - 8},
+		{simTarget6, 200, 200 - 40 - 8},
+	}
+	for _, tt := range tests {
+		result := probeSim(t, mgr, tt.ip, &Probe{TTL: 64, Size: tt.size, Fill: fill})
+		if result.Code != CodeOK || result.Truncated || result.Corrupted {
+			t.Fatalf("%s size %d: code %d truncated %v corrupted %v",
+				tt.ip, tt.size, result.Code, result.Truncated, result.Corrupted)
+		}
+		// ICMP header(8) precedes echo data
+		data := last[8:]
+		if len(data) != tt.data {
+			t.Fatalf("%s size %d: %d bytes of echo data, want %d", tt.ip, tt.size, len(data), tt.data)
+		}
+		for i, b := range data[cookieLen:] {
+			if b != fill[i%len(fill)] {
+				t.Fatalf("%s size %d: byte %d of padding is %#x", tt.ip, tt.size, i, b)
+			}
+		}
+	}
+}
+
+// TestIssueConcurrentTTL issues probes of mixed TTL from many goroutines, each
+// of which must be answered by the hop of its own TTL.
+func TestIssueConcurrentTTL(t *testing.T) {
+	hops := []SimHop{
+		{IP: net.ParseIP("203.0.113.1"), Latency: time.Millisecond},
+		{IP: net.ParseIP("203.0.113.2"), Latency: time.Millisecond},
+		{IP: net.ParseIP("203.0.113.3"), Latency: time.Millisecond},
+	}
+	mgr := newSimManager(1, &SimRoute{Hops: hops, Latency: time.Millisecond})
+	defer mgr.Close()
+	const workers, probes = 16, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < probes; i++ {
+				ttl := 1 + (w+i)%(len(hops)+1)
+				target := simTarget4
+				if i%2 != 0 {
+					target = simTarget6
+				}
+				delivery, err := mgr.IssueContext(context.Background(), &net.IPAddr{IP: target}, &Probe{TTL: ttl, Timeout: time.Second})
+				if err != nil {
+					errs <- err
+					return
+				}
+				result := <-delivery
+				code, from := CodeOK, target
+				if ttl <= len(hops) {
+					code, from = CodeTimeExceeded, hops[ttl-1].IP
+				}
+				if result.Code != code || !result.AddrIP.Equal(from) {
+					errs <- fmt.Errorf("%s ttl %d: code %d from %s, want %d from %s",
+						target, ttl, result.Code, result.AddrIP, code, from)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,83 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// A RawFilter selects RawResponse by the 5-tuple of the quoted packet.
+// Zero value fields match anything.
+type RawFilter struct {
+	// Protocol of the quoted packet, e.g. 6 for TCP, 17 for UDP
+	Protocol int
+	// source ip of the quoted packet
+	SourceIP net.IP
+	// destination ip of the quoted packet
+	TargetIP net.IP
+	// source port of the quoted packet. If SrcPortEnd is set, ports in
+	// [SrcPort, SrcPortEnd] match.
+	SrcPort    int
+	SrcPortEnd int
+	// destination port of the quoted packet. If DstPortEnd is set, ports in
+	// [DstPort, DstPortEnd] match.
+	DstPort    int
+	DstPortEnd int
+}
+
+// A RawListener represents a subscription to ICMPManager for ICMP errors
+// quoting other protocol packets.
+type RawListener struct {
+	// Filter the RawResponse should pass to be sent
+	Filter RawFilter
+	// C is the channel RawResponse be sent to
+	C chan *RawResponse
+}
+
+func matchPort(port, low, high int) bool {
+	if low == 0 {
+		return true
+	}
+	if high == 0 {
+		return port == low
+	}
+	return port >= low && port <= high
+}
+
+// Match reports whether the RawResponse passes the filter.
+func (f *RawFilter) Match(response *RawResponse) bool {
+	if f.Protocol != response.Protocol {
+		return false
+	}
+	if f.SourceIP != nil && !f.SourceIP.Equal(response.SourceIP) {
+		return false
+	}
+	if f.TargetIP != nil && !f.TargetIP.Equal(response.TargetIP) {
+		return false
+	}
+	if f.SrcPort == 0 && f.DstPort == 0 {
+		return true
+	}
+	// ports are the first 4 bytes of TCP, UDP, SCTP, DCCP and UDP-Lite
+	// header. We can't filter on what is not quoted.
+	if len(response.Fragment) < 4 {
+		return false
+	}
+	return matchPort(int(binary.BigEndian.Uint16(response.Fragment[0:2])), f.SrcPort, f.SrcPortEnd) &&
+		matchPort(int(binary.BigEndian.Uint16(response.Fragment[2:4])), f.DstPort, f.DstPortEnd)
+}
@@ -0,0 +1,160 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"encoding/binary"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpHeader is the UDP header from sport to dport, as quoted in ICMP errors
+func udpHeader(sport, dport int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b[0:2], uint16(sport))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dport))
+	binary.BigEndian.PutUint16(b[4:6], 8)
+	return b
+}
+
+func TestRawFilterMatch(t *testing.T) {
+	udp := &RawResponse{
+		Protocol: 17,
+		SourceIP: simLocal4.To16(),
+		TargetIP: simTarget4.To16(),
+		Fragment: udpHeader(40000, 33434),
+	}
+	for _, c := range []struct {
+		name   string
+		filter RawFilter
+		match  bool
+	}{
+		{"protocol", RawFilter{Protocol: 17}, true},
+		{"other protocol", RawFilter{Protocol: 6}, false},
+		{"source", RawFilter{Protocol: 17, SourceIP: simLocal4}, true},
+		{"other source", RawFilter{Protocol: 17, SourceIP: simHop4}, false},
+		{"target", RawFilter{Protocol: 17, TargetIP: simTarget4}, true},
+		{"other target", RawFilter{Protocol: 17, TargetIP: simHop4}, false},
+		{"source port", RawFilter{Protocol: 17, SrcPort: 40000}, true},
+		{"other source port", RawFilter{Protocol: 17, SrcPort: 40001}, false},
+		{"source port range", RawFilter{Protocol: 17, SrcPort: 39000, SrcPortEnd: 41000}, true},
+		{"source port range low end", RawFilter{Protocol: 17, SrcPort: 40000, SrcPortEnd: 41000}, true},
+		{"source port range high end", RawFilter{Protocol: 17, SrcPort: 39000, SrcPortEnd: 40000}, true},
+		{"below source port range", RawFilter{Protocol: 17, SrcPort: 40001, SrcPortEnd: 41000}, false},
+		{"destination port", RawFilter{Protocol: 17, DstPort: 33434}, true},
+		{"destination port range", RawFilter{Protocol: 17, DstPort: 33434, DstPortEnd: 33534}, true},
+		{"above destination port range", RawFilter{Protocol: 17, DstPort: 33000, DstPortEnd: 33433}, false},
+		{"both ports", RawFilter{Protocol: 17, SrcPort: 40000, DstPort: 33434, DstPortEnd: 33534}, true},
+		{"one port off", RawFilter{Protocol: 17, SrcPort: 40001, DstPort: 33434, DstPortEnd: 33534}, false},
+	} {
+		if got := c.filter.Match(udp); got != c.match {
+			t.Fatalf("%s: match %v, want %v", c.name, got, c.match)
+		}
+	}
+	// ports are not filtered on unless quoted
+	short := &RawResponse{Protocol: 17, Fragment: make([]byte, 3)}
+	if !(&RawFilter{Protocol: 17}).Match(short) || (&RawFilter{Protocol: 17, DstPort: 33434}).Match(short) {
+		t.Fatal("short fragment matched by ports")
+	}
+}
+
+func TestRawListener(t *testing.T) {
+	sim := NewSimNetwork(1)
+	v4, v6 := sim.Transports()
+	mgr := NewICMPManager(v4, v6)
+	defer mgr.Close()
+	// inject receives Time Exceeded quoting a UDP packet to dport
+	inject := func(dport int) {
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeTimeExceeded,
+			Body: &icmp.TimeExceeded{Data: quoteIPv4(sim.Local4, simTarget4, 17, 0, udpHeader(40000, dport))},
+		}
+		b, err := msg.Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v4.(*simTransport).receive(simPacket{b: b, src: &net.IPAddr{IP: simHop4}, received: time.Now()})
+	}
+	receive := func(c chan *RawResponse, name string) *RawResponse {
+		select {
+		case r := <-c:
+			return r
+		case <-time.After(time.Second):
+			t.Fatalf("nothing sent to %s listener", name)
+			return nil
+		}
+	}
+
+	trace := make(chan *RawResponse, 4)
+	all := make(chan *RawResponse, 4)
+	tcp := make(chan *RawResponse, 4)
+	traceL := mgr.RegisterListener(RawFilter{Protocol: 17, DstPort: 33434, DstPortEnd: 33534}, trace)
+	mgr.RegisterListener(RawFilter{Protocol: 17}, all)
+	mgr.RegisterListener(RawFilter{Protocol: 6}, tcp)
+
+	inject(33500)
+	r := receive(trace, "trace")
+	if r.Code != CodeTimeExceeded || !r.AddrIP.Equal(simHop4) || !r.TargetIP.Equal(simTarget4) || r.Protocol != 17 {
+		t.Fatalf("raw response %+v", r)
+	}
+	receive(all, "UDP")
+	// outside the port range, only the catch-all listener gets it
+	inject(40000)
+	receive(all, "UDP")
+
+	mgr.UnregisterListener(traceL)
+	inject(33500)
+	inject(33501)
+	// the catch-all listener getting both means both were dispatched
+	receive(all, "UDP")
+	receive(all, "UDP")
+	select {
+	case r := <-trace:
+		t.Fatalf("%+v sent after unregistering", r)
+	default:
+	}
+	if len(tcp) != 0 {
+		t.Fatal("UDP error sent to TCP listener")
+	}
+}
+
+func TestUnregisterListener(t *testing.T) {
+	sim := NewSimNetwork(1)
+	mgr := sim.Manager()
+	defer mgr.Close()
+	a := mgr.RegisterListener(RawFilter{Protocol: 17}, make(chan *RawResponse))
+	b := mgr.RegisterListener(RawFilter{Protocol: 17}, make(chan *RawResponse))
+	mgr.UnregisterListener(a)
+	// unregistering twice is harmless
+	mgr.UnregisterListener(a)
+	mgr.extL.RLock()
+	left := mgr.extListener[17]
+	mgr.extL.RUnlock()
+	if len(left) != 1 || left[0] != b {
+		t.Fatalf("%d listeners left, want the other one", len(left))
+	}
+	mgr.UnregisterListener(b)
+	mgr.extL.RLock()
+	_, ok := mgr.extListener[17]
+	mgr.extL.RUnlock()
+	if ok {
+		t.Fatal("protocol still listened to without listeners")
+	}
+}
@@ -0,0 +1,477 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// A SimHop represents a router on a simulated path.
+type SimHop struct {
+	// address the router replies from
+	IP net.IP
+	// round trip time to the router
+	Latency time.Duration
+	// probability that probe or reply is lost
+	Loss float64
+	// MTU of the link toward the next hop, 0 means unlimited. Larger
+	// probes get Fragmentation Needed (Packet Too Big for IPv6).
+	MTU int
+	// MPLS label stack reported in Time Exceeded extension
+	MPLS []MPLSLabel
+	// if Remark is set, probes leaving the hop have TOS (traffic class)
+	// changed to TOS
+	Remark bool
+	TOS    int
+}
+
+// A SimRoute scripts how the simulated network treats probes toward a
+// destination.
+type SimRoute struct {
+	// Hops are routers before the destination. Probe with TTL i not larger
+	// than len(Hops) gets Time Exceeded from Hops[i-1].
+	Hops []SimHop
+	// round trip time to the destination
+	Latency time.Duration
+	// probability that probe or reply to the destination is lost
+	Loss float64
+	// if Unreachable is set, probes passing all Hops get Destination
+	// Unreachable with Code from the last hop (or the destination itself if
+	// there's no hop) instead of reaching the destination.
+	Unreachable bool
+	Code        int
+	// probability that echo reply payload from the destination is
+	// corrupted. Only payload after the cookie is corrupted, so probes
+	// without padding are never.
+	Corrupt float64
+	// probability that echo reply payload from the destination is cut
+	// right after the cookie, likewise only for probes with padding
+	Truncate float64
+	// probability that echo reply from the destination is duplicated
+	Duplicate float64
+	// echo replies from the destination are delayed by up to Jitter more
+	// than Latency, so they may be reordered
+	Jitter time.Duration
+}
+
+// A SimNetwork is an in-memory network for ICMPManager. Probes are answered
+// as scripted by the SimRoute of their destination, and probes to unknown
+// destinations are lost.
+//
+// Replies are delivered by one goroutine in order of their due time, ties
+// broken by the order probes are sent, and read with the due time as receive
+// time. So latency of a Result is the scripted one, less the time writing the
+// probe takes to return, no matter how late the goroutine is scheduled.
+type SimNetwork struct {
+	// local address quoted in ICMP errors
+	Local4 net.IP
+	Local6 net.IP
+	routes map[string]*SimRoute
+	rnd    *rand.Rand
+	// replies to deliver, and the number scheduled so far
+	pending simSchedule
+	seq     uint64
+	// whether the delivery goroutine is running, and its wake-up call
+	// when an earlier reply is scheduled
+	running bool
+	wake    chan struct{}
+	l       sync.Mutex
+}
+
+// NewSimNetwork creates an empty SimNetwork. Loss is decided by random source
+// seeded with seed, so probes sent in the same order get the same fate.
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		Local4: net.IPv4(192, 0, 2, 1),
+		Local6: net.ParseIP("2001:db8::1"),
+		routes: make(map[string]*SimRoute),
+		rnd:    rand.New(rand.NewSource(seed)),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Route sets the SimRoute toward ip
+func (s *SimNetwork) Route(ip net.IP, route *SimRoute) {
+	s.l.Lock()
+	s.routes[ip.String()] = route
+	s.l.Unlock()
+}
+
+// Transports returns IPv4 and IPv6 transports attached to the network.
+func (s *SimNetwork) Transports() (v4, v6 PacketTransport) {
+	return newSimTransport(s, true), newSimTransport(s, false)
+}
+
+// Manager returns a new ICMPManager running on the network.
+func (s *SimNetwork) Manager() *ICMPManager {
+	return NewICMPManager(s.Transports())
+}
+
+// jitter returns a random duration in [0, d)
+func (s *SimNetwork) jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	return time.Duration(s.rnd.Int63n(int64(d)))
+}
+
+func (s *SimNetwork) lost(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.rnd.Float64() < p
+}
+
+type simPacket struct {
+	b   []byte
+	src net.Addr
+	// when the packet arrives
+	received time.Time
+}
+
+// a simDelivery is a reply scheduled to arrive at transport t
+type simDelivery struct {
+	t   *simTransport
+	p   simPacket
+	seq uint64
+}
+
+// simSchedule is a min-heap of simDelivery ordered by arrival, then seq
+type simSchedule []simDelivery
+
+func (h simSchedule) Len() int { return len(h) }
+func (h simSchedule) Less(i, j int) bool {
+	if !h[i].p.received.Equal(h[j].p.received) {
+		return h[i].p.received.Before(h[j].p.received)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h simSchedule) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *simSchedule) Push(x interface{}) {
+	*h = append(*h, x.(simDelivery))
+}
+
+func (h *simSchedule) Pop() interface{} {
+	old := *h
+	d := old[len(old)-1]
+	old[len(old)-1] = simDelivery{}
+	*h = old[:len(old)-1]
+	return d
+}
+
+// schedule delivers p to t at p.received
+func (s *SimNetwork) schedule(t *simTransport, p simPacket) {
+	s.l.Lock()
+	heap.Push(&s.pending, simDelivery{t: t, p: p, seq: s.seq})
+	s.seq++
+	earliest := s.pending[0].seq == s.seq-1
+	start := !s.running
+	s.running = true
+	s.l.Unlock()
+	switch {
+	case start:
+		go s.deliver()
+	case earliest:
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// deliver hands scheduled replies to their transports in order, and exits
+// once none is pending.
+func (s *SimNetwork) deliver() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		s.l.Lock()
+		if len(s.pending) == 0 {
+			s.running = false
+			s.l.Unlock()
+			return
+		}
+		next := s.pending[0]
+		wait := time.Until(next.p.received)
+		if wait <= 0 {
+			heap.Pop(&s.pending)
+		}
+		s.l.Unlock()
+		if wait <= 0 {
+			next.t.receive(next.p)
+			continue
+		}
+		resetTimer(timer, next.p.received)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
+
+var errSimClosed = errors.New("simulated transport closed")
+
+type simTimeout struct{}
+
+func (simTimeout) Error() string   { return "i/o timeout" }
+func (simTimeout) Timeout() bool   { return true }
+func (simTimeout) Temporary() bool { return true }
+
+type simTransport struct {
+	net      *SimNetwork
+	v4       bool
+	inbox    chan simPacket
+	done     chan struct{}
+	once     sync.Once
+	l        sync.Mutex
+	deadline time.Time
+}
+
+func newSimTransport(s *SimNetwork, v4 bool) *simTransport {
+	return &simTransport{
+		net:   s,
+		v4:    v4,
+		inbox: make(chan simPacket, 1024),
+		done:  make(chan struct{}),
+	}
+}
+
+func (t *simTransport) Mode() string {
+	return "simulated"
+}
+
+func (t *simTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, src, _, err := t.ReadFromTimestamp(b)
+	return n, src, err
+}
+
+// ReadFromTimestamp is ReadFrom returning when the packet arrives as
+// scheduled.
+func (t *simTransport) ReadFromTimestamp(b []byte) (int, net.Addr, time.Time, error) {
+	t.l.Lock()
+	deadline := t.deadline
+	t.l.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p := <-t.inbox:
+		return copy(b, p.b), p.src, p.received, nil
+	case <-timeout:
+		return 0, nil, time.Time{}, simTimeout{}
+	case <-t.done:
+		return 0, nil, time.Time{}, errSimClosed
+	}
+}
+
+func (t *simTransport) SetReadDeadline(deadline time.Time) error {
+	t.l.Lock()
+	t.deadline = deadline
+	t.l.Unlock()
+	return nil
+}
+
+func (t *simTransport) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+	})
+	return nil
+}
+
+// deliver schedules reply from src to arrive at sent + delay
+func (t *simTransport) deliver(reply []byte, src net.IP, sent time.Time, delay time.Duration) {
+	t.net.schedule(t, simPacket{b: reply, src: &net.IPAddr{IP: src}, received: sent.Add(delay)})
+}
+
+// receive puts p into inbox, or drops it if t is closed
+func (t *simTransport) receive(p simPacket) {
+	select {
+	case t.inbox <- p:
+	case <-t.done:
+	}
+}
+
+func (t *simTransport) WriteTo(b []byte, dst net.Addr, ttl int) (int, error) {
+	return t.WriteToOptions(b, dst, &WriteOptions{TTL: ttl})
+}
+
+// WriteToOptions is WriteTo with source address, which is quoted in ICMP
+// errors instead of Local4 (Local6). Outgoing interface is ignored.
+func (t *simTransport) WriteToOptions(b []byte, dst net.Addr, opts *WriteOptions) (int, error) {
+	sent := time.Now()
+	ttl := opts.TTL
+	select {
+	case <-t.done:
+		return 0, errSimClosed
+	default:
+	}
+	ipAddr, ok := dst.(*net.IPAddr)
+	if !ok {
+		return 0, errors.New("simulated transport only accepts *net.IPAddr")
+	}
+	proto := 1 // iana.ProtocolICMP
+	if !t.v4 {
+		proto = 58 // iana.ProtocolIPv6ICMP
+	}
+	msg, err := icmp.ParseMessage(proto, b)
+	if err != nil {
+		return 0, err
+	}
+	echo, ok := msg.Body.(*icmp.Echo)
+	if !ok {
+		return len(b), nil
+	}
+	t.net.l.Lock()
+	route := t.net.routes[ipAddr.IP.String()]
+	t.net.l.Unlock()
+	if route == nil {
+		return len(b), nil
+	}
+
+	var reply icmp.Message
+	var from net.IP
+	var delay time.Duration
+	var loss float64
+	duplicate := false
+	// ICMP errors quote the probe as received after passing n hops
+	quote := func(n int) []byte {
+		tos := opts.TOS
+		for _, hop := range route.Hops[:n] {
+			if hop.Remark {
+				tos = hop.TOS
+			}
+		}
+		if t.v4 {
+			src := t.net.Local4
+			if opts.Source != nil {
+				src = opts.Source
+			}
+			return quoteIPv4(src, ipAddr.IP, proto, tos, b)
+		}
+		src := t.net.Local6
+		if opts.Source != nil {
+			src = opts.Source
+		}
+		return quoteIPv6(src, ipAddr.IP, proto, tos, opts.FlowLabel, b)
+	}
+	size := len(b) + 20
+	if !t.v4 {
+		size = len(b) + 40
+	}
+	tooBig := -1
+	for i := 0; i < len(route.Hops) && i < ttl; i++ {
+		if route.Hops[i].MTU > 0 && size > route.Hops[i].MTU {
+			tooBig = i
+			break
+		}
+	}
+	switch {
+	case ttl < 1:
+		return len(b), nil
+	case tooBig >= 0:
+		hop := route.Hops[tooBig]
+		from, delay, loss = hop.IP, hop.Latency, hop.Loss
+		if t.v4 {
+			reply.Type = ipv4.ICMPTypeDestinationUnreachable
+			reply.Code = 4
+			reply.Body = &icmp.DstUnreach{Data: quote(tooBig)}
+		} else {
+			reply.Type = ipv6.ICMPTypePacketTooBig
+			reply.Body = &icmp.PacketTooBig{MTU: hop.MTU, Data: quote(tooBig)}
+		}
+	case ttl <= len(route.Hops):
+		hop := route.Hops[ttl-1]
+		from, delay, loss = hop.IP, hop.Latency, hop.Loss
+		reply.Type = ipv4.ICMPTypeTimeExceeded
+		if !t.v4 {
+			reply.Type = ipv6.ICMPTypeTimeExceeded
+		}
+		body := &icmp.TimeExceeded{Data: quote(ttl - 1)}
+		if len(hop.MPLS) != 0 {
+			stack := &icmp.MPLSLabelStack{Class: 1, Type: 1}
+			for _, l := range hop.MPLS {
+				stack.Labels = append(stack.Labels, icmp.MPLSLabel{Label: l.Label, TC: l.TC, S: l.S, TTL: l.TTL})
+			}
+			body.Extensions = []icmp.Extension{stack}
+		}
+		reply.Body = body
+	case route.Unreachable:
+		from, delay, loss = ipAddr.IP, route.Latency, route.Loss
+		passed := 0
+		if len(route.Hops) != 0 {
+			hop := route.Hops[len(route.Hops)-1]
+			from, delay, loss = hop.IP, hop.Latency, hop.Loss
+			passed = len(route.Hops) - 1
+		}
+		reply.Type = ipv4.ICMPTypeDestinationUnreachable
+		if !t.v4 {
+			reply.Type = ipv6.ICMPTypeDestinationUnreachable
+		}
+		reply.Code = route.Code
+		reply.Body = &icmp.DstUnreach{Data: quote(passed)}
+	default:
+		from, delay, loss = ipAddr.IP, route.Latency, route.Loss
+		reply.Type = ipv4.ICMPTypeEchoReply
+		if !t.v4 {
+			reply.Type = ipv6.ICMPTypeEchoReply
+		}
+		data := echo.Data
+		if len(data) > cookieLen && t.net.lost(route.Corrupt) {
+			data = append([]byte(nil), data...)
+			data[len(data)-1] ^= 0xff
+		}
+		if len(data) > cookieLen && t.net.lost(route.Truncate) {
+			data = data[:cookieLen]
+		}
+		reply.Body = &icmp.Echo{ID: echo.ID, Seq: echo.Seq, Data: data}
+		delay += t.net.jitter(route.Jitter)
+		duplicate = t.net.lost(route.Duplicate)
+	}
+	if t.net.lost(loss) {
+		return len(b), nil
+	}
+	r, err := reply.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	if t.v4 && tooBig >= 0 {
+		// next-hop MTU, which icmp package doesn't marshal
+		binary.BigEndian.PutUint16(r[6:8], uint16(route.Hops[tooBig].MTU))
+	}
+	t.deliver(r, from, sent, delay)
+	if duplicate {
+		t.deliver(r, from, sent, delay+t.net.jitter(route.Jitter))
+	}
+	return len(b), nil
+}
@@ -0,0 +1,374 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"container/heap"
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	simTarget4 = net.ParseIP("198.51.100.7")
+	simTarget6 = net.ParseIP("2001:db8:1::7")
+	simHop4    = net.ParseIP("203.0.113.1")
+	simHop6    = net.ParseIP("2001:db8:2::1")
+)
+
+// latencySlack is how much Result latency may exceed the scripted one, and
+// writeSlack how much it may fall short: latency is measured from when writing
+// the probe returns, which is after the SimNetwork takes it.
+const (
+	latencySlack = 20 * time.Millisecond
+	writeSlack   = time.Millisecond
+)
+
+// newSimManager returns a manager on a SimNetwork with route toward both
+// simTarget4 and simTarget6
+func newSimManager(seed int64, route *SimRoute) *ICMPManager {
+	sim := NewSimNetwork(seed)
+	sim.Route(simTarget4, route)
+	sim.Route(simTarget6, route)
+	return sim.Manager()
+}
+
+// probeSim issues probe to ip and waits for the Result
+func probeSim(t testing.TB, mgr Manager, ip net.IP, probe *Probe) *Result {
+	t.Helper()
+	if probe.Timeout == 0 {
+		probe.Timeout = 300 * time.Millisecond
+	}
+	delivery, err := mgr.IssueContext(context.Background(), &net.IPAddr{IP: ip}, probe)
+	if err != nil {
+		t.Fatalf("issue to %s: %v", ip, err)
+	}
+	return <-delivery
+}
+
+func checkLatency(t *testing.T, result *Result, want time.Duration) {
+	t.Helper()
+	if result.Latency < want-writeSlack || result.Latency > want+latencySlack {
+		t.Errorf("latency = %v, want %v", result.Latency, want)
+	}
+}
+
+func TestSimEchoReply(t *testing.T) {
+	mgr := newSimManager(1, &SimRoute{Latency: 30 * time.Millisecond})
+	defer mgr.Close()
+	for _, ip := range []net.IP{simTarget4, simTarget6} {
+		result := probeSim(t, mgr, ip, &Probe{TTL: 64})
+		if result.Code != CodeOK || !result.AddrIP.Equal(ip) {
+			t.Fatalf("%s: got code %d from %s", ip, result.Code, result.AddrIP)
+		}
+		if result.Clock != ClockKernel {
+			t.Errorf("%s: clock = %v, want receive time of the simulation", ip, result.Clock)
+		}
+		checkLatency(t, result, 30*time.Millisecond)
+	}
+}
+
+func TestSimUnknownTarget(t *testing.T) {
+	mgr := newSimManager(1, &SimRoute{})
+	defer mgr.Close()
+	result := probeSim(t, mgr, net.ParseIP("192.0.2.99"), &Probe{TTL: 64, Timeout: 50 * time.Millisecond})
+	if result.Code != CodeTimeout {
+		t.Fatalf("code = %d, want timeout", result.Code)
+	}
+}
+
+// lossPattern returns which of n sequential probes are lost on a fresh
+// network of seed
+func lossPattern(t *testing.T, seed int64, n int) []bool {
+	mgr := newSimManager(seed, &SimRoute{Latency: time.Millisecond, Loss: 0.5})
+	defer mgr.Close()
+	lost := make([]bool, n)
+	for i := range lost {
+		result := probeSim(t, mgr, simTarget4, &Probe{TTL: 64, Timeout: 50 * time.Millisecond})
+		switch result.Code {
+		case CodeTimeout:
+			lost[i] = true
+		case CodeOK:
+		default:
+			t.Fatalf("probe %d: code %d", i, result.Code)
+		}
+	}
+	return lost
+}
+
+func TestSimLoss(t *testing.T) {
+	mgr := newSimManager(1, &SimRoute{Latency: time.Millisecond, Loss: 1})
+	defer mgr.Close()
+	if result := probeSim(t, mgr, simTarget4, &Probe{TTL: 64, Timeout: 50 * time.Millisecond}); result.Code != CodeTimeout {
+		t.Fatalf("code = %d, want timeout", result.Code)
+	}
+
+	first := lossPattern(t, 42, 20)
+	drop := 0
+	for _, lost := range first {
+		if lost {
+			drop++
+		}
+	}
+	if drop == 0 || drop == len(first) {
+		t.Fatalf("%d of %d lost with 50%% loss", drop, len(first))
+	}
+	if again := lossPattern(t, 42, 20); !reflect.DeepEqual(first, again) {
+		t.Fatalf("loss differs with the same seed: %v, %v", first, again)
+	}
+}
+
+func TestSimDuplicate(t *testing.T) {
+	mgr := newSimManager(1, &SimRoute{Latency: 5 * time.Millisecond, Duplicate: 1})
+	defer mgr.Close()
+	duplicates := make(chan *Result, 4)
+	start := time.Now()
+	delivery, err := mgr.IssueContext(context.Background(), &net.IPAddr{IP: simTarget4}, &Probe{
+		TTL:       64,
+		Timeout:   100 * time.Millisecond,
+		Duplicate: func(result *Result) { duplicates <- result },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first reply is delivered right away
+	result := <-delivery
+	if result.Code != CodeOK || time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("code %d after %v, want a reply before timeout", result.Code, time.Since(start))
+	}
+	// and the channel is closed once duplicates are counted
+	if _, ok := <-delivery; ok {
+		t.Fatal("more than one Result delivered")
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("closed after %v, before timeout", time.Since(start))
+	}
+	if n := len(duplicates); n != 1 {
+		t.Fatalf("%d duplicates, want 1", n)
+	}
+	if dup := <-duplicates; dup.Code != CodeOK || !dup.AddrIP.Equal(simTarget4) {
+		t.Fatalf("duplicate code %d from %s", dup.Code, dup.AddrIP)
+	}
+	// without counting, the first reply finishes the request
+	delivery, _ = mgr.IssueContext(context.Background(), &net.IPAddr{IP: simTarget4}, &Probe{TTL: 64, Timeout: time.Second})
+	if result = <-delivery; result.Code != CodeOK {
+		t.Fatalf("code %d, want a reply", result.Code)
+	}
+	if _, ok := <-delivery; ok || time.Since(start) > time.Second {
+		t.Fatal("request is not finished by the first reply")
+	}
+}
+
+func TestSimDuplicateCancel(t *testing.T) {
+	mgr := newSimManager(1, &SimRoute{Latency: time.Millisecond})
+	defer mgr.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	delivery, err := mgr.IssueContext(ctx, &net.IPAddr{IP: simTarget4}, &Probe{
+		TTL:       64,
+		Timeout:   time.Minute,
+		Duplicate: func(*Result) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := <-delivery; result.Code != CodeOK {
+		t.Fatalf("code %d, want a reply", result.Code)
+	}
+	// a replied request is closed without another Result
+	cancel()
+	select {
+	case result, ok := <-delivery:
+		if ok {
+			t.Fatalf("Result of code %d after the reply", result.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelled request is not closed")
+	}
+	if n := mgr.queue.Count(); n != 0 {
+		t.Fatalf("%d requests left in queue", n)
+	}
+}
+
+func TestSimReorder(t *testing.T) {
+	mgr := newSimManager(7, &SimRoute{Latency: time.Millisecond, Jitter: 50 * time.Millisecond})
+	defer mgr.Close()
+	const n = 20
+	issued := make([]time.Time, n)
+	deliveries := make([]chan *Result, n)
+	for i := range deliveries {
+		issued[i] = time.Now()
+		deliveries[i] = mgr.Issue(&net.IPAddr{IP: simTarget4}, 64, time.Second)
+	}
+	arrival := make([]time.Time, n)
+	for i, delivery := range deliveries {
+		result := <-delivery
+		if result.Code != CodeOK {
+			t.Fatalf("probe %d: code %d", i, result.Code)
+		}
+		if result.Latency > 51*time.Millisecond+latencySlack {
+			t.Fatalf("probe %d: latency %v beyond jitter", i, result.Latency)
+		}
+		arrival[i] = issued[i].Add(result.Latency)
+	}
+	for i := 1; i < n; i++ {
+		if arrival[i].Before(arrival[i-1]) {
+			return
+		}
+	}
+	t.Fatal("no reply overtakes an earlier one with 50ms jitter")
+}
+
+func TestSimScheduleOrder(t *testing.T) {
+	at := time.Now()
+	var h simSchedule
+	for i, offset := range []time.Duration{3, 1, 1, 2, 1} {
+		heap.Push(&h, simDelivery{p: simPacket{received: at.Add(offset)}, seq: uint64(i)})
+	}
+	var got []uint64
+	for h.Len() != 0 {
+		got = append(got, heap.Pop(&h).(simDelivery).seq)
+	}
+	// same arrival keeps the order of sending
+	if want := []uint64{1, 2, 4, 3, 0}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+}
+
+func TestSimPayloadDamage(t *testing.T) {
+	tests := []struct {
+		name      string
+		route     SimRoute
+		size      int
+		truncated bool
+		corrupted bool
+	}{
+		{"corrupted", SimRoute{Corrupt: 1}, 100, false, true},
+		{"truncated", SimRoute{Truncate: 1}, 100, true, false},
+		// the cookie alone is never damaged, or the reply isn't ours
+		{"cookie only", SimRoute{Corrupt: 1, Truncate: 1}, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := tt.route
+			route.Latency = time.Millisecond
+			mgr := newSimManager(1, &route)
+			defer mgr.Close()
+			result := probeSim(t, mgr, simTarget4, &Probe{TTL: 64, Size: tt.size, Fill: []byte{0xa5}})
+			if result.Code != CodeOK {
+				t.Fatalf("code = %d, want reply", result.Code)
+			}
+			if result.Truncated != tt.truncated || result.Corrupted != tt.corrupted {
+				t.Fatalf("truncated %v corrupted %v, want %v %v",
+					result.Truncated, result.Corrupted, tt.truncated, tt.corrupted)
+			}
+		})
+	}
+}
+
+func TestSimTimeExceeded(t *testing.T) {
+	labels := []MPLSLabel{{Label: 24001, TC: 0, S: false, TTL: 1}, {Label: 16, TC: 5, S: true, TTL: 1}}
+	route := &SimRoute{
+		Hops: []SimHop{
+			{IP: simHop4, Latency: 2 * time.Millisecond},
+			{IP: simHop6, Latency: 4 * time.Millisecond, MPLS: labels},
+		},
+		Latency: 6 * time.Millisecond,
+	}
+	mgr := newSimManager(1, route)
+	defer mgr.Close()
+	for _, ip := range []net.IP{simTarget4, simTarget6} {
+		result := probeSim(t, mgr, ip, &Probe{TTL: 1})
+		if result.Code != CodeTimeExceeded || !result.AddrIP.Equal(simHop4) || result.Extensions != nil {
+			t.Fatalf("%s ttl 1: code %d from %s, extensions %v", ip, result.Code, result.AddrIP, result.Extensions)
+		}
+		checkLatency(t, result, 2*time.Millisecond)
+		result = probeSim(t, mgr, ip, &Probe{TTL: 2})
+		if result.Code != CodeTimeExceeded || !result.AddrIP.Equal(simHop6) {
+			t.Fatalf("%s ttl 2: code %d from %s", ip, result.Code, result.AddrIP)
+		}
+		if result.Extensions == nil || !reflect.DeepEqual(result.Extensions.MPLS, labels) {
+			t.Fatalf("%s ttl 2: extensions %+v, want MPLS %v", ip, result.Extensions, labels)
+		}
+		if result = probeSim(t, mgr, ip, &Probe{TTL: 3}); result.Code != CodeOK {
+			t.Fatalf("%s ttl 3: code %d, want reply", ip, result.Code)
+		}
+	}
+}
+
+func TestSimTooBig(t *testing.T) {
+	route := &SimRoute{
+		Hops: []SimHop{
+			{IP: simHop4, Latency: time.Millisecond},
+			{IP: simHop6, Latency: 2 * time.Millisecond, MTU: 1280},
+		},
+		Latency: 3 * time.Millisecond,
+	}
+	mgr := newSimManager(1, route)
+	defer mgr.Close()
+	for _, tt := range []struct {
+		ip   net.IP
+		code int
+	}{
+		{simTarget4, 4},
+		{simTarget6, CodePacketTooBig},
+	} {
+		ip := tt.ip
+		result := probeSim(t, mgr, ip, &Probe{TTL: 64, Size: 1400})
+		if result.Code != tt.code || result.MTU != 1280 || !result.AddrIP.Equal(simHop6) {
+			t.Fatalf("%s: code %d from %s with MTU %d, want %d from %s with 1280",
+				ip, result.Code, result.AddrIP, result.MTU, tt.code, simHop6)
+		}
+		checkLatency(t, result, 2*time.Millisecond)
+		// probes dying before the link aren't affected
+		if result = probeSim(t, mgr, ip, &Probe{TTL: 1, Size: 1400}); result.Code != CodeTimeExceeded {
+			t.Fatalf("%s ttl 1: code %d, want time exceeded", ip, result.Code)
+		}
+		if result = probeSim(t, mgr, ip, &Probe{TTL: 64, Size: 1280}); result.Code != CodeOK {
+			t.Fatalf("%s: code %d for probe fitting MTU", ip, result.Code)
+		}
+	}
+}
+
+func TestSimUnreachable(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   net.IP
+		hops []SimHop
+		code int
+		from net.IP
+	}{
+		{"v4 host from target", simTarget4, nil, 1, simTarget4},
+		{"v4 admin prohibited from hop", simTarget4, []SimHop{{IP: simHop4}}, 13, simHop4},
+		{"v6 no route from hop", simTarget6, []SimHop{{IP: simHop6}}, 0, simHop6},
+		{"v6 admin prohibited from target", simTarget6, nil, 1, simTarget6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newSimManager(1, &SimRoute{Hops: tt.hops, Unreachable: true, Code: tt.code})
+			defer mgr.Close()
+			result := probeSim(t, mgr, tt.ip, &Probe{TTL: 64})
+			if result.Code != tt.code || !result.AddrIP.Equal(tt.from) {
+				t.Fatalf("code %d from %s, want %d from %s", result.Code, result.AddrIP, tt.code, tt.from)
+			}
+			if !result.Replied() {
+				t.Fatal("unreachable is not counted as replied")
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package network
+
+import (
+	"encoding/binary"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// setsockoptInt sets integer socket option on c
+func setsockoptInt(c syscall.Conn, level, opt, value int) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, value)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// enableDontFragment makes packets sent from c carry DF flag and never be
+// fragmented locally. Packets larger than the interface MTU fail to send with
+// EMSGSIZE, while the cached path MTU is ignored so it can be probed.
+func enableDontFragment(c syscall.Conn, v4 bool) error {
+	if v4 {
+		return setsockoptInt(c, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+	}
+	return setsockoptInt(c, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+}
+
+// enableRxTimestamp asks kernel to attach receive time to each packet read
+// from c as SCM_TIMESTAMPNS control message.
+func enableRxTimestamp(c syscall.Conn) error {
+	return setsockoptInt(c, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+}
+
+// rxTimestamp finds kernel receive time in control messages oob
+func rxTimestamp(oob []byte) (time.Time, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_SOCKET || m.Header.Type != syscall.SCM_TIMESTAMPNS ||
+			len(m.Data) < int(unsafe.Sizeof(syscall.Timespec{})) {
+			continue
+		}
+		ts := (*syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+		return time.Unix(ts.Unix()), true
+	}
+	return time.Time{}, false
+}
+
+// bindToDevice binds socket c to interface name, so it only uses routes and
+// addresses of the interface (or routing table of the VRF device).
+func bindToDevice(c syscall.RawConn, name string) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = syscall.BindToDevice(int(fd), name)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// IPV6_FLOWINFO, missing in syscall package
+const ipv6FlowInfo = 0xb
+
+// controlMessage builds control messages carrying per-packet options of
+// opts: IP_TTL, IP_PKTINFO and IP_TOS for IPv4, or IPV6_HOPLIMIT,
+// IPV6_PKTINFO, IPV6_TCLASS and IPV6_FLOWINFO for IPv6. ttl reports whether
+// TTL is carried, which always is on Linux.
+func controlMessage(v4 bool, opts *WriteOptions) (oob []byte, ttl bool, err error) {
+	if v4 {
+		if opts.Source != nil || opts.IfIndex != 0 {
+			oob = (&ipv4.ControlMessage{Src: opts.Source.To4(), IfIndex: opts.IfIndex}).Marshal()
+		}
+		oob = appendCmsgInt(oob, syscall.IPPROTO_IP, syscall.IP_TTL, opts.TTL)
+		if opts.TOS != 0 {
+			oob = appendCmsgInt(oob, syscall.IPPROTO_IP, syscall.IP_TOS, opts.TOS)
+		}
+		return oob, true, nil
+	}
+	oob = (&ipv6.ControlMessage{
+		TrafficClass: opts.TOS,
+		HopLimit:     opts.TTL,
+		Src:          opts.Source.To16(),
+		IfIndex:      opts.IfIndex,
+	}).Marshal()
+	if opts.FlowLabel != 0 {
+		// flow information is in network byte order
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(opts.FlowLabel&0xfffff))
+		oob = appendCmsg(oob, syscall.IPPROTO_IPV6, ipv6FlowInfo, b)
+	}
+	return oob, true, nil
+}
+
+// appendCmsgInt appends control message of an int in host byte order
+func appendCmsgInt(oob []byte, level, typ, value int) []byte {
+	b := make([]byte, 4)
+	*(*int32)(unsafe.Pointer(&b[0])) = int32(value)
+	return appendCmsg(oob, level, typ, b)
+}
+
+func appendCmsg(oob []byte, level, typ int, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return append(oob, b...)
+}
@@ -0,0 +1,71 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !linux
+// +build !linux
+
+package network
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"syscall"
+	"time"
+)
+
+// these socket options are only implemented on Linux. Elsewhere DF is left to
+// the system default.
+func enableDontFragment(c syscall.Conn, v4 bool) error {
+	return syscall.ENOPROTOOPT
+}
+
+func enableRxTimestamp(c syscall.Conn) error {
+	return syscall.ENOPROTOOPT
+}
+
+func rxTimestamp(oob []byte) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func bindToDevice(c syscall.RawConn, name string) error {
+	return syscall.ENOPROTOOPT
+}
+
+// controlMessage builds control messages carrying per-packet options of
+// opts. TTL is left to the socket option, and TOS of IPv4 and flow label
+// can't be set per packet here.
+func controlMessage(v4 bool, opts *WriteOptions) (oob []byte, ttl bool, err error) {
+	if v4 {
+		if opts.TOS != 0 {
+			return nil, false, syscall.ENOPROTOOPT
+		}
+		if opts.Source != nil || opts.IfIndex != 0 {
+			oob = (&ipv4.ControlMessage{Src: opts.Source.To4(), IfIndex: opts.IfIndex}).Marshal()
+		}
+		return oob, false, nil
+	}
+	if opts.FlowLabel != 0 {
+		return nil, false, syscall.ENOPROTOOPT
+	}
+	if opts.Source != nil || opts.IfIndex != 0 || opts.TOS != 0 {
+		oob = (&ipv6.ControlMessage{
+			TrafficClass: opts.TOS,
+			Src:          opts.Source.To16(),
+			IfIndex:      opts.IfIndex,
+		}).Marshal()
+	}
+	return oob, false, nil
+}
@@ -0,0 +1,96 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrSourceFamily means the source address of a probe is not of the same
+// address family as its target.
+var ErrSourceFamily = errors.New("source address family mismatch")
+
+// probeInterface returns the index of the outgoing interface of probe, 0 if
+// the probe isn't bound to one.
+func probeInterface(probe *Probe) (int, error) {
+	if probe.Interface == "" {
+		return 0, nil
+	}
+	ifi, err := net.InterfaceByName(probe.Interface)
+	if err != nil {
+		return 0, err
+	}
+	return ifi.Index, nil
+}
+
+// ProbeSource returns the source address of probe toward dst. If the probe
+// doesn't set Source, it's the address the kernel chooses, within the
+// routing table of Interface if set.
+func ProbeSource(dst net.IP, probe *Probe) (net.IP, error) {
+	if probe.Source != nil {
+		if (probe.Source.To4() != nil) != (dst.To4() != nil) {
+			return nil, ErrSourceFamily
+		}
+		return probe.Source.To16(), nil
+	}
+	if probe.Interface == "" {
+		return sourceIP(dst)
+	}
+	ifi, err := net.InterfaceByName(probe.Interface)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return bindToDevice(c, ifi.Name)
+		},
+	}
+	if conn, err := dialer.Dial("udp", (&net.UDPAddr{IP: dst, Port: 9}).String()); err == nil {
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.To16(), nil
+	}
+	// can't look up routes of the interface, take its first address
+	return interfaceIP(ifi, dst)
+}
+
+// interfaceIP returns an address of ifi in the same family of dst, preferring
+// link-local one only if dst is link-local.
+func interfaceIP(ifi *net.Interface, dst net.IP) (net.IP, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var found net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() != nil) != (dst.To4() != nil) {
+			continue
+		}
+		if ipNet.IP.IsLinkLocalUnicast() == dst.IsLinkLocalUnicast() {
+			return ipNet.IP.To16(), nil
+		}
+		if found == nil {
+			found = ipNet.IP.To16()
+		}
+	}
+	if found == nil {
+		return nil, &net.AddrError{Err: "no suitable address", Addr: ifi.Name}
+	}
+	return found, nil
+}
@@ -0,0 +1,398 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultTCPPort is the destination port of TCP probes whose target doesn't
+// carry a port.
+const DefaultTCPPort = 443
+
+const (
+	// local ports used by SYN probes. We stay above the default Linux
+	// ephemeral range so the kernel won't pick them for real connections.
+	tcpPortBase  = 61000
+	tcpPortRange = 65536 - tcpPortBase
+)
+
+// tcpFilter selects ICMP errors quoting SYN probes from our local ports
+var tcpFilter = RawFilter{
+	Protocol:   6, // iana.ProtocolTCP
+	SrcPort:    tcpPortBase,
+	SrcPortEnd: 65535,
+}
+
+// A TCPRequest represents a SYN probe issued by ping or trace
+type TCPRequest struct {
+	// Key used to identify request in queue. Its low 16 bits form the high
+	// 16 bits of Seq.
+	Key int
+	// sequence number of the SYN, extend identify field
+	Seq uint32
+	// target ip of the request, extend identify field
+	TargetIP net.IP
+	probeRequest
+}
+
+func (r *TCPRequest) Deliver(response Response) bool {
+	if response != nil {
+		ID, TargetIP := response.GetIdentifier()
+		if uint32(ID) != r.Seq || !TargetIP.Equal(r.TargetIP) {
+			return false
+		}
+	}
+	r.respond(response, nil)
+	return true
+}
+
+// A TCPResponse represents a TCPResponse (SYN-ACK, RST or ICMP error quoting
+// our SYN)
+type TCPResponse struct {
+	// low 16 bits of Key of the request, the high 16 bits of Seq
+	Key int
+	// sequence number of the SYN being responded
+	Seq uint32
+	// response source ip
+	AddrIP net.IP
+	// time passed from request time
+	Received time.Time
+	// clock source of Received
+	Clock ClockSource
+	// target ip of the request
+	TargetIP net.IP
+	// Code of the response, same meaning as ICMPResponse
+	Code int
+	// ICMP extensions if the response is ICMP error
+	Extensions *Extensions
+	// TOS (traffic class) of the probe header quoted in ICMP error, -1 if
+	// not known
+	QuotedTOS int
+}
+
+func (r TCPResponse) GetIdentifier() (int, net.IP) {
+	return int(r.Seq), r.TargetIP
+}
+
+func (r TCPResponse) GetInformation() (net.IP, time.Time, int) {
+	return r.AddrIP, r.Received, r.Code
+}
+
+func (r TCPResponse) GetClock() ClockSource {
+	return r.Clock
+}
+
+func (r TCPResponse) annotate(result *Result) {
+	result.Extensions = r.Extensions
+}
+
+func (r TCPResponse) quotedTOS() int {
+	return r.QuotedTOS
+}
+
+// A TCPManager sends TCP SYN probes and measures the time until SYN-ACK or RST
+// arrives. TTL limited probes dying mid-path are matched by ICMP errors
+// received by the ICMPManager.
+type TCPManager struct {
+	ipManager
+}
+
+// tcpManager is the shared manager returned by GetTCPManager, guarded by
+// tcpL
+var tcpManager *TCPManager
+var tcpL sync.Mutex
+
+// return TCPManager to caller. As listening to raw TCP will receive all TCP
+// packet, there will be only one manager in the whole process. A new manager
+// is created once the manager, or the ICMPManager it receives ICMP errors
+// from, is closed.
+func GetTCPManager() *TCPManager {
+	tcpL.Lock()
+	defer tcpL.Unlock()
+	if tcpManager == nil || tcpManager.stale() {
+		tcpManager = newTCPManager(GetICMPManager())
+	}
+	return tcpManager
+}
+
+// newTCPManager creates a TCPManager on raw TCP sockets, receiving ICMP
+// errors from icmp.
+func newTCPManager(icmp *ICMPManager) *TCPManager {
+	mgr := &TCPManager{}
+	mgr.init()
+	mgr.icmp = icmp
+	raw := make(chan *RawResponse, 1024)
+	err := mgr.listen("tcp", tcpFilter, raw)
+	if err != nil {
+		panic(fmt.Sprintf("Can't listen to TCP: %s", err))
+	}
+	result := make(chan Response, 1024)
+	for _, conn := range []*net.IPConn{mgr.conn4, mgr.conn6} {
+		if conn != nil {
+			conn := conn
+			spawn(&mgr.wg, func() { mgr.tcpReceiver(conn, 1000*time.Millisecond, result) })
+		}
+	}
+	spawn(&mgr.wg, func() { mgr.tcpRawReceiver(raw, result) })
+	spawn(&mgr.wg, func() {
+		mgr.dispatcher(result, func(response Response) {
+			mgr.dispatchLow(uint16(response.(*TCPResponse).Key), response)
+		})
+	})
+	return mgr
+}
+
+// listen to raw TCP socket to receive SYN-ACK or RST of our probes
+func (mgr *TCPManager) tcpReceiver(conn *net.IPConn, wait time.Duration, tcpResponse chan<- Response) {
+	readBytes := make([]byte, MaxPacketSize)
+	for {
+		select {
+		case <-mgr.ctx.Done():
+			return
+		default:
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+			return
+		}
+		n, sAddr, connErr := conn.ReadFromIP(readBytes)
+		now := time.Now()
+		if connErr != nil || sAddr == nil || n < 20 {
+			continue
+		}
+		response := parseTCPReply(readBytes[:n], sAddr.IP, now)
+		if response == nil {
+			continue
+		}
+		if !mgr.forward(tcpResponse, response) {
+			return
+		}
+	}
+}
+
+// translate ICMP errors quoting our SYN to TCPResponse
+func (mgr *TCPManager) tcpRawReceiver(raw chan *RawResponse, tcpResponse chan<- Response) {
+	for {
+		var response *RawResponse
+		select {
+		case <-mgr.ctx.Done():
+			return
+		case response = <-raw:
+		}
+		translated := tcpQuoted(response)
+		if translated == nil {
+			continue
+		}
+		if !mgr.forward(tcpResponse, translated) {
+			return
+		}
+	}
+}
+
+// Issue a TCP SYN probe. ip can be *net.TCPAddr to specify the destination
+// port, *FlowAddr to also fix the local port, or *net.IPAddr to use
+// DefaultTCPPort. return a channel to send result back
+func (mgr *TCPManager) Issue(ip net.Addr, ttl int, timeout time.Duration) chan *Result {
+	return resolved(mgr.IssueContext(context.Background(), ip, &Probe{TTL: ttl, Timeout: timeout}))
+}
+
+// IssueContext is the context-aware version of Issue. see Manager.
+func (mgr *TCPManager) IssueContext(ctx context.Context, ip net.Addr, probe *Probe) (chan *Result, error) {
+	var dest net.IP
+	port := DefaultTCPPort
+	flow := -1
+	switch addr := ip.(type) {
+	case *net.TCPAddr:
+		dest = addr.IP
+		if addr.Port != 0 {
+			port = addr.Port
+		}
+	case *FlowAddr:
+		dest = addr.IP
+		if addr.Port != 0 {
+			port = addr.Port
+		}
+		flow = addr.Flow
+	case *net.IPAddr:
+		dest = addr.IP
+	default:
+		return nil, fmt.Errorf("unsupported address type %T", ip)
+	}
+	v4 := dest.To4() != nil
+	dest = dest.To16()
+	if !mgr.available(v4) {
+		return unavailable(), ErrFamilyUnavailable
+	}
+	ifIndex, err := probeInterface(probe)
+	if err != nil {
+		return nil, err
+	}
+	src, err := ProbeSource(dest, probe)
+	if err == ErrSourceFamily {
+		return nil, err
+	}
+	if err != nil {
+		return failed(sendErrorCode(err)), err
+	}
+
+	count := mgr.nextKey()
+
+	// local port varies with each probe unless flow is given
+	if flow < 0 {
+		flow = int(count)
+	}
+	seq := tcpSeq(count)
+	msg := tcpSYN(src, dest, tcpPortBase+flow%tcpPortRange, port, seq)
+
+	request := &TCPRequest{
+		Key:      int(count),
+		Seq:      seq,
+		TargetIP: dest,
+	}
+	request.init(ctx, probe)
+	if !mgr.enqueue(ctx, int(count), request, &request.probeRequest, probe.Timeout) {
+		return request.delivery, ErrClosed
+	}
+
+	err = send(mgr.queue, int(count), request, &request.probeRequest, func(time.Time) error {
+		// kernel chooses the same source as ProbeSource if not set
+		opts := &WriteOptions{
+			TTL:       probe.TTL,
+			Source:    probe.Source,
+			IfIndex:   ifIndex,
+			TOS:       probe.TOS,
+			FlowLabel: probe.FlowLabel,
+		}
+		return mgr.write(v4, msg, dest, opts)
+	})
+	return request.delivery, err
+}
+
+// tcpSeq returns the sequence number of the SYN probe keyed key. SYN-ACK and
+// ICMP errors carry back only the sequence number, so its high 16 bits are the
+// low 16 bits of key, and the rest is random.
+func tcpSeq(key uint64) uint32 {
+	return uint32(uint16(key))<<16 | uint32(rand.Intn(1<<16))
+}
+
+// parseTCPReply returns the TCPResponse of segment b from ip, or nil if it
+// doesn't acknowledge a SYN of ours.
+func parseTCPReply(b []byte, ip net.IP, now time.Time) *TCPResponse {
+	if len(b) < 20 {
+		return nil
+	}
+	// TCP header: source port(2) destination port(2) seq(4) ack(4)
+	// data offset(1) flags(1)...
+	localPort := int(binary.BigEndian.Uint16(b[2:4]))
+	if localPort < tcpPortBase {
+		return nil
+	}
+	flags := b[13]
+	// we only care SYN-ACK and RST-ACK which acknowledge our SYN
+	if flags&0x10 == 0 || flags&0x06 == 0 { // ACK, RST|SYN
+		return nil
+	}
+	seq := binary.BigEndian.Uint32(b[8:12]) - 1
+	return &TCPResponse{
+		Key:       int(seq >> 16),
+		Seq:       seq,
+		AddrIP:    ip,
+		Received:  now,
+		TargetIP:  ip.To16(),
+		Code:      257,
+		QuotedTOS: -1,
+	}
+}
+
+// tcpQuoted translates the ICMP error quoting our SYN to TCPResponse, or nil
+// if too little of the SYN is quoted.
+func tcpQuoted(response *RawResponse) *TCPResponse {
+	// first 8 bytes of TCP header: source port(2) destination port(2) seq(4)
+	if len(response.Fragment) < 8 {
+		return nil
+	}
+	seq := binary.BigEndian.Uint32(response.Fragment[4:8])
+	return &TCPResponse{
+		Key:        int(seq >> 16),
+		Seq:        seq,
+		AddrIP:     response.AddrIP,
+		Received:   response.Received,
+		Clock:      response.Clock,
+		Extensions: response.Extensions,
+		QuotedTOS:  response.QuotedTOS,
+		TargetIP:   response.TargetIP,
+		Code:       response.Code,
+	}
+}
+
+// sourceIP returns the local address the kernel will choose to reach dst.
+func sourceIP(dst net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 9})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.To16(), nil
+}
+
+// tcpSYN builds a TCP SYN segment with MSS option and valid checksum
+func tcpSYN(src, dst net.IP, srcPort, dstPort int, seq uint32) []byte {
+	b := make([]byte, 24)
+	binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint32(b[4:8], seq)
+	b[12] = 6 << 4 // data offset: 6 words, header with MSS option
+	b[13] = 0x02   // SYN
+	binary.BigEndian.PutUint16(b[14:16], 65535)
+	b[20], b[21] = 2, 4 // MSS option
+	binary.BigEndian.PutUint16(b[22:24], 1460)
+	binary.BigEndian.PutUint16(b[16:18], pseudoChecksum(src, dst, 6, b))
+	return b
+}
+
+// pseudoChecksum computes TCP/UDP checksum over the IPv4 or IPv6 pseudo header
+// and the segment b.
+func pseudoChecksum(src, dst net.IP, proto int, b []byte) uint16 {
+	var sum uint32
+	add := func(p []byte) {
+		for i := 0; i+1 < len(p); i += 2 {
+			sum += uint32(p[i])<<8 | uint32(p[i+1])
+		}
+		if len(p)%2 == 1 {
+			sum += uint32(p[len(p)-1]) << 8
+		}
+	}
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		add(src4)
+		add(dst4)
+	} else {
+		add(src.To16())
+		add(dst.To16())
+	}
+	sum += uint32(proto) + uint32(len(b))
+	add(b)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
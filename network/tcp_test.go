@@ -0,0 +1,177 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	simLocal4 = net.ParseIP("192.0.2.1")
+	simLocal6 = net.ParseIP("2001:db8::1")
+)
+
+func TestTCPSYN(t *testing.T) {
+	for _, c := range []struct{ src, dst net.IP }{
+		{simLocal4, simTarget4},
+		{simLocal6, simTarget6},
+	} {
+		seq := tcpSeq(0x12345)
+		if seq>>16 != 0x2345 {
+			t.Fatalf("seq %#x doesn't carry the low 16 bits of key", seq)
+		}
+		b := tcpSYN(c.src, c.dst, tcpPortBase+5, 443, seq)
+		if len(b) != 24 || b[12]>>4 != 6 || b[13] != 0x02 {
+			t.Fatalf("%s: segment % x, want a SYN with MSS option", c.dst, b)
+		}
+		if sport, dport := binary.BigEndian.Uint16(b[0:2]), binary.BigEndian.Uint16(b[2:4]); sport != tcpPortBase+5 || dport != 443 {
+			t.Fatalf("%s: ports %d > %d", c.dst, sport, dport)
+		}
+		if got := binary.BigEndian.Uint32(b[4:8]); got != seq {
+			t.Fatalf("%s: seq %#x, want %#x", c.dst, got, seq)
+		}
+		// a segment with its checksum in place sums to zero
+		if sum := pseudoChecksum(c.src, c.dst, 6, b); sum != 0 {
+			t.Fatalf("%s: bad checksum, residue %#x", c.dst, sum)
+		}
+	}
+}
+
+// tcpReply builds the header of a segment from port 443 to port with flags,
+// acknowledging ack
+func tcpReply(port int, flags byte, ack uint32) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b[0:2], 443)
+	binary.BigEndian.PutUint16(b[2:4], uint16(port))
+	binary.BigEndian.PutUint32(b[4:8], 0xcafe)
+	binary.BigEndian.PutUint32(b[8:12], ack)
+	b[12] = 5 << 4
+	b[13] = flags
+	return b
+}
+
+func TestParseTCPReply(t *testing.T) {
+	const ack = 0x23450008
+	for _, c := range []struct {
+		name string
+		b    []byte
+		ours bool
+	}{
+		{"SYN-ACK", tcpReply(tcpPortBase+5, 0x12, ack), true},
+		{"RST-ACK", tcpReply(tcpPortBase+5, 0x14, ack), true},
+		{"RST", tcpReply(tcpPortBase+5, 0x04, ack), false},
+		{"SYN", tcpReply(tcpPortBase+5, 0x02, ack), false},
+		{"ACK", tcpReply(tcpPortBase+5, 0x10, ack), false},
+		{"foreign port", tcpReply(tcpPortBase-1, 0x12, ack), false},
+		{"short", tcpReply(tcpPortBase+5, 0x12, ack)[:19], false},
+	} {
+		at := time.Now()
+		r := parseTCPReply(c.b, simTarget4, at)
+		if (r != nil) != c.ours {
+			t.Fatalf("%s: response %+v, want ours %v", c.name, r, c.ours)
+		}
+		if r == nil {
+			continue
+		}
+		if r.Seq != ack-1 || r.Key != 0x2345 || r.Code != CodeOK || !r.TargetIP.Equal(simTarget4) || !r.Received.Equal(at) {
+			t.Fatalf("%s: %+v, want seq %#x of key 0x2345", c.name, r, ack-1)
+		}
+	}
+}
+
+func TestTCPQuoted(t *testing.T) {
+	seq := tcpSeq(0x4321)
+	quoted := func(src, dst net.IP, port int) []byte {
+		syn := tcpSYN(src, dst, port, 443, seq)
+		if dst.To4() != nil {
+			return quoteIPv4(src, dst, 6, 0, syn)
+		}
+		return quoteIPv6(src, dst, 6, 0, 0, syn)
+	}
+	for _, c := range []struct {
+		name  string
+		msg   icmp.Message
+		parse func([]byte, net.IP, time.Time, ClockSource) (*ICMPResponse, *RawResponse)
+		dst   net.IP
+		code  int
+		match bool
+	}{
+		{"v4 time exceeded", icmp.Message{
+			Type: ipv4.ICMPTypeTimeExceeded,
+			Body: &icmp.TimeExceeded{Data: quoted(simLocal4, simTarget4, tcpPortBase+5)},
+		}, parseICMPv4, simTarget4, CodeTimeExceeded, true},
+		{"v4 prohibited", icmp.Message{
+			Type: ipv4.ICMPTypeDestinationUnreachable, Code: 13,
+			Body: &icmp.DstUnreach{Data: quoted(simLocal4, simTarget4, tcpPortBase+5)},
+		}, parseICMPv4, simTarget4, 13, true},
+		{"v6 time exceeded", icmp.Message{
+			Type: ipv6.ICMPTypeTimeExceeded,
+			Body: &icmp.TimeExceeded{Data: quoted(simLocal6, simTarget6, tcpPortBase+5)},
+		}, parseICMPv6, simTarget6, CodeTimeExceeded, true},
+		{"foreign port", icmp.Message{
+			Type: ipv4.ICMPTypeTimeExceeded,
+			Body: &icmp.TimeExceeded{Data: quoted(simLocal4, simTarget4, 40000)},
+		}, parseICMPv4, simTarget4, CodeTimeExceeded, false},
+	} {
+		b, err := c.msg.Marshal(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, raw := c.parse(b, simHop4, time.Now(), ClockUser)
+		if raw == nil || raw.Protocol != 6 {
+			t.Fatalf("%s: raw response %+v, want TCP", c.name, raw)
+		}
+		if tcpFilter.Match(raw) != c.match {
+			t.Fatalf("%s: filter matches %v, want %v", c.name, !c.match, c.match)
+		}
+		r := tcpQuoted(raw)
+		if r == nil || r.Seq != seq || r.Key != 0x4321 || r.Code != c.code || !r.TargetIP.Equal(c.dst) || !r.AddrIP.Equal(simHop4) {
+			t.Fatalf("%s: %+v, want seq %#x code %d", c.name, r, seq, c.code)
+		}
+	}
+	if r := tcpQuoted(&RawResponse{Protocol: 6, Fragment: make([]byte, 7)}); r != nil {
+		t.Fatalf("%+v from a short quote", r)
+	}
+}
+
+func TestTCPRequestDeliver(t *testing.T) {
+	seq := tcpSeq(7)
+	request := &TCPRequest{Key: 7, Seq: seq, TargetIP: simTarget4.To16()}
+	request.init(context.Background(), &Probe{Timeout: time.Second})
+	request.SetTimeout(time.Second)
+	for _, r := range []*TCPResponse{
+		{Seq: seq + 1, TargetIP: simTarget4.To16()},
+		{Seq: seq, TargetIP: simTarget6},
+	} {
+		if request.Deliver(r) {
+			t.Fatalf("delivered %+v of another probe", r)
+		}
+	}
+	if !request.Deliver(&TCPResponse{Seq: seq, TargetIP: simTarget4.To16(), AddrIP: simTarget4, Received: time.Now(), Code: CodeOK}) {
+		t.Fatal("reply not delivered")
+	}
+	if result := <-request.delivery; result.Code != CodeOK || !result.AddrIP.Equal(simTarget4) {
+		t.Fatalf("result %+v", result)
+	}
+}
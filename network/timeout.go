@@ -0,0 +1,119 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+type deadlineEntry struct {
+	deadline time.Time
+	key      int
+	request  Request
+}
+
+// deadlineHeap is a min-heap of deadlineEntry ordered by deadline
+type deadlineHeap []deadlineEntry
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h deadlineHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *deadlineHeap) Push(x interface{}) {
+	*h = append(*h, x.(deadlineEntry))
+}
+
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = deadlineEntry{}
+	*h = old[:len(old)-1]
+	return e
+}
+
+// A deadlineQueue orders pending requests by deadline, so they can be expired
+// right at their deadline without scanning the whole ConMapRequest.
+//
+// Requests finished early are left in the queue and skipped on expiry, as
+// finishing a request twice is a no-op.
+type deadlineQueue struct {
+	entries deadlineHeap
+	l       sync.Mutex
+	// notified when the earliest deadline changes
+	wake chan struct{}
+}
+
+func newDeadlineQueue() *deadlineQueue {
+	return &deadlineQueue{
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Push adds request stored under key with its deadline
+func (q *deadlineQueue) Push(key int, request Request, deadline time.Time) {
+	q.l.Lock()
+	heap.Push(&q.entries, deadlineEntry{
+		deadline: deadline,
+		key:      key,
+		request:  request,
+	})
+	earliest := q.entries[0].request == request
+	q.l.Unlock()
+	if earliest {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// expire removes requests passed deadline at now from queue and finishes them
+// with timeout. returns the next deadline, or zero time if none is pending.
+func (q *deadlineQueue) expire(queue *ConMapRequest, now time.Time) time.Time {
+	var expired []deadlineEntry
+	next := time.Time{}
+	q.l.Lock()
+	for len(q.entries) != 0 {
+		if q.entries[0].deadline.After(now) {
+			next = q.entries[0].deadline
+			break
+		}
+		expired = append(expired, heap.Pop(&q.entries).(deadlineEntry))
+	}
+	q.l.Unlock()
+	for _, e := range expired {
+		// the key may be taken by a newer request, leave it there
+		queue.RemoveIf(e.key, e.request)
+		e.request.Deliver(nil)
+	}
+	return next
+}
+
+// resetTimer makes timer fire at next, or stops it if next is zero.
+func resetTimer(timer *time.Timer, next time.Time) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	if !next.IsZero() {
+		timer.Reset(time.Until(next))
+	}
+}
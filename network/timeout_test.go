@@ -0,0 +1,145 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// countingRequest is a Request counting how it's finished
+type countingRequest struct {
+	timeouts int
+}
+
+func (r *countingRequest) SetTimeout(time.Duration) {}
+func (r *countingRequest) Passed(time.Time) bool    { return true }
+func (r *countingRequest) Fail(int)                 {}
+
+func (r *countingRequest) Deliver(response Response) bool {
+	if response == nil {
+		r.timeouts++
+	}
+	return true
+}
+
+func TestDeadlineQueueExpire(t *testing.T) {
+	q := newDeadlineQueue()
+	queue := NewCMap(4)
+	at := time.Now()
+	requests := make([]*countingRequest, 5)
+	for i, offset := range []int{30, 10, 50, 20, 40} {
+		requests[i] = &countingRequest{}
+		queue.Set(i, requests[i], 0)
+		q.Push(i, requests[i], at.Add(time.Duration(offset)*time.Millisecond))
+	}
+	select {
+	case <-q.wake:
+	default:
+		t.Fatal("no wake-up for the earliest deadline")
+	}
+
+	next := q.expire(queue, at.Add(25*time.Millisecond))
+	if want := at.Add(30 * time.Millisecond); !next.Equal(want) {
+		t.Fatalf("next deadline %v, want %v", next.Sub(at), want.Sub(at))
+	}
+	for i, want := range []int{0, 1, 0, 1, 0} {
+		if requests[i].timeouts != want {
+			t.Fatalf("request %d: %d timeouts, want %d", i, requests[i].timeouts, want)
+		}
+	}
+	if n := queue.Count(); n != 3 {
+		t.Fatalf("%d requests in queue, want 3", n)
+	}
+
+	// a newer request under an expired key is left alone
+	newer := &countingRequest{}
+	queue.Set(0, newer, 0)
+	if next = q.expire(queue, at.Add(time.Hour)); !next.IsZero() {
+		t.Fatalf("next deadline %v with none pending", next.Sub(at))
+	}
+	if _, ok := queue.Get(0); !ok || newer.timeouts != 0 {
+		t.Fatal("newer request under the same key is expired")
+	}
+}
+
+// BenchmarkDeadlineQueue measures pushing a request and expiring it with n
+// others in flight.
+func BenchmarkDeadlineQueue(b *testing.B) {
+	for _, n := range []int{10000, 60000} {
+		b.Run(fmt.Sprintf("inflight=%d", n), func(b *testing.B) {
+			q := newDeadlineQueue()
+			queue := NewCMap(32)
+			at := time.Now()
+			rnd := rand.New(rand.NewSource(1))
+			for i := 0; i < n; i++ {
+				r := &countingRequest{}
+				queue.Set(i, r, 0)
+				q.Push(i, r, at.Add(time.Hour+time.Duration(rnd.Int63n(int64(time.Hour)))))
+			}
+			r := &countingRequest{}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := n + i
+				queue.Set(key, r, 0)
+				q.Push(key, r, at)
+				q.expire(queue, at)
+			}
+			b.StopTimer()
+			if r.timeouts != b.N {
+				b.Fatalf("%d of %d expired", r.timeouts, b.N)
+			}
+		})
+	}
+}
+
+// BenchmarkManagerInFlight measures a probe round trip on a SimNetwork
+// manager with n requests in flight, whose probes are lost.
+func BenchmarkManagerInFlight(b *testing.B) {
+	lost := net.ParseIP("198.51.100.99")
+	for _, n := range []int{10000, 60000} {
+		b.Run(fmt.Sprintf("inflight=%d", n), func(b *testing.B) {
+			sim := NewSimNetwork(1)
+			sim.Route(simTarget4, &SimRoute{})
+			sim.Route(lost, &SimRoute{Loss: 1})
+			mgr := sim.Manager()
+			defer mgr.Close()
+			for i := 0; i < n; i++ {
+				if _, err := mgr.IssueContext(context.Background(), &net.IPAddr{IP: lost}, &Probe{TTL: 64, Timeout: time.Hour}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			target := &net.IPAddr{IP: simTarget4}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if result := <-mgr.Issue(target, 64, time.Minute); result.Code != CodeOK {
+					b.Fatalf("code %d", result.Code)
+				}
+			}
+			b.StopTimer()
+			if pending := mgr.queue.Count(); pending != n {
+				b.Fatalf("%d requests in flight, want %d", pending, n)
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A PacketTransport sends and receives ICMP messages of one address family
+// for ICMPManager.
+type PacketTransport interface {
+	// ReadFrom reads an ICMP message, without IP header, into b.
+	ReadFrom(b []byte) (n int, src net.Addr, err error)
+	// WriteTo sends ICMP message b to dst with given TTL (hop limit). It's
+	// called concurrently, and the TTL must only apply to this message.
+	WriteTo(b []byte, dst net.Addr, ttl int) (int, error)
+	// SetReadDeadline sets the deadline of ReadFrom.
+	SetReadDeadline(t time.Time) error
+	// Close closes the transport.
+	Close() error
+}
+
+// WriteOptions are per-packet parameters of an outgoing probe
+type WriteOptions struct {
+	// TTL (hop limit) of the packet
+	TTL int
+	// source address of the packet, nil to let kernel choose
+	Source net.IP
+	// index of the outgoing interface, 0 to let kernel route
+	IfIndex int
+	// TOS (traffic class) byte and IPv6 flow label of the packet
+	TOS       int
+	FlowLabel int
+}
+
+// errWriteOptions means the transport can't send with given WriteOptions
+var errWriteOptions = errors.New("transport doesn't support per-packet options")
+
+// writeTo sends b to dst through conn with per-packet options. Transports
+// taking more than TTL implement WriteToOptions.
+func writeTo(conn PacketTransport, b []byte, dst net.Addr, opts *WriteOptions) (int, error) {
+	if w, ok := conn.(interface {
+		WriteToOptions([]byte, net.Addr, *WriteOptions) (int, error)
+	}); ok {
+		return w.WriteToOptions(b, dst, opts)
+	}
+	if opts.Source != nil || opts.IfIndex != 0 || opts.TOS != 0 || opts.FlowLabel != 0 {
+		return 0, errWriteOptions
+	}
+	return conn.WriteTo(b, dst, opts.TTL)
+}
+
+// ttlLock serializes setting TTL on socket and sending, where TTL can't be
+// sent as control message.
+var ttlLock sync.Mutex
+
+// writeControl sends b to dst through conn, a raw IP or datagram socket of
+// IPv4 (p4) or IPv6 (p6 if p4 is nil). Options are sent as control messages
+// (see controlMessage), so they never leak to other probes sharing conn.
+func writeControl(conn net.PacketConn, p4 *ipv4.PacketConn, p6 *ipv6.PacketConn, b []byte, dst net.Addr, opts *WriteOptions) (int, error) {
+	oob, ttl, err := controlMessage(p4 != nil, opts)
+	if err != nil {
+		return 0, err
+	}
+	if !ttl {
+		ttlLock.Lock()
+		defer ttlLock.Unlock()
+		if p4 != nil {
+			err = p4.SetTTL(opts.TTL)
+		} else {
+			err = p6.SetHopLimit(opts.TTL)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(oob) == 0 {
+		return conn.WriteTo(b, dst)
+	}
+	switch c := conn.(type) {
+	case *net.IPConn:
+		if addr, ok := dst.(*net.IPAddr); ok {
+			n, _, err := c.WriteMsgIP(b, oob, addr)
+			return n, err
+		}
+	case *net.UDPConn:
+		if addr, ok := dst.(*net.UDPAddr); ok {
+			n, _, err := c.WriteMsgUDP(b, oob, addr)
+			return n, err
+		}
+	}
+	return 0, errWriteOptions
+}
+
+// icmpTransport is a PacketTransport over raw IP socket, or ICMP socket of icmp
+// package in datagram mode
+type icmpTransport struct {
+	// messages read, accessed atomically
+	received uint64
+	conn     net.PacketConn
+	// conn as raw IP socket, nil in datagram mode. read with control
+	// messages to get kernel receive timestamps.
+	ip *net.IPConn
+	p4 *ipv4.PacketConn
+	p6 *ipv6.PacketConn
+	v4 bool
+	// whether conn is datagram socket, which uses *net.UDPAddr as address
+	datagram bool
+	// whether kernel receive timestamp is enabled
+	timestamp bool
+	// echo ID of probes, passed by the socket filter
+	id int
+	// whether the socket filter is attached, and ICMP messages received by
+	// the host when it's attached
+	filter   bool
+	hostBase uint64
+}
+
+// ListenICMP opens ICMP socket as PacketTransport. network can be "ip4:icmp"
+// or "ip6:ipv6-icmp" for raw socket, or "udp4" or "udp6" for unprivileged
+// datagram socket.
+func ListenICMP(network string) (PacketTransport, error) {
+	if network == "udp4" || network == "udp6" {
+		return listenICMPDatagram(network)
+	}
+	conn, err := net.ListenIP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	t := &icmpTransport{
+		conn: conn,
+		ip:   conn,
+		v4:   strings.HasPrefix(network, "ip4"),
+	}
+	if t.v4 {
+		t.p4 = ipv4.NewPacketConn(conn)
+	} else {
+		t.p6 = ipv6.NewPacketConn(conn)
+	}
+	t.timestamp = enableRxTimestamp(conn) == nil
+	_ = enableDontFragment(conn, t.v4)
+	t.attachFilter()
+	return t, nil
+}
+
+// attachFilter picks the echo ID and attaches socket filter passing only
+// what ICMPManager handles, see icmpFilter.
+func (t *icmpTransport) attachFilter() {
+	t.id = rand.Intn(1 << 16)
+	filter, err := icmpFilter(t.v4, t.id)
+	if err != nil {
+		return
+	}
+	if t.v4 {
+		err = t.p4.SetBPF(filter)
+	} else {
+		err = t.p6.SetBPF(filter)
+	}
+	if err != nil {
+		return
+	}
+	t.filter = true
+	t.hostBase, _ = hostICMPInput(t.v4)
+}
+
+// EchoID returns the echo ID passed by the socket filter
+func (t *icmpTransport) EchoID() int {
+	return t.id
+}
+
+// FilterStat returns counters of the socket filter
+func (t *icmpTransport) FilterStat() FilterStat {
+	stat := FilterStat{
+		Enabled:  t.filter,
+		Received: atomic.LoadUint64(&t.received),
+	}
+	if !t.filter {
+		return stat
+	}
+	if host, ok := hostICMPInput(t.v4); ok && host-t.hostBase > stat.Received {
+		stat.FilteredEstimate = host - t.hostBase - stat.Received
+	}
+	return stat
+}
+
+func (t *icmpTransport) Mode() string {
+	if t.datagram {
+		return "datagram"
+	}
+	return "raw"
+}
+
+func (t *icmpTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, src, _, err := t.ReadFromTimestamp(b)
+	return n, src, err
+}
+
+// ReadFromTimestamp is ReadFrom also returning the kernel receive time, or
+// zero time if not available.
+func (t *icmpTransport) ReadFromTimestamp(b []byte) (int, net.Addr, time.Time, error) {
+	if t.ip == nil || !t.timestamp {
+		n, src, err := t.conn.ReadFrom(b)
+		if err == nil {
+			atomic.AddUint64(&t.received, 1)
+		}
+		if udpAddr, ok := src.(*net.UDPAddr); ok {
+			src = &net.IPAddr{IP: udpAddr.IP, Zone: udpAddr.Zone}
+		}
+		return n, src, time.Time{}, err
+	}
+	buf := oobPool.Get().(*[]byte)
+	defer oobPool.Put(buf)
+	oob := *buf
+	n, oobn, _, src, err := t.ip.ReadMsgIP(b, oob)
+	if err != nil {
+		return 0, nil, time.Time{}, err
+	}
+	atomic.AddUint64(&t.received, 1)
+	// unlike ReadFrom, ReadMsgIP keeps IPv4 header
+	if t.v4 {
+		if n, err = stripIPv4Header(b[:n]); err != nil {
+			return 0, nil, time.Time{}, err
+		}
+	}
+	received, _ := rxTimestamp(oob[:oobn])
+	return n, src, received, nil
+}
+
+// stripIPv4Header moves the payload of IPv4 packet b to its start, and returns
+// the payload length. b without IPv4 header is left as is.
+func stripIPv4Header(b []byte) (int, error) {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return len(b), nil
+	}
+	l := int(b[0]&0x0f) << 2
+	if l < 20 || l > len(b) {
+		return 0, errInvalidHeader
+	}
+	return copy(b, b[l:]), nil
+}
+
+func (t *icmpTransport) WriteTo(b []byte, dst net.Addr, ttl int) (int, error) {
+	return t.WriteToOptions(b, dst, &WriteOptions{TTL: ttl})
+}
+
+// WriteToOptions is WriteTo with source address and outgoing interface.
+func (t *icmpTransport) WriteToOptions(b []byte, dst net.Addr, opts *WriteOptions) (int, error) {
+	if ipAddr, ok := dst.(*net.IPAddr); ok && t.datagram {
+		dst = &net.UDPAddr{IP: ipAddr.IP, Zone: ipAddr.Zone}
+	}
+	if t.v4 {
+		return writeControl(t.conn, t.p4, nil, b, dst, opts)
+	}
+	return writeControl(t.conn, nil, t.p6, b, dst, opts)
+}
+
+func (t *icmpTransport) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+func (t *icmpTransport) Close() error {
+	return t.conn.Close()
+}
+
+var errInvalidHeader = errors.New("invalid IPv4 header")
+
+// packetPool holds receive buffers of MaxPacketSize bytes
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, MaxPacketSize)
+		return &b
+	},
+}
+
+// oobPool holds control message buffers for reads, large enough for a
+// timestamp and an extended socket error with its offender address
+var oobPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 512)
+		return &b
+	},
+}
+
+// receiveLoop reads packets from conn into pooled buffers and passes them to
+// handle, until ctx is done or conn is closed. Reads time out every wait to
+// check ctx. b is reused once handle returns, so handle must copy what it
+// keeps.
+func receiveLoop(ctx context.Context, conn PacketTransport, wait time.Duration,
+	handle func(b []byte, src net.IP, received time.Time, clock ClockSource)) {
+	for ctx.Err() == nil {
+		if err := conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+			return
+		}
+		buf := packetPool.Get().(*[]byte)
+		n, src, received, clock, err := readFrom(conn, *buf)
+		if ipAddr, ok := src.(*net.IPAddr); ok && err == nil {
+			handle((*buf)[:n], ipAddr.IP, received, clock)
+		}
+		packetPool.Put(buf)
+	}
+}
+
+// readFrom reads from conn, with kernel receive time if conn provides it.
+func readFrom(conn PacketTransport, b []byte) (int, net.Addr, time.Time, ClockSource, error) {
+	if r, ok := conn.(interface {
+		ReadFromTimestamp([]byte) (int, net.Addr, time.Time, error)
+	}); ok {
+		n, src, received, err := r.ReadFromTimestamp(b)
+		if !received.IsZero() {
+			return n, src, received, ClockKernel, err
+		}
+		return n, src, time.Now(), ClockUser, err
+	}
+	n, src, err := conn.ReadFrom(b)
+	return n, src, time.Now(), ClockUser, err
+}
+
+// transportMode returns how the transport reaches network, e.g. "raw" or
+// "datagram".
+func transportMode(t PacketTransport) string {
+	if t == nil {
+		return "disabled"
+	}
+	if m, ok := t.(interface{ Mode() string }); ok {
+		return m.Mode()
+	}
+	return "custom"
+}
+
+// echoID returns the echo ID to use on the transport. Datagram sockets on
+// Linux have it fixed by kernel.
+func echoID(t PacketTransport) int {
+	if e, ok := t.(interface{ EchoID() int }); ok {
+		return e.EchoID()
+	}
+	return rand.Intn(1 << 16)
+}
+
+// quoteIPv4 builds the IPv4 header of a packet carrying payload, as quoted in
+// ICMP errors, followed by payload.
+func quoteIPv4(src, dst net.IP, protocol, tos int, payload []byte) []byte {
+	h := &ipv4.Header{
+		Version:  4,
+		Len:      20,
+		TOS:      tos,
+		TotalLen: 20 + len(payload),
+		TTL:      1,
+		Protocol: protocol,
+		Src:      src.To4(),
+		Dst:      dst.To4(),
+	}
+	b, _ := h.Marshal()
+	return append(b, payload...)
+}
+
+// quoteIPv6 builds the IPv6 header of a packet carrying payload, as quoted in
+// ICMPv6 errors, followed by payload.
+func quoteIPv6(src, dst net.IP, nextHeader, trafficClass, flowLabel int, payload []byte) []byte {
+	b := make([]byte, 40, 40+len(payload))
+	binary.BigEndian.PutUint32(b[0:4], 6<<28|uint32(trafficClass&0xff)<<20|uint32(flowLabel&0xfffff))
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(payload)))
+	b[6] = byte(nextHeader)
+	b[7] = 1
+	copy(b[8:24], src.To16())
+	copy(b[24:40], dst.To16())
+	return append(b, payload...)
+}
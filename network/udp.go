@@ -0,0 +1,315 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/bpf"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// classic traceroute destination ports, used when target doesn't carry
+	// a port.
+	udpClassicBase  = 33434
+	udpClassicRange = 100
+	// local port used by UDP probes, chosen from this range.
+	udpPortBase  = 61000
+	udpPortRange = 65536 - udpPortBase
+)
+
+// A UDPRequest represents a UDP probe issued by trace
+type UDPRequest struct {
+	// Key used to identify request in queue. Its low 16 bits are the
+	// checksum of the probe.
+	Key int
+	// destination port of the probe, extend identify field
+	Port int
+	// target ip of the request, extend identify field
+	TargetIP net.IP
+	probeRequest
+}
+
+func (r *UDPRequest) Deliver(response Response) bool {
+	if response != nil {
+		ID, TargetIP := response.GetIdentifier()
+		if ID != r.Port<<16|int(uint16(r.Key)) || !TargetIP.Equal(r.TargetIP) {
+			return false
+		}
+	}
+	r.respond(response, nil)
+	return true
+}
+
+// A UDPResponse represents an ICMP error (TimeExceed or DstUnreachable)
+// quoting our UDP probe
+type UDPResponse struct {
+	// checksum of quoted probe, the low 16 bits of Key of the request
+	Key int
+	// destination port of quoted probe
+	Port int
+	// response source ip
+	AddrIP net.IP
+	// time passed from request time
+	Received time.Time
+	// clock source of Received
+	Clock ClockSource
+	// target ip of the request
+	TargetIP net.IP
+	// Code of the response, same meaning as ICMPResponse
+	Code int
+	// ICMP extensions if the response is ICMP error
+	Extensions *Extensions
+	// TOS (traffic class) of the probe header quoted in ICMP error, -1 if
+	// not known
+	QuotedTOS int
+}
+
+func (r UDPResponse) GetIdentifier() (int, net.IP) {
+	return r.Port<<16 | r.Key, r.TargetIP
+}
+
+func (r UDPResponse) GetInformation() (net.IP, time.Time, int) {
+	return r.AddrIP, r.Received, r.Code
+}
+
+func (r UDPResponse) GetClock() ClockSource {
+	return r.Clock
+}
+
+func (r UDPResponse) annotate(result *Result) {
+	result.Extensions = r.Extensions
+}
+
+func (r UDPResponse) quotedTOS() int {
+	return r.QuotedTOS
+}
+
+// A UDPManager sends UDP traceroute probes. Probes are identified by their
+// checksum, so the flow (address and port pairs) can stay constant. All
+// responses are ICMP errors received by the ICMPManager; Port Unreachable
+// from the target is reported as reached(257).
+type UDPManager struct {
+	ipManager
+	// local port of probes without flow. Probes of flow n use the
+	// n-th port after it.
+	port int
+}
+
+// udpManager is the shared manager returned by GetUDPManager, guarded by
+// udpL
+var udpManager *UDPManager
+var udpL sync.Mutex
+
+// return UDPManager to caller. Like GetTCPManager, a new manager is created
+// once the manager, or the ICMPManager it receives ICMP errors from, is
+// closed.
+func GetUDPManager() *UDPManager {
+	udpL.Lock()
+	defer udpL.Unlock()
+	if udpManager == nil || udpManager.stale() {
+		udpManager = newUDPManager(GetICMPManager())
+	}
+	return udpManager
+}
+
+// newUDPManager creates a UDPManager on raw UDP sockets, receiving ICMP
+// errors from icmp.
+func newUDPManager(icmp *ICMPManager) *UDPManager {
+	mgr := &UDPManager{
+		port: udpPortBase + rand.Intn(udpPortRange),
+	}
+	mgr.init()
+	mgr.icmp = icmp
+	raw := make(chan *RawResponse, 1024)
+	err := mgr.listen("udp", RawFilter{
+		Protocol:   17, // iana.ProtocolUDP
+		SrcPort:    udpPortBase,
+		SrcPortEnd: 65535,
+	}, raw)
+	if err != nil {
+		panic(fmt.Sprintf("Can't listen to UDP: %s", err))
+	}
+	// raw udp socket receives all UDP packets, but we only need it to
+	// send. drop everything in kernel.
+	drop, _ := bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 0}})
+	if mgr.pConn4 != nil {
+		_ = mgr.pConn4.SetBPF(drop)
+	}
+	if mgr.pConn6 != nil {
+		_ = mgr.pConn6.SetBPF(drop)
+	}
+	result := make(chan Response, 1024)
+	spawn(&mgr.wg, func() { mgr.udpRawReceiver(raw, result) })
+	spawn(&mgr.wg, func() {
+		mgr.dispatcher(result, func(response Response) {
+			mgr.dispatchLow(uint16(response.(*UDPResponse).Key), response)
+		})
+	})
+	return mgr
+}
+
+// translate ICMP errors quoting our probe to UDPResponse
+func (mgr *UDPManager) udpRawReceiver(raw chan *RawResponse, udpResponse chan<- Response) {
+	for {
+		var response *RawResponse
+		select {
+		case <-mgr.ctx.Done():
+			return
+		case response = <-raw:
+		}
+		// UDP header: source port(2) destination port(2) length(2) checksum(2)
+		if len(response.Fragment) < 8 {
+			continue
+		}
+		code := response.Code
+		// Port Unreachable from target means we reached it
+		if response.AddrIP.Equal(response.TargetIP) {
+			if response.TargetIP.To4() != nil && code == 3 || response.TargetIP.To4() == nil && code == 4 {
+				code = 257
+			}
+		}
+		translated := &UDPResponse{
+			Key:        int(binary.BigEndian.Uint16(response.Fragment[6:8])),
+			Port:       int(binary.BigEndian.Uint16(response.Fragment[2:4])),
+			AddrIP:     response.AddrIP,
+			Received:   response.Received,
+			Clock:      response.Clock,
+			Extensions: response.Extensions,
+			QuotedTOS:  response.QuotedTOS,
+			TargetIP:   response.TargetIP,
+			Code:       code,
+		}
+		if !mgr.forward(udpResponse, translated) {
+			return
+		}
+	}
+}
+
+// Issue a UDP probe. ip can be *net.UDPAddr to probe a fixed destination port,
+// *FlowAddr to fix both ports of the flow, or *net.IPAddr to use classic
+// traceroute ports. return a channel to send result back
+func (mgr *UDPManager) Issue(ip net.Addr, ttl int, timeout time.Duration) chan *Result {
+	return resolved(mgr.IssueContext(context.Background(), ip, &Probe{TTL: ttl, Timeout: timeout}))
+}
+
+// IssueContext is the context-aware version of Issue. see Manager.
+func (mgr *UDPManager) IssueContext(ctx context.Context, ip net.Addr, probe *Probe) (chan *Result, error) {
+	var dest net.IP
+	port := 0
+	localPort := mgr.port
+	switch addr := ip.(type) {
+	case *net.UDPAddr:
+		dest = addr.IP
+		port = addr.Port
+	case *FlowAddr:
+		dest = addr.IP
+		port = addr.Port
+		if port == 0 {
+			port = udpClassicBase
+		}
+		localPort = mgr.flowPort(addr.Flow)
+	case *net.IPAddr:
+		dest = addr.IP
+	default:
+		return nil, fmt.Errorf("unsupported address type %T", ip)
+	}
+	v4 := dest.To4() != nil
+	dest = dest.To16()
+	if !mgr.available(v4) {
+		return unavailable(), ErrFamilyUnavailable
+	}
+	ifIndex, err := probeInterface(probe)
+	if err != nil {
+		return nil, err
+	}
+	src, err := ProbeSource(dest, probe)
+	if err == ErrSourceFamily {
+		return nil, err
+	}
+	if err != nil {
+		return failed(sendErrorCode(err)), err
+	}
+
+	// the low 16 bits of Key are the checksum, skipping 0 and 0xffff as
+	// they are identical in one's complement
+	count := mgr.nextKey()
+	for uint16(count) == 0 || uint16(count) == 0xffff {
+		count = mgr.nextKey()
+	}
+
+	if port == 0 {
+		port = udpClassicBase + int(count)%udpClassicRange
+	}
+	msg := udpProbe(src, dest, localPort, port, uint16(count))
+
+	request := &UDPRequest{
+		Key:      int(count),
+		Port:     port,
+		TargetIP: dest,
+	}
+	request.init(ctx, probe)
+	if !mgr.enqueue(ctx, int(count), request, &request.probeRequest, probe.Timeout) {
+		return request.delivery, ErrClosed
+	}
+
+	err = send(mgr.queue, int(count), request, &request.probeRequest, func(time.Time) error {
+		// kernel chooses the same source as ProbeSource if not set
+		opts := &WriteOptions{
+			TTL:       probe.TTL,
+			Source:    probe.Source,
+			IfIndex:   ifIndex,
+			TOS:       probe.TOS,
+			FlowLabel: probe.FlowLabel,
+		}
+		return mgr.write(v4, msg, dest, opts)
+	})
+	return request.delivery, err
+}
+
+// flowPort returns the local port of probes of flow, the flow-th port after
+// mgr.port, wrapping around within the local port range.
+func (mgr *UDPManager) flowPort(flow int) int {
+	return udpPortBase + (mgr.port-udpPortBase+flow)%udpPortRange
+}
+
+// udpProbe builds a UDP datagram whose checksum equals to sum. The 2 bytes
+// payload is adjusted to get the checksum we want.
+func udpProbe(src, dst net.IP, srcPort, dstPort int, sum uint16) []byte {
+	b := make([]byte, 10)
+	binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)))
+	// checksum is the complement of one's complement sum. Adding x to the
+	// sum turns checksum c into c - x, so payload = c - sum.
+	c := pseudoChecksum(src, dst, 17, b) // iana.ProtocolUDP
+	binary.BigEndian.PutUint16(b[8:10], onesSub(c, sum))
+	binary.BigEndian.PutUint16(b[6:8], sum)
+	return b
+}
+
+// onesSub computes a - b in one's complement arithmetic
+func onesSub(a, b uint16) uint16 {
+	s := uint32(a) + uint32(^b)
+	s = s>>16 + s&0xffff
+	return uint16(s)
+}
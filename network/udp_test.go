@@ -0,0 +1,68 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestUDPProbeChecksum(t *testing.T) {
+	for _, c := range []struct{ src, dst net.IP }{
+		{simLocal4, simTarget4},
+		{simLocal6, simTarget6},
+	} {
+		for _, sum := range []uint16{1, 2, 0x00ff, 0x1234, 0x8000, 0xfeff, 0xfffe} {
+			for _, ports := range [][2]int{{udpPortBase, udpClassicBase}, {65535, 65535}, {61234, 443}} {
+				b := udpProbe(c.src, c.dst, ports[0], ports[1], sum)
+				if got := binary.BigEndian.Uint16(b[6:8]); got != sum {
+					t.Fatalf("%s sum %#x: checksum field %#x", c.dst, sum, got)
+				}
+				// recompute the checksum as the receiver does
+				zeroed := append([]byte(nil), b...)
+				zeroed[6], zeroed[7] = 0, 0
+				if got := pseudoChecksum(c.src, c.dst, 17, zeroed); got != sum {
+					t.Fatalf("%s sum %#x ports %v: checksum computes to %#x", c.dst, sum, ports, got)
+				}
+				if sport, dport := int(binary.BigEndian.Uint16(b[0:2])), int(binary.BigEndian.Uint16(b[2:4])); sport != ports[0] || dport != ports[1] {
+					t.Fatalf("ports %d > %d, want %v", sport, dport, ports)
+				}
+			}
+		}
+	}
+}
+
+func TestUDPFlowPort(t *testing.T) {
+	for _, c := range []struct {
+		port, flow, want int
+	}{
+		{udpPortBase, 0, udpPortBase},
+		{udpPortBase, 5, udpPortBase + 5},
+		{65535, 0, 65535},
+		{65535, 1, udpPortBase},
+		{65530, 10, udpPortBase + 4},
+		{udpPortBase, udpPortRange - 1, 65535},
+		{udpPortBase + 7, udpPortRange, udpPortBase + 7},
+		{65535, 3*udpPortRange + 2, udpPortBase + 1},
+	} {
+		mgr := &UDPManager{port: c.port}
+		if got := mgr.flowPort(c.flow); got != c.want {
+			t.Fatalf("flow %d from port %d: port %d, want %d", c.flow, c.port, got, c.want)
+		}
+	}
+}
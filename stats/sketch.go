@@ -0,0 +1,123 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stats
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// DefaultAlpha is the relative accuracy of Sketch quantiles by default, 1%
+const DefaultAlpha = 0.01
+
+// samples smaller than this are counted as zero by Sketch
+const sketchMinValue = 1e-6
+
+// ErrAlphaMismatch is returned when merging sketches of different accuracy
+var ErrAlphaMismatch = errors.New("sketches of different accuracy")
+
+// A Sketch estimates quantiles of positive samples within relative error
+// Alpha, like DDSketch. Samples are counted in bins growing exponentially, so
+// the size depends on the range of samples rather than their count, and
+// sketches merge exactly by adding bins.
+type Sketch struct {
+	Alpha float64 `json:"alpha"`
+	Count int     `json:"count"`
+	// samples too small to bin
+	Zero int `json:"zero"`
+	// Bins[i] counts samples in (gamma^(i-1), gamma^i]
+	Bins map[int]int `json:"bins"`
+}
+
+// NewSketch creates an empty Sketch with accuracy alpha, DefaultAlpha if alpha
+// is not in (0, 1).
+func NewSketch(alpha float64) *Sketch {
+	if alpha <= 0 || alpha >= 1 {
+		alpha = DefaultAlpha
+	}
+	return &Sketch{
+		Alpha: alpha,
+		Bins:  make(map[int]int),
+	}
+}
+
+func (s *Sketch) gamma() float64 {
+	return (1 + s.Alpha) / (1 - s.Alpha)
+}
+
+// Add adds sample x
+func (s *Sketch) Add(x float64) {
+	s.Count++
+	if x < sketchMinValue {
+		s.Zero++
+		return
+	}
+	if s.Bins == nil {
+		s.Bins = make(map[int]int)
+	}
+	s.Bins[int(math.Ceil(math.Log(x)/math.Log(s.gamma())))]++
+}
+
+// Merge adds samples of o, which must have the same Alpha
+func (s *Sketch) Merge(o *Sketch) error {
+	if s.Alpha != o.Alpha {
+		return ErrAlphaMismatch
+	}
+	if s.Bins == nil {
+		s.Bins = make(map[int]int)
+	}
+	s.Count += o.Count
+	s.Zero += o.Zero
+	for i, n := range o.Bins {
+		s.Bins[i] += n
+	}
+	return nil
+}
+
+// Clone returns a copy of s
+func (s *Sketch) Clone() *Sketch {
+	c := NewSketch(s.Alpha)
+	_ = c.Merge(s)
+	return c
+}
+
+// Quantile returns the estimated q-th (0-1) quantile, 0 if s is empty
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := int(math.Round(math.Max(0, math.Min(1, q)) * float64(s.Count-1)))
+	if rank < s.Zero {
+		return 0
+	}
+	keys := make([]int, 0, len(s.Bins))
+	for i := range s.Bins {
+		keys = append(keys, i)
+	}
+	sort.Ints(keys)
+	seen := s.Zero
+	gamma := s.gamma()
+	for _, i := range keys {
+		seen += s.Bins[i]
+		if seen > rank {
+			// the value with least relative error to both ends of the bin
+			return 2 * math.Pow(gamma, float64(i)) / (gamma + 1)
+		}
+	}
+	return 2 * math.Pow(gamma, float64(keys[len(keys)-1])) / (gamma + 1)
+}
@@ -0,0 +1,167 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package stats accumulates probe statistics in a form that can be merged, so
+// rounds of probing, or reports of several Planets, roll up without losing
+// accuracy.
+package stats
+
+import (
+	"math"
+)
+
+// A Welford accumulates count, mean, variance, min and max of samples with
+// Welford's online algorithm, which is stable where sum of squares is not.
+type Welford struct {
+	N    int     `json:"n"`
+	Mean float64 `json:"mean"`
+	// sum of squared differences from Mean
+	M2  float64 `json:"m2"`
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// Add adds sample x
+func (w *Welford) Add(x float64) {
+	w.N++
+	if w.N == 1 {
+		w.Min, w.Max = x, x
+	} else {
+		w.Min, w.Max = math.Min(w.Min, x), math.Max(w.Max, x)
+	}
+	d := x - w.Mean
+	w.Mean += d / float64(w.N)
+	w.M2 += d * (x - w.Mean)
+}
+
+// Merge adds samples accumulated by o, as Chan et al. combine partial results.
+func (w *Welford) Merge(o *Welford) {
+	if o.N == 0 {
+		return
+	}
+	if w.N == 0 {
+		*w = *o
+		return
+	}
+	n := float64(w.N + o.N)
+	d := o.Mean - w.Mean
+	w.M2 += o.M2 + d*d*float64(w.N)*float64(o.N)/n
+	w.Mean += d * float64(o.N) / n
+	w.Min, w.Max = math.Min(w.Min, o.Min), math.Max(w.Max, o.Max)
+	w.N += o.N
+}
+
+// Variance returns the sample variance, 0 with less than 2 samples
+func (w *Welford) Variance() float64 {
+	if w.N < 2 {
+		return 0
+	}
+	return w.M2 / float64(w.N-1)
+}
+
+// StdDev returns the sample standard deviation
+func (w *Welford) StdDev() float64 {
+	return math.Sqrt(w.Variance())
+}
+
+// Loss counts probes sent and lost
+type Loss struct {
+	Total int `json:"total"`
+	Drop  int `json:"drop"`
+}
+
+// Add counts a probe, lost or not
+func (l *Loss) Add(lost bool) {
+	l.Total++
+	if lost {
+		l.Drop++
+	}
+}
+
+// Merge adds probes counted by o
+func (l *Loss) Merge(o *Loss) {
+	l.Total += o.Total
+	l.Drop += o.Drop
+}
+
+// Rate returns the fraction of probes lost, 0 if none is sent
+func (l *Loss) Rate() float64 {
+	if l.Total == 0 {
+		return 0
+	}
+	return float64(l.Drop) / float64(l.Total)
+}
+
+// An Accumulator summarizes probes toward a target: how many are lost, and
+// RTT of replies, whose quantiles are estimated if Sketch is not nil.
+type Accumulator struct {
+	Loss   Loss    `json:"loss"`
+	RTT    Welford `json:"rtt"`
+	Sketch *Sketch `json:"sketch,omitempty"`
+}
+
+// NewAccumulator creates an Accumulator, with a Sketch of DefaultAlpha if
+// quantiles is set.
+func NewAccumulator(quantiles bool) *Accumulator {
+	a := &Accumulator{}
+	if quantiles {
+		a.Sketch = NewSketch(DefaultAlpha)
+	}
+	return a
+}
+
+// Add counts a probe replied after rtt
+func (a *Accumulator) Add(rtt float64) {
+	a.Loss.Add(false)
+	a.RTT.Add(rtt)
+	if a.Sketch != nil {
+		a.Sketch.Add(rtt)
+	}
+}
+
+// Drop counts a lost probe
+func (a *Accumulator) Drop() {
+	a.Loss.Add(true)
+}
+
+// Clone returns a copy of a, which shares no Sketch with it
+func (a *Accumulator) Clone() *Accumulator {
+	c := *a
+	if a.Sketch != nil {
+		c.Sketch = a.Sketch.Clone()
+	}
+	return &c
+}
+
+// Merge adds probes accumulated by o. Sketch is dropped if o has samples
+// without one. Sketches of different accuracy don't merge: ErrAlphaMismatch is
+// returned and a is left unchanged.
+func (a *Accumulator) Merge(o *Accumulator) error {
+	switch {
+	case a.Sketch != nil && o.Sketch != nil:
+		if err := a.Sketch.Merge(o.Sketch); err != nil {
+			return err
+		}
+	case a.Sketch != nil && o.RTT.N != 0:
+		// o has samples the sketch misses
+		a.Sketch = nil
+	case a.Sketch == nil && a.RTT.N == 0 && o.Sketch != nil:
+		a.Sketch = o.Sketch.Clone()
+	}
+	a.Loss.Merge(&o.Loss)
+	a.RTT.Merge(&o.RTT)
+	return nil
+}
@@ -0,0 +1,264 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stats
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// samples returns n RTT-like samples of seed, log-normal around 20ms
+func samples(seed int64, n int) []float64 {
+	r := rand.New(rand.NewSource(seed))
+	xs := make([]float64, n)
+	for i := range xs {
+		xs[i] = math.Exp(3 + r.NormFloat64())
+	}
+	return xs
+}
+
+// within reports whether a and b are equal within relative error e
+func within(a, b, e float64) bool {
+	return math.Abs(a-b) <= e*math.Max(math.Abs(a), math.Abs(b))
+}
+
+func TestWelford(t *testing.T) {
+	var w Welford
+	for _, x := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		w.Add(x)
+	}
+	if w.N != 8 || w.Mean != 5 || w.Min != 2 || w.Max != 9 || !within(w.Variance(), 32.0/7, 1e-12) {
+		t.Fatalf("%+v with variance %v", w, w.Variance())
+	}
+	var one Welford
+	one.Add(3)
+	if one.Variance() != 0 || one.StdDev() != 0 || one.Min != 3 || one.Max != 3 {
+		t.Fatalf("%+v of one sample", one)
+	}
+}
+
+func TestWelfordMerge(t *testing.T) {
+	xs := samples(1, 1000)
+	var single Welford
+	for _, x := range xs {
+		single.Add(x)
+	}
+	// uneven parts, some empty
+	var merged Welford
+	for _, part := range [][]float64{xs[:0], xs[:1], xs[1:300], xs[300:300], xs[300:]} {
+		var w Welford
+		for _, x := range part {
+			w.Add(x)
+		}
+		merged.Merge(&w)
+	}
+	if merged.N != single.N || merged.Min != single.Min || merged.Max != single.Max ||
+		!within(merged.Mean, single.Mean, 1e-12) || !within(merged.M2, single.M2, 1e-9) {
+		t.Fatalf("merged %+v, single pass %+v", merged, single)
+	}
+}
+
+func TestLoss(t *testing.T) {
+	var a, b Loss
+	if a.Rate() != 0 {
+		t.Fatal("loss rate without probes")
+	}
+	a.Add(true)
+	a.Add(false)
+	b.Add(false)
+	b.Add(true)
+	b.Add(true)
+	a.Merge(&b)
+	if a.Total != 5 || a.Drop != 3 || a.Rate() != 0.6 {
+		t.Fatalf("%+v with rate %v", a, a.Rate())
+	}
+}
+
+func TestSketchEmpty(t *testing.T) {
+	s := NewSketch(0)
+	if s.Alpha != DefaultAlpha || s.Quantile(0.5) != 0 {
+		t.Fatalf("empty sketch %+v, median %v", s, s.Quantile(0.5))
+	}
+	// a decoded sketch may have no bins
+	s = &Sketch{Alpha: DefaultAlpha}
+	s.Add(10)
+	if s.Count != 1 || len(s.Bins) != 1 {
+		t.Fatalf("%+v after a sample", s)
+	}
+}
+
+func TestSketchOne(t *testing.T) {
+	for _, x := range []float64{0.05, 1, 20, 1500} {
+		s := NewSketch(DefaultAlpha)
+		s.Add(x)
+		// every quantile is the sample
+		for _, q := range []float64{-1, 0, 0.5, 0.99, 1, 2} {
+			if got := s.Quantile(q); !within(got, x, DefaultAlpha) {
+				t.Fatalf("quantile %v of %v: %v", q, x, got)
+			}
+		}
+	}
+	// too small to bin
+	s := NewSketch(DefaultAlpha)
+	s.Add(0)
+	if s.Zero != 1 || len(s.Bins) != 0 || s.Quantile(1) != 0 {
+		t.Fatalf("%+v of sample 0", s)
+	}
+}
+
+func TestSketchQuantile(t *testing.T) {
+	for _, alpha := range []float64{DefaultAlpha, 0.05} {
+		xs := samples(2, 2000)
+		s := NewSketch(alpha)
+		for _, x := range xs {
+			s.Add(x)
+		}
+		// a few zero samples at the bottom
+		xs = append(xs, 0, 0, 0)
+		s.Add(0)
+		s.Add(0)
+		s.Add(0)
+		sort.Float64s(xs)
+		for _, q := range []float64{0, 0.001, 0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.95, 0.99, 1} {
+			exact := xs[int(math.Round(q*float64(len(xs)-1)))]
+			if got := s.Quantile(q); !within(got, exact, alpha) {
+				t.Fatalf("alpha %v: quantile %v %v, exact %v", alpha, q, got, exact)
+			}
+		}
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	xs := samples(3, 1000)
+	single := NewSketch(DefaultAlpha)
+	for _, x := range xs {
+		single.Add(x)
+	}
+	merged := NewSketch(DefaultAlpha)
+	for _, part := range [][]float64{xs[:0], xs[:400], xs[400:400], xs[400:]} {
+		s := NewSketch(DefaultAlpha)
+		for _, x := range part {
+			s.Add(x)
+		}
+		if err := merged.Merge(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// merging is exact
+	if !reflect.DeepEqual(merged, single) {
+		t.Fatalf("merged %+v, single pass %+v", merged, single)
+	}
+	// bins of zero count change no quantile
+	if err := merged.Merge(&Sketch{Alpha: DefaultAlpha, Bins: map[int]int{-1000: 0, 1000: 0}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []float64{0, 0.5, 1} {
+		if merged.Quantile(q) != single.Quantile(q) {
+			t.Fatalf("quantile %v %v after empty bins, want %v", q, merged.Quantile(q), single.Quantile(q))
+		}
+	}
+	if err := merged.Merge(NewSketch(0.05)); err != ErrAlphaMismatch || merged.Count != single.Count {
+		t.Fatalf("merging another alpha: %v, count %d", err, merged.Count)
+	}
+}
+
+func TestSketchClone(t *testing.T) {
+	s := NewSketch(DefaultAlpha)
+	s.Add(10)
+	c := s.Clone()
+	c.Add(10)
+	c.Add(1000)
+	if s.Count != 1 || len(s.Bins) != 1 {
+		t.Fatalf("%+v changed with its clone", s)
+	}
+}
+
+func TestAccumulatorMerge(t *testing.T) {
+	xs := samples(4, 500)
+	single := NewAccumulator(true)
+	parts := []*Accumulator{NewAccumulator(true), NewAccumulator(true), NewAccumulator(true)}
+	for i, x := range xs {
+		// every 7th probe is lost
+		part := parts[i%len(parts)]
+		if i%7 == 0 {
+			single.Drop()
+			part.Drop()
+			continue
+		}
+		single.Add(x)
+		part.Add(x)
+	}
+	merged := NewAccumulator(true)
+	for _, part := range parts {
+		if err := merged.Merge(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if merged.Loss != single.Loss || merged.RTT.N != single.RTT.N || !within(merged.RTT.Mean, single.RTT.Mean, 1e-12) ||
+		!within(merged.RTT.M2, single.RTT.M2, 1e-9) || !reflect.DeepEqual(merged.Sketch, single.Sketch) {
+		t.Fatalf("merged %+v, single pass %+v", merged, single)
+	}
+	if err := merged.Merge(&Accumulator{Sketch: NewSketch(0.05)}); err != ErrAlphaMismatch || merged.Loss != single.Loss {
+		t.Fatalf("merging another alpha: %v, loss %+v", err, merged.Loss)
+	}
+}
+
+func TestAccumulatorMergeSketch(t *testing.T) {
+	withSketch := NewAccumulator(true)
+	withSketch.Add(10)
+	without := NewAccumulator(false)
+	without.Add(20)
+
+	// samples the sketch misses drop it
+	a := withSketch.Clone()
+	if err := a.Merge(without); err != nil || a.Sketch != nil || a.RTT.N != 2 {
+		t.Fatalf("%+v, %v", a, err)
+	}
+	// only losses keep it
+	lost := NewAccumulator(false)
+	lost.Drop()
+	a = withSketch.Clone()
+	if err := a.Merge(lost); err != nil || a.Sketch == nil || a.Loss.Total != 2 {
+		t.Fatalf("%+v, %v", a, err)
+	}
+	// an empty accumulator takes a copy of the sketch
+	a = NewAccumulator(false)
+	if err := a.Merge(withSketch); err != nil || a.Sketch == nil || a.Sketch == withSketch.Sketch || a.Sketch.Count != 1 {
+		t.Fatalf("%+v, %v", a, err)
+	}
+}
+
+func TestAccumulatorClone(t *testing.T) {
+	a := NewAccumulator(true)
+	a.Add(10)
+	a.Drop()
+	c := a.Clone()
+	if !reflect.DeepEqual(c, a) {
+		t.Fatalf("clone %+v of %+v", c, a)
+	}
+	c.Add(20)
+	c.Drop()
+	if a.Loss.Total != 2 || a.RTT.N != 1 || a.Sketch.Count != 1 {
+		t.Fatalf("%+v changed with its clone", a)
+	}
+	if c := NewAccumulator(false).Clone(); c.Sketch != nil {
+		t.Fatal("clone grew a sketch")
+	}
+}
@@ -18,12 +18,10 @@ package tools
 
 import (
     "fmt"
-    lru "github.com/hashicorp/golang-lru"
-    "math"
     "net"
     "starping/network"
+    "starping/stats"
     "strings"
-    "sync"
     "time"
 )
 
@@ -36,8 +34,17 @@ var IcmpUnreachableMark = map[int]string{
     13:  "!X",
     14:  "!V",
     15:  "!C",
+    // Packet Too Big of ICMPv6, the same as Fragmentation Needed
+    network.CodePacketTooBig: "!F",
 }
 
+// MTR probe protocols
+const (
+    ProtocolICMP = "icmp"
+    ProtocolUDP  = "udp"
+    ProtocolTCP  = "tcp"
+)
+
 // MTRConfig represent a mtr work config
 type MTRConfig struct {
     Frequency time.Duration `json:"frequency"`
@@ -45,12 +52,48 @@ type MTRConfig struct {
     Interval  time.Duration `json:"interval"`
     MaxTTL    int `json:"max_ttl"`
     Count     int `json:"count"`
+    // Protocol of probes, one of ProtocolICMP(default), ProtocolUDP and
+    // ProtocolTCP
+    Protocol  string `json:"protocol"`
+    // Port is the destination port of UDP or TCP probes. For UDP, 0 means
+    // classic traceroute ports; otherwise the port is fixed and probes are
+    // told apart by checksum. For TCP, 0 means network.DefaultTCPPort.
+    Port      int `json:"port"`
+    // Multipath enables Paris traceroute style probing, where all probes
+    // keep the same flow, followed by MDA multipath discovery. Only UDP and
+    // TCP protocol support it.
+    Multipath  bool `json:"multipath"`
+    // Confidence level of multipath discovery to find all next hops,
+    // default 0.95
+    Confidence float64 `json:"confidence"`
+    // MaxFlows limits flows multipath discovery may use, default 256
+    MaxFlows   int `json:"max_flows"`
+    // PayloadSize and Pattern of echo payload, same as PingConfig. Only
+    // ICMP protocol supports them.
+    PayloadSize int `json:"payload_size"`
+    Pattern     string `json:"pattern"`
+    // Source, Interface, TOS and FlowLabel of probes, same as PingConfig
+    Source    string `json:"source"`
+    Interface string `json:"interface"`
+    TOS       int `json:"tos"`
+    FlowLabel int `json:"flow_label"`
+    // Summary keeps the accumulated probes of each hop in
+    // MTRHopStat.Summary, same as PingConfig
+    Summary bool `json:"summary"`
 }
 
 type HopInfo struct {
     IP string `json:"ip"`
     RDNS string `json:"rdns"`
     Code int `json:"code"`
+    // MPLS label stack and interface information the hop reported in ICMP
+    // extensions, of the latest response
+    MPLS []network.MPLSLabel `json:"mpls,omitempty"`
+    Interfaces []network.InterfaceInfo `json:"interfaces,omitempty"`
+    // Remarked is set if the hop saw probes with DSCP changed in transit,
+    // to TOS
+    Remarked bool `json:"remarked,omitempty"`
+    TOS int `json:"tos,omitempty"`
 }
 
 func (i *HopInfo) String() (s string) {
@@ -58,13 +101,16 @@ func (i *HopInfo) String() (s string) {
     if i.RDNS != "" {
         s += fmt.Sprintf("(%s)", i.RDNS)
     }
-    if i.Code < 256 {
+    if i.Code < 256 || i.Code == network.CodePacketTooBig {
         if mark, ok := IcmpUnreachableMark[i.Code]; ok {
             s += fmt.Sprintf(" %s", mark)
         } else {
             s += fmt.Sprintf(" !<%d>", i.Code)
         }
     }
+    if i.Remarked {
+        s += fmt.Sprintf(" [TOS 0x%02x]", i.TOS)
+    }
     return
 }
 
@@ -79,16 +125,61 @@ type MTRHopStat struct {
     StdDev float64 `json:"std_dev"`
     Drop int `json:"drop"`
     Total int `json:"total"`
+    // Summary accumulates the probes, to merge with other MTRHopStat. Only
+    // kept if MTRConfig.Summary is set.
+    Summary *stats.Accumulator `json:"summary,omitempty"`
+}
+
+// summarize fills Avg, Min, Max, StdDev, Drop, Total and Timeout of stat from
+// Summary
+func (stat *MTRHopStat) summarize() {
+    s := stat.Summary
+    stat.Total, stat.Drop = s.Loss.Total, s.Loss.Drop
+    stat.Timeout = s.Loss.Total == s.Loss.Drop
+    stat.Avg, stat.Min, stat.Max = s.RTT.Mean, s.RTT.Min, s.RTT.Max
+    stat.StdDev = stdDev(&s.RTT, s.Loss.Total)
+}
+
+// Merge adds probes of o, e.g. the same hop in another round, to stat. Both
+// must carry Summary. Responders of o are added to IP.
+func (stat *MTRHopStat) Merge(o *MTRHopStat) error {
+    if stat.Summary == nil || o.Summary == nil {
+        return ErrNoSummary
+    }
+    if err := stat.Summary.Merge(o.Summary); err != nil {
+        return err
+    }
+    seen := make(map[string]bool)
+    for _, ip := range stat.IP {
+        seen[ip.String()] = true
+    }
+    for _, ip := range o.IP {
+        if !seen[ip.String()] {
+            seen[ip.String()] = true
+            stat.IP = append(stat.IP, ip)
+        }
+    }
+    stat.summarize()
+    return nil
 }
 
 type MTRStat struct {
     IP string `json:"ip"`
+    // address and interface probes left from
+    Source string `json:"source,omitempty"`
+    Interface string `json:"interface,omitempty"`
+    // TOS and flow label of probes
+    TOS int `json:"tos,omitempty"`
+    FlowLabel int `json:"flow_label,omitempty"`
+    Protocol string `json:"protocol"`
     HopCount int `json:"hop_count"`
     Stat *[]MTRHopStat `json:"stat"`
+    Multipath *MultipathStat `json:"multipath,omitempty"`
 }
 
 func (stat *MTRStat) String() (s string) {
-    s += fmt.Sprintf("MTR Statistic for target %s:\n", stat.IP)
+    s += fmt.Sprintf("MTR Statistic for target %s%s (%s):\n", stat.IP,
+        sourceString(stat.Source, stat.Interface), stat.Protocol)
     addrWidth := 6
     for _, hop := range *stat.Stat {
         for _, ip := range hop.IP {
@@ -110,92 +201,157 @@ func (stat *MTRStat) String() (s string) {
         s += fmt.Sprintf("%7.2f %7.2f %7.2f %7.2f %2d/%2d %4.1f%%\n",
             hop.Avg, hop.Min, hop.Max, hop.StdDev, hop.Drop, hop.Total,
             float64(hop.Drop * 100) / float64(hop.Total))
+        s += mplsString(hop.IP[0].MPLS)
         if len(hop.IP) > 1 {
             for _, ip := range hop.IP[1:] {
                 s += fmt.Sprintf("    %s\n", ip.String())
+                s += mplsString(ip.MPLS)
             }
         }
     }
+    if stat.Multipath != nil {
+        s += stat.Multipath.String()
+    }
     return
 }
 
-type mtrHopStat struct {
-    IP map[HopInfo]struct{}
-    Avg float64
-    Min float64
-    Max float64
-    StdDev float64
-    Drop int
-    Total int
+// mplsString formats MPLS labels like mtr -e, one label per line
+func mplsString(labels []network.MPLSLabel) (s string) {
+    for _, l := range labels {
+        bottom := 0
+        if l.S {
+            bottom = 1
+        }
+        s += fmt.Sprintf("    [MPLS: Lbl %d TC %d S %d TTL %d]\n", l.Label, l.TC, bottom, l.TTL)
+    }
+    return
 }
 
-var cache *lru.TwoQueueCache
-var once sync.Once
+type mtrHopStat struct {
+    // IP maps HopInfo.String() to the HopInfo
+    IP map[string]HopInfo
+    *stats.Accumulator
+}
 
-func getRDNSCache() *lru.TwoQueueCache {
-    once.Do(func() {
-        cache, _ = lru.New2Q(8192)
-    })
-    return cache
+// rDNSLookup returns the first name of ip, or empty if not found
+func rDNSLookup(r Resolver, ip string) string {
+    rdns, err := r.LookupAddr(ip)
+    if err != nil || len(rdns) == 0 {
+        return ""
+    }
+    return strings.TrimSuffix(rdns[0], ".")
 }
 
-func rDNSLookup(ip string) string {
-    c := getRDNSCache()
-    if entry, ok := c.Get(ip); ok {
-        return entry.(string)
-    } else {
-        rdns, err := net.LookupAddr(ip)
-        if err != nil {
-            return ""
+// mtrTarget returns the probe address and the protocol of config.
+func mtrTarget(addr *net.IPAddr, config *MTRConfig) (net.Addr, string, error) {
+    if config.Multipath {
+        switch config.Protocol {
+        case ProtocolUDP:
+            return &network.FlowAddr{IP: addr.IP, Port: config.Port}, ProtocolUDP, nil
+        case ProtocolTCP:
+            return &network.FlowAddr{IP: addr.IP, Port: config.Port}, ProtocolTCP, nil
+        default:
+            return nil, "", fmt.Errorf("multipath MTR doesn't support protocol: %s", config.Protocol)
         }
-        record := ""
-        if len(rdns) != 0 {
-            record = rdns[0][:len(rdns[0])-1]
+    }
+    switch config.Protocol {
+    case "", ProtocolICMP:
+        return addr, ProtocolICMP, nil
+    case ProtocolUDP:
+        if config.Port == 0 {
+            return addr, ProtocolUDP, nil
         }
-        c.Add(ip, record)
-        return record
+        return &net.UDPAddr{IP: addr.IP, Port: config.Port}, ProtocolUDP, nil
+    case ProtocolTCP:
+        return &net.TCPAddr{IP: addr.IP, Port: config.Port}, ProtocolTCP, nil
+    default:
+        return nil, "", fmt.Errorf("unknown MTR protocol: %s", config.Protocol)
     }
 }
 
+// MTR traces the path toward ip with the shared manager of config.Protocol.
 func MTR(ip string, config *MTRConfig) (*MTRStat, error) {
-    addr, err := net.ResolveIPAddr("", ip)
+    return defaultProber.MTR(ip, config)
+}
+
+// MTR traces the path toward ip, then discovers load balanced paths if
+// config.Multipath is set.
+func (p *Prober) MTR(ip string, config *MTRConfig) (*MTRStat, error) {
+    return p.MTRStream(ip, config, nil)
+}
+
+// MTRStream traces the path toward ip with the shared manager of
+// config.Protocol.
+func MTRStream(ip string, config *MTRConfig, handle func(*MTREvent)) (*MTRStat, error) {
+    return defaultProber.MTRStream(ip, config, handle)
+}
+
+// MTRStream is MTR handing the outcome of each probe and the updated statistics
+// of its hop to handle, if not nil, round by round. handle is called from the
+// calling goroutine. Multipath discovery isn't streamed.
+func (p *Prober) MTRStream(ip string, config *MTRConfig, handle func(*MTREvent)) (*MTRStat, error) {
+    addr, err := p.resolver().ResolveIPAddr(ip)
+    if err != nil {
+        return nil, err
+    }
+    target, protocol, err := mtrTarget(addr, config)
     if err != nil {
         return nil, err
     }
+    m := p.manager(protocol)
+    if err = network.CheckFamily(m, addr.IP); err != nil {
+        return nil, err
+    }
+    payload, err := newPayloadSpec(addr.IP, config.PayloadSize, config.Pattern)
+    if err != nil {
+        return nil, err
+    }
+    var source string
+    if payload.source, source, err = parseSource(addr.IP, config.Source, config.Interface); err != nil {
+        return nil, err
+    }
+    payload.iface = config.Interface
+    payload.tos, payload.flowLabel = config.TOS, config.FlowLabel
     _stat := make([]mtrHopStat, config.MaxTTL)
     minHop := config.MaxTTL
     maxHop := 0
     for i := 0; i < config.MaxTTL; i++ {
-        _stat[i].Min = math.MaxFloat64
-        _stat[i].IP = make(map[HopInfo]struct{})
+        _stat[i].IP = make(map[string]HopInfo)
+        _stat[i].Accumulator = stats.NewAccumulator(true)
     }
-    m := network.GetICMPManager()
     for i := 0; i < config.Count; i++ {
         for j := 0; j < config.MaxTTL; j++ {
-            _stat[j].Total++
-            result := <- m.Issue(addr, j + 1, config.Timeout)
-            time.Sleep(config.Interval)
-            if result.Code == 256 {
-                _stat[j].Drop++
+            result, err := issue(m, target, payload.probe(j + 1, config.Timeout))
+            if err != nil {
+                return nil, err
+            }
+            if !result.Replied() {
+                _stat[j].Drop()
             } else {
-                _stat[j].IP[HopInfo{
+                hop := HopInfo{
                     IP:   result.AddrIP.String(),
                     Code: result.Code,
-                }] = struct{}{}
-                timeFloat := float64(result.Latency) / float64(time.Millisecond)
-                _stat[j].Avg += timeFloat
-                _stat[j].Min = math.Min(_stat[j].Min, timeFloat)
-                _stat[j].Max = math.Max(_stat[j].Max, timeFloat)
-                _stat[j].StdDev += timeFloat * timeFloat
-                if result.Code != 258 {
-                    if minHop > j {
-                        minHop = j
-                    }
-                    if maxHop < j + 1 {
-                        maxHop = j + 1
-                    }
-                    break
                 }
+                if result.Extensions != nil {
+                    hop.MPLS = result.Extensions.MPLS
+                    hop.Interfaces = result.Extensions.Interfaces
+                }
+                hop.Remarked, hop.TOS = result.Remarked, result.QuotedTOS
+                _stat[j].IP[hop.String()] = hop
+                _stat[j].Add(float64(result.Latency) / float64(time.Millisecond))
+            }
+            if handle != nil {
+                handle(newMTREvent(i + 1, j + 1, result, &_stat[j]))
+            }
+            p.sleep(config.Interval)
+            if result.Replied() && result.Code != 258 {
+                if minHop > j {
+                    minHop = j
+                }
+                if maxHop < j + 1 {
+                    maxHop = j + 1
+                }
+                break
             }
         }
     }
@@ -205,16 +361,16 @@ func MTR(ip string, config *MTRConfig) (*MTRStat, error) {
     CHECK:
     for i := maxHop - 1; i > minHop; i-- {
         // if this hop is totally time out
-        if _stat[i].Drop == _stat[i].Total {
+        if _stat[i].Loss.Drop == _stat[i].Loss.Total {
             continue
         }
         // or if each ip in this hop is identical to the previous one
         if len(_stat[i].IP) == len(_stat[i - 1].IP) {
             for k := range _stat[i].IP {
-                h[k.String()] = struct{}{}
+                h[k] = struct{}{}
             }
             for k := range _stat[i - 1].IP {
-                if _, ok := h[k.String()]; !ok {
+                if _, ok := h[k]; !ok {
                     break CHECK
                 }
             }
@@ -226,36 +382,37 @@ func MTR(ip string, config *MTRConfig) (*MTRStat, error) {
     _stat = _stat[:maxHop]
     stat := make([]MTRHopStat, 0)
     for i := 0; i < maxHop; i++ {
-        if _stat[i].Total == 0 {
+        if _stat[i].Loss.Total == 0 {
             break
         }
         stat = append(stat, MTRHopStat{
             Index:   i + 1,
-            Max:     _stat[i].Max,
-            Drop:    _stat[i].Drop,
-            Total:   _stat[i].Total,
+            Summary: _stat[i].Accumulator,
         })
-        if _stat[i].Total == _stat[i].Drop {
-            stat[i].Timeout = true
+        stat[i].summarize()
+        if !config.Summary {
+            stat[i].Summary = nil
+        }
+        if stat[i].Timeout {
             continue
         }
         stat[i].IP = make([]HopInfo, 0, len(_stat[i].IP))
-        for ip := range _stat[i].IP {
-            ip.RDNS = rDNSLookup(ip.IP)
+        for _, ip := range _stat[i].IP {
+            ip.RDNS = rDNSLookup(p.resolver(), ip.IP)
             stat[i].IP = append(stat[i].IP, ip)
         }
-        stat[i].Min = _stat[i].Min
-        succeed := float64(_stat[i].Total - _stat[i].Drop)
-        total := float64(_stat[i].Total)
-        stat[i].Avg = _stat[i].Avg / succeed
-        stat[i].StdDev = math.Sqrt((_stat[i].StdDev / succeed - stat[i].Avg * stat[i].Avg) * succeed * (
-            total - 1) / total / (succeed - 1))
-        if math.IsNaN(stat[i].StdDev) || math.IsInf(stat[i].StdDev, 1) {
-            stat[i].StdDev = 0
-        }
     }
-    return &MTRStat{
-        IP:   ip,
-        Stat: &stat,
-    }, nil
+    result := &MTRStat{
+        IP:        ip,
+        Source:    source,
+        Interface: config.Interface,
+        TOS:       config.TOS,
+        FlowLabel: config.FlowLabel,
+        Protocol:  protocol,
+        Stat:      &stat,
+    }
+    if config.Multipath {
+        result.Multipath = p.Multipath(addr.IP, config)
+    }
+    return result, nil
 }
\ No newline at end of file
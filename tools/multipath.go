@@ -0,0 +1,347 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tools
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "net"
+    "sort"
+    "starping/network"
+    "strings"
+    "time"
+)
+
+const (
+    // default confidence level of multipath discovery
+    defaultConfidence = 0.95
+    // default max number of flows multipath discovery may use
+    defaultMaxFlows = 256
+    // stop discovery after this many hops without any response
+    mdaMaxSilentHops = 3
+)
+
+// MultipathNode represent an interface found by multipath discovery
+type MultipathNode struct {
+    TTL  int `json:"ttl"`
+    IP   string `json:"ip"`
+    RDNS string `json:"rdns"`
+}
+
+// MultipathEdge represent a link between interfaces of adjacent hops, with the
+// flows observed passing through it
+type MultipathEdge struct {
+    From  int `json:"from"`
+    To    int `json:"to"`
+    Flows []int `json:"flows"`
+}
+
+// MultipathFlow represent the path a flow takes. Path[i] is the responder at
+// TTL i+1, "" if not probed and "*" if timed out.
+type MultipathFlow struct {
+    Flow int `json:"flow"`
+    Path []string `json:"path"`
+}
+
+// MultipathStat represent the DAG of paths found by multipath discovery.
+// Edges refer to Nodes by index.
+type MultipathStat struct {
+    Confidence float64 `json:"confidence"`
+    Probes     int `json:"probes"`
+    Nodes      []MultipathNode `json:"nodes"`
+    Edges      []MultipathEdge `json:"edges"`
+    Flows      []MultipathFlow `json:"flows"`
+}
+
+func (stat *MultipathStat) String() (s string) {
+    s += fmt.Sprintf("Multipath (confidence %.0f%%, %d probes):\n", stat.Confidence*100, stat.Probes)
+    next := make(map[int][]string)
+    for _, e := range stat.Edges {
+        next[e.From] = append(next[e.From], fmt.Sprintf("%s(%d)", stat.Nodes[e.To].IP, len(e.Flows)))
+    }
+    for i, n := range stat.Nodes {
+        s += fmt.Sprintf("%2d: %s", n.TTL, n.IP)
+        if n.RDNS != "" {
+            s += fmt.Sprintf("(%s)", n.RDNS)
+        }
+        if len(next[i]) != 0 {
+            s += " -> " + strings.Join(next[i], ", ")
+        }
+        s += "\n"
+    }
+    return
+}
+
+// mdaProbes returns how many probes are needed to rule out the existence of
+// k+1 successors when k are found, with failure probability alpha.
+// (Veitch et al., Failure Control in Multipath Route Tracing)
+func mdaProbes(k int, alpha float64) int {
+    if k < 1 {
+        k = 1
+    }
+    return int(math.Ceil(math.Log(alpha/float64(k+1)) / math.Log(float64(k)/float64(k+1))))
+}
+
+type mdaState struct {
+    m        network.Manager
+    // sleep paces probes config.Interval apart
+    sleep    func(time.Duration)
+    resolver Resolver
+    ip       net.IP
+    config   *MTRConfig
+    alpha    float64
+    maxFlows int
+    flows    int
+    probes   int
+    // hops[ttl-1][flow] is the responder of flow at ttl, "*" if timed out
+    hops     []map[int]string
+    // whether a responder is the end of path
+    final    map[string]bool
+}
+
+// probe sends one probe for each flow at ttl and records the responders.
+// Probes are sent config.Interval apart, so routers don't rate limit their
+// ICMP errors.
+func (st *mdaState) probe(flows []int, ttl int) {
+    channels := make([]chan *network.Result, len(flows))
+    for i, flow := range flows {
+        if st.probes + i != 0 {
+            st.sleep(st.config.Interval)
+        }
+        channels[i], _ = st.m.IssueContext(context.Background(),
+            &network.FlowAddr{IP: st.ip, Port: st.config.Port, Flow: flow},
+            &network.Probe{
+                TTL:       ttl,
+                Timeout:   st.config.Timeout,
+                Source:    net.ParseIP(st.config.Source),
+                Interface: st.config.Interface,
+                TOS:       st.config.TOS,
+                FlowLabel: st.config.FlowLabel,
+            })
+    }
+    st.probes += len(flows)
+    for i, c := range channels {
+        var result *network.Result
+        if c != nil {
+            result = <-c
+        }
+        if result == nil || !result.Replied() {
+            st.hops[ttl-1][flows[i]] = "*"
+            continue
+        }
+        responder := result.AddrIP.String()
+        st.hops[ttl-1][flows[i]] = responder
+        if result.Code != 258 {
+            st.final[responder] = true
+        }
+    }
+}
+
+// flowsThrough returns flows known to reach node at ttl and not probed at ttl+1
+func (st *mdaState) flowsThrough(node string, ttl int) (flows []int) {
+    for flow, responder := range st.hops[ttl-1] {
+        if _, probed := st.hops[ttl][flow]; responder == node && !probed {
+            flows = append(flows, flow)
+        }
+    }
+    sort.Ints(flows)
+    return
+}
+
+// newFlows allocates at most n unused flow identifiers
+func (st *mdaState) newFlows(n int) (flows []int) {
+    for ; n > 0 && st.flows < st.maxFlows; n-- {
+        flows = append(flows, st.flows)
+        st.flows++
+    }
+    return
+}
+
+// discover enumerates successors of node (responder at ttl-1, "" for the
+// source host) until confident all are found.
+func (st *mdaState) discover(node string, ttl int) {
+    successors := make(map[string]struct{})
+    probed := 0
+    for {
+        need := mdaProbes(len(successors), st.alpha) - probed
+        if need <= 0 {
+            return
+        }
+        var flows []int
+        if ttl == 1 {
+            flows = st.newFlows(need)
+        } else {
+            flows = st.flowsThrough(node, ttl-1)
+            // find more flows through node by probing the previous hop
+            for len(flows) < need {
+                fresh := st.newFlows(need - len(flows))
+                if len(fresh) == 0 {
+                    break
+                }
+                st.probe(fresh, ttl-1)
+                flows = st.flowsThrough(node, ttl-1)
+            }
+            if len(flows) > need {
+                flows = flows[:need]
+            }
+        }
+        if len(flows) == 0 {
+            return
+        }
+        st.probe(flows, ttl)
+        probed += len(flows)
+        for _, flow := range flows {
+            if responder := st.hops[ttl-1][flow]; responder != "*" {
+                successors[responder] = struct{}{}
+            }
+        }
+    }
+}
+
+// Multipath discovers load balanced paths toward ip with the shared manager of
+// config.Protocol.
+func Multipath(ip net.IP, config *MTRConfig) *MultipathStat {
+    return defaultProber.Multipath(ip, config)
+}
+
+// Multipath discovers load balanced paths toward ip with the MDA algorithm.
+// Probes with the same flow identifier follow the same path, and flows are
+// varied to enumerate branches of each hop. The manager must support
+// network.FlowAddr.
+func (p *Prober) Multipath(ip net.IP, config *MTRConfig) *MultipathStat {
+    st := &mdaState{
+        m:        p.manager(config.Protocol),
+        sleep:    p.sleep,
+        resolver: p.resolver(),
+        ip:       ip,
+        config:   config,
+        alpha:    1 - config.Confidence,
+        maxFlows: config.MaxFlows,
+        hops:     make([]map[int]string, config.MaxTTL+1),
+        final:    make(map[string]bool),
+    }
+    if config.Confidence <= 0 || config.Confidence >= 1 {
+        st.alpha = 1 - defaultConfidence
+    }
+    if st.maxFlows <= 0 {
+        st.maxFlows = defaultMaxFlows
+    }
+    for i := range st.hops {
+        st.hops[i] = make(map[int]string)
+    }
+    silent := 0
+    maxTTL := 0
+    for ttl := 1; ttl <= config.MaxTTL; ttl++ {
+        maxTTL = ttl
+        if ttl == 1 {
+            st.discover("", 1)
+        } else {
+            nodes := make(map[string]struct{})
+            for _, responder := range st.hops[ttl-2] {
+                if responder != "*" && !st.final[responder] {
+                    nodes[responder] = struct{}{}
+                }
+            }
+            for node := range nodes {
+                st.discover(node, ttl)
+            }
+        }
+        done, responded := true, false
+        for _, responder := range st.hops[ttl-1] {
+            if responder != "*" {
+                responded = true
+                if !st.final[responder] {
+                    done = false
+                }
+            }
+        }
+        if responded {
+            silent = 0
+        } else {
+            silent++
+        }
+        if responded && done || silent >= mdaMaxSilentHops {
+            break
+        }
+    }
+    return st.graph(maxTTL)
+}
+
+// graph builds the DAG from responders of each flow
+func (st *mdaState) graph(maxTTL int) *MultipathStat {
+    stat := &MultipathStat{
+        Confidence: 1 - st.alpha,
+        Probes:     st.probes,
+        Nodes:      make([]MultipathNode, 0),
+        Edges:      make([]MultipathEdge, 0),
+        Flows:      make([]MultipathFlow, 0, st.flows),
+    }
+    type nodeKey struct {
+        ttl int
+        ip  string
+    }
+    index := make(map[nodeKey]int)
+    for ttl := 1; ttl <= maxTTL; ttl++ {
+        ips := make([]string, 0)
+        for _, responder := range st.hops[ttl-1] {
+            if _, ok := index[nodeKey{ttl, responder}]; !ok && responder != "*" {
+                index[nodeKey{ttl, responder}] = -1
+                ips = append(ips, responder)
+            }
+        }
+        sort.Strings(ips)
+        for _, ip := range ips {
+            index[nodeKey{ttl, ip}] = len(stat.Nodes)
+            stat.Nodes = append(stat.Nodes, MultipathNode{
+                TTL:  ttl,
+                IP:   ip,
+                RDNS: rDNSLookup(st.resolver, ip),
+            })
+        }
+    }
+    type edgeKey struct {
+        from, to int
+    }
+    edges := make(map[edgeKey]int)
+    for flow := 0; flow < st.flows; flow++ {
+        path := make([]string, maxTTL)
+        for ttl := 1; ttl <= maxTTL; ttl++ {
+            path[ttl-1] = st.hops[ttl-1][flow]
+            if ttl == 1 {
+                continue
+            }
+            from, okFrom := index[nodeKey{ttl - 1, path[ttl-2]}]
+            to, okTo := index[nodeKey{ttl, path[ttl-1]}]
+            if !okFrom || !okTo {
+                continue
+            }
+            e, ok := edges[edgeKey{from, to}]
+            if !ok {
+                e = len(stat.Edges)
+                edges[edgeKey{from, to}] = e
+                stat.Edges = append(stat.Edges, MultipathEdge{From: from, To: to})
+            }
+            stat.Edges[e].Flows = append(stat.Edges[e].Flows, flow)
+        }
+        stat.Flows = append(stat.Flows, MultipathFlow{
+            Flow: flow,
+            Path: path,
+        })
+    }
+    return stat
+}
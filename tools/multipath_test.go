@@ -0,0 +1,208 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tools
+
+import (
+    "context"
+    "net"
+    "reflect"
+    "starping/network"
+    "sync"
+    "testing"
+    "time"
+)
+
+var (
+    simHopA = net.ParseIP("203.0.113.10")
+    simHopB = net.ParseIP("203.0.113.11")
+)
+
+// recordClock is a Clock recording sleeps instead of sleeping
+type recordClock struct {
+    l      sync.Mutex
+    sleeps []time.Duration
+}
+
+func (c *recordClock) Now() time.Time {
+    return time.Now()
+}
+
+func (c *recordClock) Sleep(d time.Duration) {
+    c.l.Lock()
+    c.sleeps = append(c.sleeps, d)
+    c.l.Unlock()
+}
+
+// flowSim issues probes toward network.FlowAddr as ICMP echo on a
+// SimNetwork, which has no load balancing, and records their flows.
+type flowSim struct {
+    *network.ICMPManager
+    l     sync.Mutex
+    flows map[int]int
+}
+
+func (m *flowSim) IssueContext(ctx context.Context, ip net.Addr, probe *network.Probe) (chan *network.Result, error) {
+    flow := ip.(*network.FlowAddr)
+    m.l.Lock()
+    m.flows[flow.Flow]++
+    m.l.Unlock()
+    return m.ICMPManager.IssueContext(ctx, &net.IPAddr{IP: flow.IP}, probe)
+}
+
+// balancer is a network.Manager load balancing flows over paths by flow
+// modulo len(paths). The last hop of a path is the target.
+type balancer struct {
+    paths [][]net.IP
+}
+
+func (m *balancer) Issue(ip net.Addr, ttl int, timeout time.Duration) chan *network.Result {
+    c, _ := m.IssueContext(context.Background(), ip, &network.Probe{TTL: ttl, Timeout: timeout})
+    return c
+}
+
+func (m *balancer) IssueContext(_ context.Context, ip net.Addr, probe *network.Probe) (chan *network.Result, error) {
+    path := m.paths[ip.(*network.FlowAddr).Flow % len(m.paths)]
+    result := &network.Result{Code: network.CodeTimeExceeded, Latency: time.Millisecond}
+    if probe.TTL >= len(path) {
+        result.AddrIP, result.Code = path[len(path) - 1], network.CodeOK
+    } else {
+        result.AddrIP = path[probe.TTL - 1]
+    }
+    c := make(chan *network.Result, 1)
+    c <- result
+    close(c)
+    return c, nil
+}
+
+func (m *balancer) Finish() {}
+
+func TestMDAProbes(t *testing.T) {
+    // the 95% confidence stopping points of MDA
+    for k, want := range []int{6, 6, 11, 16, 21, 27} {
+        if n := mdaProbes(k, 0.05); n != want {
+            t.Fatalf("%d successors: %d probes, want %d", k, n, want)
+        }
+    }
+}
+
+func TestMultipathSim(t *testing.T) {
+    p, m := newSimProber(1, &network.SimRoute{
+        Hops: []network.SimHop{
+            {IP: simHop1, Latency: time.Millisecond},
+            {IP: simHop2, Latency: 2 * time.Millisecond},
+        },
+        Latency: 3 * time.Millisecond,
+    })
+    defer m.Close()
+    mgr := &flowSim{ICMPManager: m, flows: make(map[int]int)}
+    clock := &recordClock{}
+    p.Manager, p.Clock = mgr, clock
+    stat := p.Multipath(simTarget, &MTRConfig{
+        MaxTTL:   10,
+        Interval: 5 * time.Millisecond,
+        Timeout:  50 * time.Millisecond,
+    })
+
+    // a single successor is confirmed by 6 flows at each hop
+    if stat.Probes != 18 || len(stat.Flows) != 6 || stat.Confidence != defaultConfidence {
+        t.Fatalf("%d probes of %d flows at confidence %v", stat.Probes, len(stat.Flows), stat.Confidence)
+    }
+    want := []MultipathNode{
+        {TTL: 1, IP: simHop1.String(), RDNS: "hop1.example"},
+        {TTL: 2, IP: simHop2.String(), RDNS: "hop2.example"},
+        {TTL: 3, IP: simTarget.String()},
+    }
+    if !reflect.DeepEqual(stat.Nodes, want) {
+        t.Fatalf("nodes %+v, want %+v", stat.Nodes, want)
+    }
+    all := []int{0, 1, 2, 3, 4, 5}
+    edges := []MultipathEdge{{From: 0, To: 1, Flows: all}, {From: 1, To: 2, Flows: all}}
+    if !reflect.DeepEqual(stat.Edges, edges) {
+        t.Fatalf("edges %+v, want %+v", stat.Edges, edges)
+    }
+    path := []string{simHop1.String(), simHop2.String(), simTarget.String()}
+    for i, flow := range stat.Flows {
+        if flow.Flow != i || !reflect.DeepEqual(flow.Path, path) {
+            t.Fatalf("flow %+v, want %d along %v", flow, i, path)
+        }
+        // one probe per hop
+        if mgr.flows[i] != 3 {
+            t.Fatalf("flow %d probed %d times", i, mgr.flows[i])
+        }
+    }
+    // probes are paced, not sent in a burst
+    if len(clock.sleeps) != stat.Probes - 1 {
+        t.Fatalf("%d sleeps between %d probes", len(clock.sleeps), stat.Probes)
+    }
+    for _, d := range clock.sleeps {
+        if d != 5 * time.Millisecond {
+            t.Fatalf("slept %v between probes, want the interval", d)
+        }
+    }
+}
+
+func TestMultipathBalanced(t *testing.T) {
+    p := NewProber(&balancer{paths: [][]net.IP{
+        {simHop1, simHopA, simTarget},
+        {simHop1, simHopB, simTarget},
+    }})
+    p.Clock, p.Resolver = &recordClock{}, simResolver{}
+    stat := p.Multipath(simTarget, &MTRConfig{MaxTTL: 10})
+
+    // hop 1: 11 flows, 6 at first and 5 more once hop 2 shows 2
+    // successors, which take 11 flows to confirm. hopB is reached by 5 of
+    // them, so a 12th flow is probed at hop 2 only. hop 3: 6 flows each.
+    if stat.Probes != 35 || len(stat.Flows) != 12 {
+        t.Fatalf("%d probes of %d flows", stat.Probes, len(stat.Flows))
+    }
+    ips := make([]string, 0, len(stat.Nodes))
+    for _, n := range stat.Nodes {
+        ips = append(ips, n.IP)
+    }
+    nodes := []string{simHop1.String(), simHopA.String(), simHopB.String(), simTarget.String()}
+    if !reflect.DeepEqual(ips, nodes) {
+        t.Fatalf("nodes %v, want %v", ips, nodes)
+    }
+    even, odd := []int{0, 2, 4, 6, 8, 10}, []int{1, 3, 5, 7, 9}
+    edges := map[[2]int][]int{
+        {0, 1}: even,
+        {0, 2}: odd,
+        {1, 3}: even,
+        {2, 3}: append(odd, 11),
+    }
+    if len(stat.Edges) != len(edges) {
+        t.Fatalf("edges %+v, want %v", stat.Edges, edges)
+    }
+    for _, e := range stat.Edges {
+        if want := edges[[2]int{e.From, e.To}]; !reflect.DeepEqual(e.Flows, want) {
+            t.Fatalf("edge %d->%d of flows %v, want %v", e.From, e.To, e.Flows, want)
+        }
+    }
+    for _, flow := range stat.Flows {
+        via := simHopA
+        if flow.Flow % 2 == 1 {
+            via = simHopB
+        }
+        path := []string{simHop1.String(), via.String(), simTarget.String()}
+        if flow.Flow == 11 {
+            path[0] = ""
+        }
+        if !reflect.DeepEqual(flow.Path, path) {
+            t.Fatalf("flow %d along %v, want %v", flow.Flow, flow.Path, path)
+        }
+    }
+}
@@ -0,0 +1,106 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tools
+
+import (
+    "encoding/hex"
+    "fmt"
+    "math/rand"
+    "net"
+    "starping/network"
+    "time"
+)
+
+// Echo payload fill patterns. Other pattern is read as hex bytes to repeat.
+const (
+    PatternZero   = "zero"
+    PatternRandom = "random"
+)
+
+// minPayloadSize is the smallest payload size that fits the request cookie
+// network puts at the beginning of echo payload
+const minPayloadSize = 24
+
+// payloadSpec describes the echo payload of probes, and where they leave from
+type payloadSpec struct {
+    // total IP packet size, 0 for the smallest
+    size int
+    // bytes of payload to fill
+    fill   int
+    random bool
+    pattern []byte
+    // source address and outgoing interface, see parseSource
+    source net.IP
+    iface  string
+    // TOS (traffic class) and IPv6 flow label
+    tos       int
+    flowLabel int
+}
+
+// newPayloadSpec parses echo payload of size bytes (like ping -s) filled with
+// pattern toward ip. The first minPayloadSize bytes of payload are taken by the
+// request cookie, so a smaller size other than 0 is an error.
+func newPayloadSpec(ip net.IP, size int, pattern string) (*payloadSpec, error) {
+    spec := &payloadSpec{}
+    switch pattern {
+    case "", PatternZero:
+    case PatternRandom:
+        spec.random = true
+    default:
+        b, err := hex.DecodeString(pattern)
+        if err != nil || len(b) == 0 {
+            return nil, fmt.Errorf("bad payload pattern: %s", pattern)
+        }
+        spec.pattern = b
+    }
+    if size <= 0 {
+        return spec, nil
+    }
+    if size < minPayloadSize {
+        return nil, fmt.Errorf("payload size %d smaller than the %d byte cookie", size, minPayloadSize)
+    }
+    // IP header and ICMP header
+    header := 20 + 8
+    if ip.To4() == nil {
+        header = 40 + 8
+    }
+    if header+size > network.MaxPacketSize {
+        return nil, fmt.Errorf("payload size %d too large", size)
+    }
+    spec.size = header + size
+    spec.fill = size
+    return spec, nil
+}
+
+// probe returns a Probe carrying the payload
+func (p *payloadSpec) probe(ttl int, timeout time.Duration) *network.Probe {
+    probe := &network.Probe{
+        TTL:       ttl,
+        Timeout:   timeout,
+        Size:      p.size,
+        Fill:      p.pattern,
+        Source:    p.source,
+        Interface: p.iface,
+        TOS:       p.tos,
+        FlowLabel: p.flowLabel,
+    }
+    if p.random && p.fill > 0 {
+        probe.Fill = make([]byte, p.fill)
+        rand.Read(probe.Fill)
+    }
+    return probe
+}
@@ -0,0 +1,84 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tools
+
+import (
+    "bytes"
+    "net"
+    "starping/network"
+    "testing"
+)
+
+func TestPayloadSpec(t *testing.T) {
+    tests := []struct {
+        ip      net.IP
+        size    int
+        pattern string
+        want    int
+        fill    []byte
+    }{
+        {simTarget, 0, "", 0, nil},
+        {simTarget, minPayloadSize, "", 20 + 8 + minPayloadSize, nil},
+        {simTarget, 100, PatternZero, 20 + 8 + 100, nil},
+        {simTarget6, 100, "", 40 + 8 + 100, nil},
+        {simTarget, 100, "a5", 20 + 8 + 100, []byte{0xa5}},
+        {simTarget, 100, "DEADbeef", 20 + 8 + 100, []byte{0xde, 0xad, 0xbe, 0xef}},
+    }
+    for _, tt := range tests {
+        spec, err := newPayloadSpec(tt.ip, tt.size, tt.pattern)
+        if err != nil {
+            t.Fatalf("%d bytes of %q: %v", tt.size, tt.pattern, err)
+        }
+        probe := spec.probe(64, 0)
+        if probe.Size != tt.want || !bytes.Equal(probe.Fill, tt.fill) {
+            t.Fatalf("%d bytes of %q: size %d fill %x, want %d %x", tt.size, tt.pattern, probe.Size, probe.Fill, tt.want, tt.fill)
+        }
+    }
+}
+
+func TestPayloadSpecRandom(t *testing.T) {
+    spec, err := newPayloadSpec(simTarget, 100, PatternRandom)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // each probe is filled anew
+    a, b := spec.probe(64, 0).Fill, spec.probe(64, 0).Fill
+    if len(a) != 100 || bytes.Equal(a, b) {
+        t.Fatalf("fills %x and %x, want 100 random bytes each", a, b)
+    }
+    // without padding there's nothing to fill
+    if spec, _ = newPayloadSpec(simTarget, 0, PatternRandom); spec.probe(64, 0).Fill != nil {
+        t.Fatal("fill without payload size")
+    }
+}
+
+func TestPayloadSpecBad(t *testing.T) {
+    for _, tt := range []struct {
+        size    int
+        pattern string
+    }{
+        {0, "xyz"},
+        {0, "abc"},
+        {1, ""},
+        {minPayloadSize - 1, PatternZero},
+        {network.MaxPacketSize, ""},
+    } {
+        if _, err := newPayloadSpec(simTarget, tt.size, tt.pattern); err == nil {
+            t.Fatalf("%d bytes of %q accepted", tt.size, tt.pattern)
+        }
+    }
+}
@@ -17,24 +17,63 @@
 package tools
 
 import (
+    "context"
+    "errors"
     "fmt"
     "math"
     "net"
+    "os"
+    "sort"
     "starping/network"
+    "starping/stats"
+    "sync/atomic"
     "time"
 )
 
+// ErrNoSummary is returned when merging statistics without Summary
+var ErrNoSummary = errors.New("no summary to merge")
+
 // PingConfig represent a ping work config
 type PingConfig struct {
     Frequency time.Duration `json:"frequency"`
     Interval  time.Duration `json:"interval"`
     Timeout   time.Duration `json:"timeout"`
     Count     int `json:"count"`
+    // PayloadSize is the bytes of echo payload, like ping -s. The first 24
+    // bytes carry the request cookie, so sizes 1 to 23 are rejected; 0 sends
+    // the cookie alone.
+    PayloadSize int `json:"payload_size"`
+    // Pattern fills the payload: PatternZero(default), PatternRandom, or
+    // bytes in hex to repeat. Replies are checked against it.
+    Pattern     string `json:"pattern"`
+    // Source is the source address of probes, and Interface the name of
+    // the outgoing interface (or VRF device). Empty to let kernel choose.
+    Source    string `json:"source"`
+    Interface string `json:"interface"`
+    // TOS (IPv6 traffic class) byte of probes, DSCP << 2, e.g. 184 for EF
+    // and 136 for AF41. FlowLabel is the IPv6 flow label, 0 to let kernel
+    // choose.
+    TOS       int `json:"tos"`
+    FlowLabel int `json:"flow_label"`
+    // Pipeline sends probes every Interval without waiting for replies to
+    // earlier ones, and counts reordered and duplicate replies. Replies are
+    // handled as they come, but duplicates are counted until Timeout of
+    // each probe, which Ping waits for.
+    Pipeline bool `json:"pipeline"`
+    // Summary keeps the accumulated probes in PingStat.Summary to merge
+    // later. Off by default, since the quantile sketch is sizable to report.
+    Summary bool `json:"summary"`
 }
 
 // PingStat represent a statistic data to be sent to Star
 type PingStat struct {
     IP string `json:"ip"`
+    // address and interface probes left from
+    Source string `json:"source,omitempty"`
+    Interface string `json:"interface,omitempty"`
+    // TOS and flow label of probes
+    TOS int `json:"tos,omitempty"`
+    FlowLabel int `json:"flow_label,omitempty"`
     Stat struct {
         Timeout bool `json:"timeout"`
         Avg float64 `json:"avg"`
@@ -42,135 +81,404 @@ type PingStat struct {
         Max float64 `json:"max"`
         StdDev float64 `json:"std_dev"`
         Drop int `json:"drop"`
+        // replies with payload shorter than sent
+        Truncated int `json:"truncated"`
+        // replies with payload different from sent
+        Corrupted int `json:"corrupted"`
+        // replies arriving after the reply to a later probe, and replies
+        // beyond the first to a probe. Only counted in pipeline mode.
+        Reordered int `json:"reordered"`
+        Duplicates int `json:"duplicates"`
         Total int `json:"total"`
+        // percentiles of RTT in ms, estimated by the sketch of Summary
+        // within stats.DefaultAlpha (1%) relative error rather than exact,
+        // so they merge across rounds and Planets
+        Median float64 `json:"median"`
+        P90 float64 `json:"p90"`
+        P95 float64 `json:"p95"`
+        P99 float64 `json:"p99"`
+        // RFC 3550 interarrival jitter, and mean absolute difference of
+        // consecutive RTT (IPDV), in ms
+        Jitter float64 `json:"jitter"`
+        IPDV float64 `json:"ipdv"`
+        // E-model estimate of voice quality, see rFactor
+        RFactor float64 `json:"r_factor"`
+        MOS float64 `json:"mos"`
     } `json:"stat"`
+    // Summary accumulates the probes, to merge with other PingStat. Only
+    // kept if PingConfig.Summary is set.
+    Summary *stats.Accumulator `json:"summary,omitempty"`
 }
 
 // PingData represent raw ping data to be sent to Star
 type PingData struct {
     IP string `json:"target"`
+    // address and interface probes left from
+    Source string `json:"source,omitempty"`
+    Interface string `json:"interface,omitempty"`
+    // TOS and flow label of probes
+    TOS int `json:"tos,omitempty"`
+    FlowLabel int `json:"flow_label,omitempty"`
     Data []*network.Result `json:"data"`
+    // replies arriving after the reply to a later probe, in pipeline mode
+    Reordered int `json:"reordered,omitempty"`
 }
 
 func (stat *PingStat) String() string {
+    target := stat.IP + sourceString(stat.Source, stat.Interface)
+    damaged := ""
+    if stat.Stat.Truncated != 0 || stat.Stat.Corrupted != 0 {
+        damaged = fmt.Sprintf(" Truncated: %d Corrupted: %d", stat.Stat.Truncated, stat.Stat.Corrupted)
+    }
+    if stat.Stat.Reordered != 0 || stat.Stat.Duplicates != 0 {
+        damaged += fmt.Sprintf(" Reordered: %d Duplicates: %d", stat.Stat.Reordered, stat.Stat.Duplicates)
+    }
     if stat.Stat.Drop == stat.Stat.Total {
         return fmt.Sprintf(
             "Statistics for %s: No response from target. No statistics available. Drop/Total: %d/%d DropRate: 100%%\n",
-            stat.IP, stat.Stat.Drop, stat.Stat.Total)
+            target, stat.Stat.Drop, stat.Stat.Total)
+    }
+    if stat.Stat.Drop + stat.Stat.Truncated + stat.Stat.Corrupted == stat.Stat.Total {
+        return fmt.Sprintf(
+            "Statistics for %s: No intact reply from target. No statistics available. Drop/Total: %d/%d%s\n",
+            target, stat.Stat.Drop, stat.Stat.Total, damaged)
     }
     return fmt.Sprintf(
-        "Statistics for %s: Avg: %.2fms, Min: %.2fms, Max: %.2fms, SDev: %.2fms, Drop/Total: %d/%d DropRate: %.1f%%\n",
-        stat.IP, stat.Stat.Avg, stat.Stat.Min, stat.Stat.Max, stat.Stat.StdDev, stat.Stat.Drop, stat.Stat.Total,
-        float64(stat.Stat.Drop * 100) / float64(stat.Stat.Total))
+        "Statistics for %s: Avg: %.2fms, Min: %.2fms, Max: %.2fms, SDev: %.2fms, Drop/Total: %d/%d DropRate: %.1f%%%s\n",
+        target, stat.Stat.Avg, stat.Stat.Min, stat.Stat.Max, stat.Stat.StdDev, stat.Stat.Drop, stat.Stat.Total,
+        float64(stat.Stat.Drop * 100) / float64(stat.Stat.Total), damaged) + fmt.Sprintf(
+        "    Median: %.2fms, P90: %.2fms, P95: %.2fms, P99: %.2fms, Jitter: %.2fms, IPDV: %.2fms, R: %.1f, MOS: %.2f\n",
+        stat.Stat.Median, stat.Stat.P90, stat.Stat.P95, stat.Stat.P99, stat.Stat.Jitter, stat.Stat.IPDV,
+        stat.Stat.RFactor, stat.Stat.MOS)
 }
 
-func Ping(ip string, config *PingConfig) (stat *PingStat, err error) {
-    addr, err := net.ResolveIPAddr("", ip)
+// issue sends a probe by m and waits for its Result. err is only returned when
+// m doesn't accept the probe at all; failures to send are reported as Result.
+func issue(m network.Manager, addr net.Addr, probe *network.Probe) (*network.Result, error) {
+    delivery, err := m.IssueContext(context.Background(), addr, probe)
+    if delivery == nil {
+        return nil, err
+    }
+    return <-delivery, nil
+}
+
+// pingTarget resolves ip and prepares probes toward it as configured. returns
+// the manager, target, payload of probes and the address probes leave from.
+func (p *Prober) pingTarget(ip string, config *PingConfig) (network.Manager, *net.IPAddr, *payloadSpec, string, error) {
+    addr, err := p.resolver().ResolveIPAddr(ip)
     if err != nil {
-        return
+        return nil, nil, nil, "", err
     }
-    stat = &PingStat{
-        IP: addr.IP.String(),
+    m := p.manager(ProtocolICMP)
+    if err = network.CheckFamily(m, addr.IP); err != nil {
+        return nil, nil, nil, "", err
+    }
+    payload, err := newPayloadSpec(addr.IP, config.PayloadSize, config.Pattern)
+    if err != nil {
+        return nil, nil, nil, "", err
+    }
+    var source string
+    if payload.source, source, err = parseSource(addr.IP, config.Source, config.Interface); err != nil {
+        return nil, nil, nil, "", err
+    }
+    payload.iface = config.Interface
+    payload.tos, payload.flowLabel = config.TOS, config.FlowLabel
+    return m, addr, payload, source, nil
+}
+
+// pingRun sends config.Count probes toward addr by m, and calls each with the
+// sequence number and Result of every probe once it's finished, from the
+// calling goroutine. In pipeline mode, dup is called likewise once duplicate
+// replies to a probe are counted, if there's any, with Result.Duplicates set.
+// returns Results by sequence number and the number of reordered replies.
+func (p *Prober) pingRun(m network.Manager, addr *net.IPAddr, payload *payloadSpec, config *PingConfig,
+    each, dup func(seq int, result *network.Result)) ([]*network.Result, int, error) {
+    results := make([]*network.Result, config.Count)
+    if config.Pipeline {
+        return p.pipeline(m, addr, payload, config, results, each, dup)
     }
-    stat.Stat.Min = math.MaxFloat64
-    stat.Stat.Total = config.Count
-    stat.Stat.Timeout = false
-    m := network.GetICMPManager()
     for i := 0; i < config.Count; i++ {
-        result := <- m.Issue(addr, 100, config.Timeout)
-        if result.Code != 257 {
-            stat.Stat.Drop++
-        } else {
-            timeFloat := float64(result.Latency) / float64(time.Millisecond)
-            stat.Stat.Avg += timeFloat
-            stat.Stat.Min = math.Min(stat.Stat.Min, timeFloat)
-            stat.Stat.Max = math.Max(stat.Stat.Max, timeFloat)
-            stat.Stat.StdDev += timeFloat * timeFloat
+        result, err := issue(m, addr, payload.probe(100, config.Timeout))
+        if err != nil {
+            return nil, 0, err
         }
-        time.Sleep(config.Interval)
+        results[i] = result
+        each(i, result)
+        p.sleep(config.Interval)
     }
-    if stat.Stat.Total == stat.Stat.Drop {
-        stat.Stat.Min = 0
-        stat.Stat.Timeout = true
-        return
+    // replies can't be reordered when probes wait for each other
+    return results, 0, nil
+}
+
+// pipeline is pingRun sending probes every config.Interval, whether earlier
+// probes are finished or not. Each probe counts duplicate replies until
+// config.Timeout after sent, which pipeline waits for.
+func (p *Prober) pipeline(m network.Manager, addr *net.IPAddr, payload *payloadSpec, config *PingConfig,
+    results []*network.Result, each, dup func(seq int, result *network.Result)) ([]*network.Result, int, error) {
+    type finished struct {
+        seq    int
+        result *network.Result
+        // set once duplicates are counted, without result
+        counted bool
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    // buffered, so probes left behind on error don't block
+    replies := make(chan finished, 2 * config.Count)
+    // counted by the manager, read once the probe is finished
+    duplicates := make([]int32, config.Count)
+    issued := make(chan error, 1)
+    go func() {
+        start := p.now()
+        for i := 0; i < config.Count; i++ {
+            if i != 0 {
+                p.sleep(start.Add(time.Duration(i) * config.Interval).Sub(p.now()))
+            }
+            seq := i
+            probe := payload.probe(100, config.Timeout)
+            probe.Duplicate = func(*network.Result) {
+                atomic.AddInt32(&duplicates[seq], 1)
+            }
+            delivery, err := m.IssueContext(ctx, addr, probe)
+            if delivery == nil {
+                issued <- err
+                return
+            }
+            go func() {
+                replies <- finished{seq: seq, result: <-delivery}
+                // closed once duplicates are counted
+                <-delivery
+                replies <- finished{seq: seq, counted: true}
+            }()
+        }
+        issued <- nil
+    }()
+    for done := 0; done < config.Count; {
+        select {
+        case err := <-issued:
+            if err != nil {
+                return nil, 0, err
+            }
+            // all issued, wait for the rest
+            issued = nil
+        case r := <-replies:
+            if !r.counted {
+                results[r.seq] = r.result
+                each(r.seq, r.result)
+                continue
+            }
+            result := results[r.seq]
+            if result.Duplicates = int(atomic.LoadInt32(&duplicates[r.seq])); result.Duplicates != 0 {
+                dup(r.seq, result)
+            }
+            done++
+        }
     }
-    succeed := float64(stat.Stat.Total - stat.Stat.Drop)
-    total := float64(stat.Stat.Total)
-    stat.Stat.Avg = stat.Stat.Avg / succeed
-    // For standard derivation, we use D(X) = E(X^2) - E(X)^2 to compute variance,
-    // And then multiply m * (n-1) / n / (m-1) (where n = total, m = succeed)
-    // to estimate variance of 10 packets.
-    // if this estimate got NaN or Inf, then store it as 0.
-    stat.Stat.StdDev = math.Sqrt((stat.Stat.StdDev / succeed - stat.Stat.Avg * stat.Stat.Avg) * succeed * (
-        total - 1) / total / (succeed - 1))
-    if math.IsNaN(stat.Stat.StdDev) || math.IsInf(stat.Stat.StdDev, 1) {
-        stat.Stat.StdDev = 0
+    return results, reordered(results), nil
+}
+
+// reordered counts echo replies arriving after the reply of a later probe, as
+// RFC 4737 defines. Arrival is taken as transmit time plus latency, both by
+// the manager.
+func reordered(results []*network.Result) int {
+    type arrival struct {
+        seq int
+        at  time.Time
     }
-    return
+    arrivals := make([]arrival, 0, len(results))
+    for i, result := range results {
+        if result.Code == network.CodeOK {
+            arrivals = append(arrivals, arrival{i, result.IssueTime.Add(result.Latency)})
+        }
+    }
+    sort.SliceStable(arrivals, func(i, j int) bool {
+        return arrivals[i].at.Before(arrivals[j].at)
+    })
+    count, next := 0, 0
+    for _, a := range arrivals {
+        if a.seq < next {
+            count++
+        } else {
+            next = a.seq + 1
+        }
+    }
+    return count
+}
+
+// Ping pings ip with the shared ICMP manager.
+func Ping(ip string, config *PingConfig) (stat *PingStat, err error) {
+    return defaultProber.Ping(ip, config)
 }
 
+// Ping sends config.Count echo requests to ip and summarizes the replies.
+func (p *Prober) Ping(ip string, config *PingConfig) (stat *PingStat, err error) {
+    return p.PingStream(ip, config, nil)
+}
+
+// PingInfo pings ip with the shared ICMP manager.
 func PingInfo(ip string, config *PingConfig) (stat *PingStat, err error) {
-    addr, err := net.ResolveIPAddr("", ip)
+    return defaultProber.PingInfo(ip, config)
+}
+
+// PingInfo is Ping printing each reply like ping does.
+func (p *Prober) PingInfo(ip string, config *PingConfig) (stat *PingStat, err error) {
+    return p.PingStream(ip, config, PingConsole(os.Stdout))
+}
+
+// PingStream pings ip with the shared ICMP manager.
+func PingStream(ip string, config *PingConfig, handle func(*PingEvent)) (stat *PingStat, err error) {
+    return defaultProber.PingStream(ip, config, handle)
+}
+
+// PingStream is Ping handing the outcome of each probe to handle, if not nil,
+// once it's known. handle is called from the calling goroutine, in order of
+// outcome rather than sequence in pipeline mode, where probes replied more
+// than once get another event with Duplicates once they are counted.
+func (p *Prober) PingStream(ip string, config *PingConfig, handle func(*PingEvent)) (stat *PingStat, err error) {
+    m, addr, payload, source, err := p.pingTarget(ip, config)
     if err != nil {
-        return
+        return nil, err
     }
     stat = &PingStat{
-        IP: addr.IP.String(),
+        IP:        addr.IP.String(),
+        Source:    source,
+        Interface: config.Interface,
+        TOS:       config.TOS,
+        FlowLabel: config.FlowLabel,
+        Summary:   stats.NewAccumulator(true),
     }
-    stat.Stat.Min = math.MaxFloat64
-    stat.Stat.Total = config.Count
-    m := network.GetICMPManager()
-    for i := 0; i < config.Count; i++ {
-        result := <- m.Issue(addr, 100, config.Timeout)
-        if result.Code == 256 {
-            fmt.Printf("#%2d: Timeout.\n", i+1)
-            stat.Stat.Drop++
-        } else if result.Code != 257 {
-            info, ok := network.IcmpUnreachableMsg[result.Code]
-            if !ok {
-                info = fmt.Sprintf("Unknown destination unreachable code <%d>", result.Code)
-            }
-            fmt.Printf("#%2d: Reply from %s (%.2fms): %s.\n", i+1, result.AddrIP,
-                float64(result.Latency) / float64(time.Millisecond), info)
-            stat.Stat.Drop++
+    results, reordered, err := p.pingRun(m, addr, payload, config, func(i int, result *network.Result) {
+        if result.Code != 257 {
+            stat.Summary.Drop()
+        } else if result.Truncated {
+            stat.Stat.Truncated++
+            stat.Summary.Loss.Add(false)
+        } else if result.Corrupted {
+            stat.Stat.Corrupted++
+            stat.Summary.Loss.Add(false)
         } else {
-            timeFloat := float64(result.Latency) / float64(time.Millisecond)
-            fmt.Printf("#%2d: Reply from %s (%.2fms): Echo Reply.\n", i+1, result.AddrIP, timeFloat)
-            stat.Stat.Avg += timeFloat
-            stat.Stat.Min = math.Min(stat.Stat.Min, timeFloat)
-            stat.Stat.Max = math.Max(stat.Stat.Max, timeFloat)
-            stat.Stat.StdDev += timeFloat * timeFloat
+            stat.Summary.Add(float64(result.Latency) / float64(time.Millisecond))
+        }
+        if handle != nil {
+            handle(newPingEvent(i + 1, result))
         }
-        time.Sleep(config.Interval)
+    }, func(i int, result *network.Result) {
+        stat.Stat.Duplicates += result.Duplicates
+        if handle != nil {
+            event := newPingEvent(i + 1, result)
+            event.Duplicates = result.Duplicates
+            handle(event)
+        }
+    })
+    if err != nil {
+        return nil, err
+    }
+    stat.Stat.Reordered = reordered
+    stat.summarize()
+    stat.percentiles()
+    stat.quality(results)
+    if !config.Summary {
+        stat.Summary = nil
+    }
+    return
+}
+
+// stdDev is the standard deviation of RTT reported by PingStat and
+// MTRHopStat: sample variance of replies scaled by (n-1)/n, where n is total
+// probes, lost ones included, to estimate variance of n probes.
+func stdDev(rtt *stats.Welford, total int) float64 {
+    if rtt.N < 2 || total < 1 {
+        return 0
     }
-    if stat.Stat.Total == stat.Stat.Drop {
-        stat.Stat.Min = 0
+    return math.Sqrt(rtt.Variance() * float64(total - 1) / float64(total))
+}
+
+// summarize fills Avg, Min, Max, StdDev, Drop, Total and Timeout of stat from
+// Summary
+func (stat *PingStat) summarize() {
+    s := stat.Summary
+    stat.Stat.Total, stat.Stat.Drop = s.Loss.Total, s.Loss.Drop
+    stat.Stat.Timeout = s.Loss.Total == s.Loss.Drop
+    stat.Stat.Avg, stat.Stat.Min, stat.Stat.Max = s.RTT.Mean, s.RTT.Min, s.RTT.Max
+    stat.Stat.StdDev = stdDev(&s.RTT, s.Loss.Total)
+}
+
+// percentiles fills Median, P90, P95 and P99 of stat from the sketch of
+// Summary, or zeroes them without one.
+func (stat *PingStat) percentiles() {
+    sketch := stat.Summary.Sketch
+    if sketch == nil {
+        stat.Stat.Median, stat.Stat.P90, stat.Stat.P95, stat.Stat.P99 = 0, 0, 0, 0
         return
     }
-    succeed := float64(stat.Stat.Total - stat.Stat.Drop)
-    total := float64(stat.Stat.Total)
-    stat.Stat.Avg = stat.Stat.Avg / succeed
-    stat.Stat.StdDev = math.Sqrt((stat.Stat.StdDev / succeed - stat.Stat.Avg * stat.Stat.Avg) * succeed * (
-        total - 1) / total / (succeed - 1))
-    if math.IsNaN(stat.Stat.StdDev) || math.IsInf(stat.Stat.StdDev, 1) {
-        stat.Stat.StdDev = 0
+    stat.Stat.Median = sketch.Quantile(0.5)
+    stat.Stat.P90 = sketch.Quantile(0.9)
+    stat.Stat.P95 = sketch.Quantile(0.95)
+    stat.Stat.P99 = sketch.Quantile(0.99)
+}
+
+// intervals is how many consecutive pairs of n intact replies jitter and IPDV
+// are taken over
+func intervals(n int) float64 {
+    if n < 2 {
+        return 0
     }
-    return
+    return float64(n - 1)
+}
+
+// Merge adds probes of o, e.g. another round or another Planet pinging the
+// same target, to stat. Both must carry Summary. Percentiles are estimated
+// again from the merged sketch, and jitter and IPDV, which only make sense
+// within a sequence of probes, are averaged weighted by the intervals each
+// is taken over.
+func (stat *PingStat) Merge(o *PingStat) error {
+    if stat.Summary == nil || o.Summary == nil {
+        return ErrNoSummary
+    }
+    n, on := intervals(stat.Summary.RTT.N), intervals(o.Summary.RTT.N)
+    if err := stat.Summary.Merge(o.Summary); err != nil {
+        return err
+    }
+    stat.Stat.Truncated += o.Stat.Truncated
+    stat.Stat.Corrupted += o.Stat.Corrupted
+    stat.Stat.Reordered += o.Stat.Reordered
+    stat.Stat.Duplicates += o.Stat.Duplicates
+    stat.summarize()
+    stat.percentiles()
+    if n + on != 0 {
+        stat.Stat.Jitter = (stat.Stat.Jitter * n + o.Stat.Jitter * on) / (n + on)
+        stat.Stat.IPDV = (stat.Stat.IPDV * n + o.Stat.IPDV * on) / (n + on)
+    }
+    s := stat.Summary
+    if s.RTT.N == 0 {
+        return nil
+    }
+    loss := float64(s.Loss.Total - s.RTT.N) * 100 / float64(s.Loss.Total)
+    stat.Stat.RFactor = rFactor(s.RTT.Mean, stat.Stat.Jitter, loss)
+    stat.Stat.MOS = mos(stat.Stat.RFactor)
+    return nil
 }
 
+// PingRaw pings ip with the shared ICMP manager.
 func PingRaw(ip string, config *PingConfig) (data *PingData, err error) {
-    addr, err := net.ResolveIPAddr("", ip)
+    return defaultProber.PingRaw(ip, config)
+}
+
+// PingRaw is Ping reporting the Result of each probe.
+func (p *Prober) PingRaw(ip string, config *PingConfig) (data *PingData, err error) {
+    m, addr, payload, source, err := p.pingTarget(ip, config)
     if err != nil {
-        return
+        return nil, err
     }
     data = &PingData{
-        IP: addr.IP.String(),
-        Data: make([]*network.Result, config.Count),
+        IP:        addr.IP.String(),
+        Source:    source,
+        Interface: config.Interface,
+        TOS:       config.TOS,
+        FlowLabel: config.FlowLabel,
     }
-    m := network.GetICMPManager()
-    for i := 0; i < config.Count; i++ {
-        data.Data[i] = <- m.Issue(addr, 100, config.Timeout)
-        time.Sleep(config.Interval)
+    if data.Data, data.Reordered, err = p.pingRun(m, addr, payload, config, func(int, *network.Result) {}, func(int, *network.Result) {}); err != nil {
+        return nil, err
     }
     return
-}
\ No newline at end of file
+}
@@ -0,0 +1,205 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tools
+
+import (
+    "context"
+    "fmt"
+    "starping/network"
+    "time"
+)
+
+const (
+    // default largest packet size PMTU tries
+    defaultPMTUMaxSize = 1500
+    // default probes sent of each size before it's considered lost
+    defaultPMTURetry = 2
+    // Hop of PMTUStat when the MTU is limited by the outgoing interface
+    PMTULocalHop = "local"
+)
+
+// PMTUConfig represent a path MTU discovery work config
+type PMTUConfig struct {
+    Frequency time.Duration `json:"frequency"`
+    Timeout   time.Duration `json:"timeout"`
+    Interval  time.Duration `json:"interval"`
+    // Retry is the number of probes sent of each size before it's
+    // considered lost, default 2
+    Retry     int `json:"retry"`
+    // MaxSize is the largest packet size to try, default 1500, at most
+    // network.MaxPacketSize
+    MaxSize   int `json:"max_size"`
+    // Source and Interface of probes, same as PingConfig
+    Source    string `json:"source"`
+    Interface string `json:"interface"`
+}
+
+// PMTUStat represent path MTU of a target to be sent to Star
+type PMTUStat struct {
+    IP string `json:"ip"`
+    // address and interface probes left from
+    Source string `json:"source,omitempty"`
+    Interface string `json:"interface,omitempty"`
+    // largest packet size reaching the target without fragmentation
+    MTU int `json:"mtu"`
+    // Hop is the router reported the MTU with Fragmentation Needed (Packet
+    // Too Big for IPv6), PMTULocalHop if the outgoing interface limits it,
+    // or empty if MaxSize reaches the target or larger probes are silently
+    // dropped.
+    Hop string `json:"hop"`
+    RDNS string `json:"rdns"`
+    // BlackHole is set if larger probes are dropped without any error,
+    // which breaks path MTU discovery of normal traffic.
+    BlackHole bool `json:"black_hole"`
+    Probes int `json:"probes"`
+}
+
+func (stat *PMTUStat) String() string {
+    s := fmt.Sprintf("Path MTU for %s%s: %d", stat.IP, sourceString(stat.Source, stat.Interface), stat.MTU)
+    switch {
+    case stat.BlackHole:
+        s += ", larger packets silently dropped"
+    case stat.Hop == PMTULocalHop:
+        s += ", limited by local interface"
+    case stat.Hop != "":
+        s += fmt.Sprintf(", limited by %s", stat.Hop)
+        if stat.RDNS != "" {
+            s += fmt.Sprintf("(%s)", stat.RDNS)
+        }
+    }
+    return s + fmt.Sprintf(" (%d probes)\n", stat.Probes)
+}
+
+// PMTU finds the path MTU toward ip with the shared ICMP manager.
+func PMTU(ip string, config *PMTUConfig) (*PMTUStat, error) {
+    return defaultProber.PMTU(ip, config)
+}
+
+// PMTU finds the path MTU toward ip with echo requests of varying size, which
+// are never fragmented. Sizes are binary searched, and next-hop MTU reported
+// by routers is tried directly.
+func (p *Prober) PMTU(ip string, config *PMTUConfig) (*PMTUStat, error) {
+    addr, err := p.resolver().ResolveIPAddr(ip)
+    if err != nil {
+        return nil, err
+    }
+    m := p.manager(ProtocolICMP)
+    if err = network.CheckFamily(m, addr.IP); err != nil {
+        return nil, err
+    }
+    stat := &PMTUStat{
+        IP:        addr.IP.String(),
+        Interface: config.Interface,
+    }
+    source, used, err := parseSource(addr.IP, config.Source, config.Interface)
+    if err != nil {
+        return nil, err
+    }
+    stat.Source = used
+    retry := config.Retry
+    if retry <= 0 {
+        retry = defaultPMTURetry
+    }
+    maxSize := config.MaxSize
+    if maxSize <= 0 {
+        maxSize = defaultPMTUMaxSize
+    }
+    if maxSize > network.MaxPacketSize {
+        maxSize = network.MaxPacketSize
+    }
+    // IP header, ICMP header and the cookie
+    minSize := 20 + 8 + 24
+    if addr.IP.To4() == nil {
+        minSize = 40 + 8 + 24
+    }
+    if maxSize < minSize {
+        maxSize = minSize
+    }
+
+    probe := func(size int) (*network.Result, error) {
+        var result *network.Result
+        for i := 0; i < retry; i++ {
+            delivery, err := m.IssueContext(context.Background(), addr, &network.Probe{
+                TTL:       100,
+                Timeout:   config.Timeout,
+                Size:      size,
+                Source:    source,
+                Interface: config.Interface,
+            })
+            if delivery == nil {
+                return nil, err
+            }
+            stat.Probes++
+            result = <-delivery
+            p.sleep(config.Interval)
+            if result.Code != network.CodeTimeout {
+                break
+            }
+        }
+        return result, nil
+    }
+
+    result, err := probe(minSize)
+    if err != nil {
+        return nil, err
+    }
+    switch result.Code {
+    case network.CodeOK:
+    case network.CodeTimeout:
+        return nil, fmt.Errorf("no echo reply from %s: timed out", stat.IP)
+    default:
+        return nil, fmt.Errorf("no echo reply from %s: %s", stat.IP, codeMessage(result.Code))
+    }
+    lo, hi := minSize, maxSize
+    size := hi
+    for lo < hi {
+        result, err := probe(size)
+        if err != nil {
+            return nil, err
+        }
+        next := 0
+        switch result.Code {
+        case network.CodeOK:
+            lo = size
+        case 4, network.CodePacketTooBig: // Fragmentation Needed, Packet Too Big
+            hi = size - 1
+            stat.Hop, stat.BlackHole = result.AddrIP.String(), false
+            // try the reported MTU next
+            if result.MTU >= lo && result.MTU < size {
+                hi, next = result.MTU, result.MTU
+            }
+        case network.CodeMessageSize:
+            hi = size - 1
+            stat.Hop, stat.BlackHole = PMTULocalHop, false
+        case network.CodeTimeout:
+            hi = size - 1
+            stat.Hop, stat.BlackHole = "", true
+        default:
+            return nil, fmt.Errorf("probing %s with %d bytes: %s", stat.IP, size, codeMessage(result.Code))
+        }
+        if next != 0 {
+            size = next
+        } else {
+            size = (lo + hi + 1) / 2
+        }
+    }
+    stat.MTU = lo
+    if stat.Hop != "" && stat.Hop != PMTULocalHop {
+        stat.RDNS = rDNSLookup(p.resolver(), stat.Hop)
+    }
+    return stat, nil
+}
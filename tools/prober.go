@@ -0,0 +1,144 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tools
+
+import (
+    lru "github.com/hashicorp/golang-lru"
+    "net"
+    "starping/network"
+    "sync"
+    "time"
+)
+
+// Clock paces probes
+type Clock interface {
+    Now() time.Time
+    // Sleep pauses for at least d
+    Sleep(d time.Duration)
+}
+
+// Resolver resolves targets and reverse DNS of responders
+type Resolver interface {
+    // ResolveIPAddr resolves host, which is a host name or an IP address
+    ResolveIPAddr(host string) (*net.IPAddr, error)
+    // LookupAddr returns names of ip, like net.LookupAddr
+    LookupAddr(ip string) ([]string, error)
+}
+
+// A Prober runs ping, MTR and path MTU discovery with probes issued by
+// Manager. The zero value of Clock and Resolver means the system clock and
+// resolver, and nil Manager means the shared managers of network package,
+// chosen by protocol of the work.
+//
+// Manager must accept targets of the work: *net.IPAddr for ping and path MTU
+// discovery, and the address of config.Protocol for MTR (see MTRConfig).
+type Prober struct {
+    Manager  network.Manager
+    Clock    Clock
+    Resolver Resolver
+}
+
+// NewProber creates a Prober issuing probes by m, with the system clock and
+// resolver.
+func NewProber(m network.Manager) *Prober {
+    return &Prober{
+        Manager:  m,
+        Clock:    systemClock{},
+        Resolver: systemResolver{},
+    }
+}
+
+// defaultProber backs package level functions
+var defaultProber = NewProber(nil)
+
+// manager returns Manager, or the shared manager of protocol if it's nil
+func (p *Prober) manager(protocol string) network.Manager {
+    if p.Manager != nil {
+        return p.Manager
+    }
+    switch protocol {
+    case ProtocolUDP:
+        return network.GetUDPManager()
+    case ProtocolTCP:
+        return network.GetTCPManager()
+    default:
+        return network.GetICMPManager()
+    }
+}
+
+func (p *Prober) now() time.Time {
+    if p.Clock == nil {
+        return time.Now()
+    }
+    return p.Clock.Now()
+}
+
+func (p *Prober) sleep(d time.Duration) {
+    if p.Clock == nil {
+        time.Sleep(d)
+        return
+    }
+    p.Clock.Sleep(d)
+}
+
+func (p *Prober) resolver() Resolver {
+    if p.Resolver == nil {
+        return systemResolver{}
+    }
+    return p.Resolver
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+    return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+    time.Sleep(d)
+}
+
+var cache *lru.TwoQueueCache
+var once sync.Once
+
+func getRDNSCache() *lru.TwoQueueCache {
+    once.Do(func() {
+        cache, _ = lru.New2Q(8192)
+    })
+    return cache
+}
+
+// systemResolver resolves with net package. Reverse DNS is cached, failed
+// lookups are not.
+type systemResolver struct{}
+
+func (systemResolver) ResolveIPAddr(host string) (*net.IPAddr, error) {
+    return net.ResolveIPAddr("", host)
+}
+
+func (systemResolver) LookupAddr(ip string) ([]string, error) {
+    c := getRDNSCache()
+    if entry, ok := c.Get(ip); ok {
+        return entry.([]string), nil
+    }
+    names, err := net.LookupAddr(ip)
+    if err != nil {
+        return nil, err
+    }
+    c.Add(ip, names)
+    return names, nil
+}
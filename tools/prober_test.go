@@ -0,0 +1,87 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tools
+
+import (
+    "context"
+    "net"
+    "starping/network"
+    "sync"
+    "testing"
+    "time"
+)
+
+// countManager counts probes issued through the wrapped Manager by TTL
+type countManager struct {
+    network.Manager
+    l    sync.Mutex
+    ttls map[int]int
+}
+
+func (m *countManager) IssueContext(ctx context.Context, ip net.Addr, probe *network.Probe) (chan *network.Result, error) {
+    m.l.Lock()
+    m.ttls[probe.TTL]++
+    m.l.Unlock()
+    return m.Manager.IssueContext(ctx, ip, probe)
+}
+
+func TestProberInjected(t *testing.T) {
+    sim, m := newSimProber(1, &network.SimRoute{
+        Hops:    []network.SimHop{{IP: simHop1, Latency: time.Millisecond}},
+        Latency: 2 * time.Millisecond,
+    })
+    defer m.Close()
+    mgr := &countManager{Manager: m, ttls: make(map[int]int)}
+    clock := &recordClock{}
+    p := &Prober{Manager: mgr, Clock: clock, Resolver: sim.Resolver}
+
+    stat, err := p.Ping(simTarget.String(), &PingConfig{
+        Count:    4,
+        Interval: 7 * time.Millisecond,
+        Timeout:  50 * time.Millisecond,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    // probes go through the manager, and wait on the clock
+    if stat.Stat.Total != 4 || stat.Stat.Drop != 0 || mgr.ttls[100] != 4 {
+        t.Fatalf("drop/total %d/%d with %d probes issued", stat.Stat.Drop, stat.Stat.Total, mgr.ttls[100])
+    }
+    if len(clock.sleeps) != 4 || clock.sleeps[0] != 7 * time.Millisecond {
+        t.Fatalf("slept %v, want the interval after each probe", clock.sleeps)
+    }
+
+    if _, err = p.MTR(simTarget.String(), &MTRConfig{
+        Count:   2,
+        MaxTTL:  10,
+        Timeout: 50 * time.Millisecond,
+    }); err != nil {
+        t.Fatal(err)
+    }
+    // TTL 1 reaches the hop and TTL 2 the target, each round
+    if mgr.ttls[1] != 2 || mgr.ttls[2] != 2 || mgr.ttls[3] != 0 {
+        t.Fatalf("probes by TTL %v", mgr.ttls)
+    }
+
+    // names are resolved by Resolver, which only knows IP literals
+    if _, err = p.Ping("target.example", &PingConfig{Count: 1}); err == nil || err.Error() != "no such host" {
+        t.Fatalf("pinging a name: %v", err)
+    }
+    if len(mgr.ttls) != 3 {
+        t.Fatalf("probes by TTL %v, want none for the name", mgr.ttls)
+    }
+}
@@ -0,0 +1,94 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tools
+
+import (
+    "math"
+    "starping/network"
+    "time"
+)
+
+// interarrivalJitter is the RFC 3550 interarrival jitter of rtts in send
+// order. For round trips the difference of transit time between two probes is
+// the difference of their RTT.
+func interarrivalJitter(rtts []float64) (j float64) {
+    for i := 1; i < len(rtts); i++ {
+        j += (math.Abs(rtts[i] - rtts[i - 1]) - j) / 16
+    }
+    return
+}
+
+// ipdv is the mean absolute difference of consecutive rtts
+func ipdv(rtts []float64) float64 {
+    if len(rtts) < 2 {
+        return 0
+    }
+    sum := 0.0
+    for i := 1; i < len(rtts); i++ {
+        sum += math.Abs(rtts[i] - rtts[i - 1])
+    }
+    return sum / float64(len(rtts) - 1)
+}
+
+// rFactor estimates the ITU-T G.107 E-model R-factor from mean RTT and jitter
+// in ms and loss in percent, with the usual simplification for VoIP
+// monitoring: jitter counts twice toward latency, plus 10ms codec delay.
+func rFactor(rtt, jitter, loss float64) float64 {
+    effective := rtt + 2 * jitter + 10
+    r := 93.2 - effective / 40
+    if effective >= 160 {
+        r = 93.2 - (effective - 120) / 10
+    }
+    r -= 2.5 * loss
+    return math.Max(0, math.Min(100, r))
+}
+
+// mos maps R-factor to Mean Opinion Score, as ITU-T G.107 annex B
+func mos(r float64) float64 {
+    switch {
+    case r <= 0:
+        return 1
+    case r >= 100:
+        return 4.5
+    }
+    return 1 + 0.035 * r + 7e-6 * r * (r - 60) * (100 - r)
+}
+
+// quality fills jitter, IPDV, R-factor and MOS of stat from RTT
+// of intact echo replies in results, which are by sequence number. They're
+// left zero without any intact reply.
+func (stat *PingStat) quality(results []*network.Result) {
+    rtts := make([]float64, 0, len(results))
+    for _, result := range results {
+        if result.Code == network.CodeOK && !result.Truncated && !result.Corrupted {
+            rtts = append(rtts, float64(result.Latency) / float64(time.Millisecond))
+        }
+    }
+    if len(rtts) == 0 || len(results) == 0 {
+        return
+    }
+    stat.Stat.Jitter = interarrivalJitter(rtts)
+    stat.Stat.IPDV = ipdv(rtts)
+    mean := 0.0
+    for _, rtt := range rtts {
+        mean += rtt
+    }
+    mean /= float64(len(rtts))
+    loss := float64(len(results) - len(rtts)) * 100 / float64(len(results))
+    stat.Stat.RFactor = rFactor(mean, stat.Stat.Jitter, loss)
+    stat.Stat.MOS = mos(stat.Stat.RFactor)
+}
@@ -0,0 +1,129 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tools
+
+import (
+    "math"
+    "starping/network"
+    "testing"
+    "time"
+)
+
+func near(a, b float64) bool {
+    return math.Abs(a - b) < 1e-9
+}
+
+func TestInterarrivalJitter(t *testing.T) {
+    for _, tt := range []struct {
+        rtts []float64
+        want float64
+    }{
+        {nil, 0},
+        {[]float64{10}, 0},
+        {[]float64{10, 10, 10}, 0},
+        // J += (|D| - J) / 16 for each pair, RFC 3550 section 6.4.1
+        {[]float64{10, 20}, 0.625},
+        {[]float64{20, 10}, 0.625},
+        {[]float64{10, 20, 10, 20}, 1.76025390625},
+    } {
+        if got := interarrivalJitter(tt.rtts); !near(got, tt.want) {
+            t.Fatalf("jitter of %v: %v, want %v", tt.rtts, got, tt.want)
+        }
+    }
+}
+
+func TestIPDV(t *testing.T) {
+    for _, tt := range []struct {
+        rtts []float64
+        want float64
+    }{
+        {nil, 0},
+        {[]float64{10}, 0},
+        {[]float64{10, 20, 10, 20}, 10},
+        {[]float64{10, 12, 11}, 1.5},
+    } {
+        if got := ipdv(tt.rtts); !near(got, tt.want) {
+            t.Fatalf("IPDV of %v: %v, want %v", tt.rtts, got, tt.want)
+        }
+    }
+}
+
+func TestRFactor(t *testing.T) {
+    for _, tt := range []struct {
+        rtt, jitter, loss float64
+        want              float64
+    }{
+        // 10ms of codec delay alone
+        {0, 0, 0, 92.95},
+        // jitter counts twice
+        {20, 10, 0, 91.95},
+        // both slopes meet at 160ms
+        {150, 0, 0, 89.2},
+        {290, 0, 0, 75.2},
+        {0, 0, 10, 67.95},
+        {1000, 0, 0, 4.2},
+        {1100, 0, 0, 0},
+        {0, 0, 100, 0},
+    } {
+        if got := rFactor(tt.rtt, tt.jitter, tt.loss); !near(got, tt.want) {
+            t.Fatalf("R of rtt %v jitter %v loss %v: %v, want %v", tt.rtt, tt.jitter, tt.loss, got, tt.want)
+        }
+    }
+}
+
+func TestMOS(t *testing.T) {
+    // reference points of ITU-T G.107 annex B
+    for _, tt := range []struct {
+        r, want float64
+    }{
+        {-5, 1},
+        {0, 1},
+        {50, 2.575},
+        {60, 3.1},
+        {70, 3.597},
+        {80, 4.024},
+        {93.2, 4.40928582},
+        {100, 4.5},
+        {120, 4.5},
+    } {
+        if got := mos(tt.r); math.Abs(got - tt.want) > 1e-6 {
+            t.Fatalf("MOS of R %v: %v, want %v", tt.r, got, tt.want)
+        }
+    }
+}
+
+func TestPingStatQuality(t *testing.T) {
+    ok := func(ms float64) *network.Result {
+        return &network.Result{Code: network.CodeOK, Latency: time.Duration(ms * float64(time.Millisecond))}
+    }
+    truncated := ok(50)
+    truncated.Truncated = true
+    // 10, 20, 10, 20 intact, one lost and one truncated of 6
+    results := []*network.Result{ok(10), {Code: network.CodeTimeout}, ok(20), truncated, ok(10), ok(20)}
+    stat := &PingStat{}
+    stat.quality(results)
+    r := rFactor(15, 1.76025390625, 100.0 / 3)
+    if !near(stat.Stat.Jitter, 1.76025390625) || !near(stat.Stat.IPDV, 10) || !near(stat.Stat.RFactor, r) || !near(stat.Stat.MOS, mos(r)) {
+        t.Fatalf("jitter %v IPDV %v R %v MOS %v", stat.Stat.Jitter, stat.Stat.IPDV, stat.Stat.RFactor, stat.Stat.MOS)
+    }
+    // without intact replies, there's nothing to rate
+    stat = &PingStat{}
+    stat.quality([]*network.Result{{Code: network.CodeTimeout}, truncated})
+    if stat.Stat.RFactor != 0 || stat.Stat.MOS != 0 {
+        t.Fatalf("R %v MOS %v without replies", stat.Stat.RFactor, stat.Stat.MOS)
+    }
+}
@@ -0,0 +1,580 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tools
+
+import (
+    "errors"
+    "net"
+    "reflect"
+    "starping/network"
+    "starping/stats"
+    "strings"
+    "testing"
+    "time"
+)
+
+var (
+    simTarget  = net.ParseIP("198.51.100.7")
+    simTarget6 = net.ParseIP("2001:db8::7")
+    simHop1    = net.ParseIP("203.0.113.1")
+    simHop2    = net.ParseIP("203.0.113.2")
+)
+
+// simResolver resolves IP literals, and reverse DNS from names
+type simResolver map[string]string
+
+func (r simResolver) ResolveIPAddr(host string) (*net.IPAddr, error) {
+    ip := net.ParseIP(host)
+    if ip == nil {
+        return nil, errors.New("no such host")
+    }
+    return &net.IPAddr{IP: ip}, nil
+}
+
+func (r simResolver) LookupAddr(ip string) ([]string, error) {
+    if name, ok := r[ip]; ok {
+        return []string{name + "."}, nil
+    }
+    return nil, errors.New("no such host")
+}
+
+// newSimProber returns a Prober on a SimNetwork of seed with route toward
+// simTarget and simTarget6, and its manager to close.
+func newSimProber(seed int64, route *network.SimRoute) (*Prober, *network.ICMPManager) {
+    sim := network.NewSimNetwork(seed)
+    sim.Route(simTarget, route)
+    sim.Route(simTarget6, route)
+    m := sim.Manager()
+    p := NewProber(m)
+    p.Resolver = simResolver{
+        simHop1.String(): "hop1.example",
+        simHop2.String(): "hop2.example",
+    }
+    return p, m
+}
+
+func TestPingSim(t *testing.T) {
+    p, m := newSimProber(3, &network.SimRoute{Latency: 10 * time.Millisecond, Loss: 0.3})
+    defer m.Close()
+    timeouts := 0
+    stat, err := p.PingStream(simTarget.String(), &PingConfig{
+        Count:    20,
+        Interval: time.Millisecond,
+        Timeout:  50 * time.Millisecond,
+    }, func(e *PingEvent) {
+        if e.Code == network.CodeTimeout {
+            timeouts++
+        }
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stat.Stat.Total != 20 || stat.Stat.Drop != timeouts || timeouts == 0 || timeouts == 20 {
+        t.Fatalf("drop/total %d/%d with %d timeouts", stat.Stat.Drop, stat.Stat.Total, timeouts)
+    }
+    // measured from when writing the probe returns, a little late
+    if stat.Stat.Min < 9 || stat.Stat.Max > 30 || stat.Stat.Avg < stat.Stat.Min || stat.Stat.Avg > stat.Stat.Max {
+        t.Fatalf("min/avg/max %.2f/%.2f/%.2f, want around 10ms", stat.Stat.Min, stat.Stat.Avg, stat.Stat.Max)
+    }
+}
+
+func TestPingSimDamage(t *testing.T) {
+    p, m := newSimProber(1, &network.SimRoute{Latency: time.Millisecond, Corrupt: 0.5, Truncate: 0.5})
+    defer m.Close()
+    stat, err := p.Ping(simTarget.String(), &PingConfig{
+        Count:       20,
+        Interval:    time.Millisecond,
+        Timeout:     50 * time.Millisecond,
+        PayloadSize: 64,
+        Summary:     true,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    // damaged replies are neither lost nor counted in RTT
+    if stat.Stat.Drop != 0 || stat.Stat.Truncated == 0 || stat.Stat.Corrupted == 0 {
+        t.Fatalf("drop %d truncated %d corrupted %d", stat.Stat.Drop, stat.Stat.Truncated, stat.Stat.Corrupted)
+    }
+    if intact := stat.Stat.Total - stat.Stat.Truncated - stat.Stat.Corrupted; stat.Summary.RTT.N != intact {
+        t.Fatalf("%d RTT samples, want %d intact replies", stat.Summary.RTT.N, intact)
+    }
+}
+
+func TestPingSimSummary(t *testing.T) {
+    p, m := newSimProber(1, &network.SimRoute{Latency: time.Millisecond})
+    defer m.Close()
+    config := &PingConfig{
+        Count:    10,
+        Interval: time.Millisecond,
+        Timeout:  50 * time.Millisecond,
+    }
+    stat, err := p.Ping(simTarget.String(), config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stat.Summary != nil {
+        t.Fatal("Summary kept without PingConfig.Summary")
+    }
+    config.Summary = true
+    if stat, err = p.Ping(simTarget.String(), config); err != nil {
+        t.Fatal(err)
+    }
+    // percentiles are estimated from the sketch, as after Merge
+    sketch := stat.Summary.Sketch
+    if sketch == nil || sketch.Count != 10 {
+        t.Fatalf("sketch %+v, want 10 samples", sketch)
+    }
+    if stat.Stat.Median != sketch.Quantile(0.5) || stat.Stat.P99 != sketch.Quantile(0.99) {
+        t.Fatalf("median/p99 %v/%v, want %v/%v", stat.Stat.Median, stat.Stat.P99,
+            sketch.Quantile(0.5), sketch.Quantile(0.99))
+    }
+}
+
+func TestPingStatMerge(t *testing.T) {
+    newStat := func(jitter float64, rtts ...float64) *PingStat {
+        stat := &PingStat{Summary: stats.NewAccumulator(true)}
+        for _, rtt := range rtts {
+            stat.Summary.Add(rtt)
+        }
+        stat.Stat.Jitter, stat.Stat.IPDV = jitter, jitter
+        return stat
+    }
+    // 2 and 4 intervals between consecutive replies
+    stat := newStat(1, 10, 11, 12)
+    if err := stat.Merge(newStat(4, 20, 24, 28, 32, 36)); err != nil {
+        t.Fatal(err)
+    }
+    if stat.Stat.Jitter != 3 || stat.Stat.IPDV != 3 {
+        t.Fatalf("jitter/ipdv %v/%v, want 3", stat.Stat.Jitter, stat.Stat.IPDV)
+    }
+    sketch := stat.Summary.Sketch
+    if stat.Stat.Total != 8 || stat.Stat.Median != sketch.Quantile(0.5) || stat.Stat.P90 != sketch.Quantile(0.9) {
+        t.Fatalf("total %d median/p90 %v/%v", stat.Stat.Total, stat.Stat.Median, stat.Stat.P90)
+    }
+    // a single reply has no interval to weigh
+    stat = newStat(0, 10)
+    if err := stat.Merge(newStat(2, 20, 22)); err != nil {
+        t.Fatal(err)
+    }
+    if stat.Stat.Jitter != 2 {
+        t.Fatalf("jitter %v, want 2", stat.Stat.Jitter)
+    }
+    if err := stat.Merge(&PingStat{}); err != ErrNoSummary {
+        t.Fatalf("merging without summary: %v", err)
+    }
+}
+
+func TestMTRSim(t *testing.T) {
+    labels := []network.MPLSLabel{{Label: 24001, S: true, TTL: 1}}
+    p, m := newSimProber(1, &network.SimRoute{
+        Hops: []network.SimHop{
+            {IP: simHop1, Latency: 2 * time.Millisecond},
+            {IP: simHop2, Latency: 4 * time.Millisecond, MPLS: labels},
+        },
+        Latency: 6 * time.Millisecond,
+    })
+    defer m.Close()
+    stat, err := p.MTR(simTarget.String(), &MTRConfig{
+        Count:    3,
+        MaxTTL:   10,
+        Interval: time.Millisecond,
+        Timeout:  50 * time.Millisecond,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    hops := *stat.Stat
+    want := []struct {
+        ip   net.IP
+        rdns string
+        code int
+    }{
+        {simHop1, "hop1.example", network.CodeTimeExceeded},
+        {simHop2, "hop2.example", network.CodeTimeExceeded},
+        {simTarget, "", network.CodeOK},
+    }
+    if len(hops) != len(want) {
+        t.Fatalf("%d hops, want %d", len(hops), len(want))
+    }
+    for i, w := range want {
+        hop := hops[i]
+        if hop.Total != 3 || hop.Drop != 0 || len(hop.IP) != 1 {
+            t.Fatalf("hop %d: drop/total %d/%d with %d responders", i + 1, hop.Drop, hop.Total, len(hop.IP))
+        }
+        info := hop.IP[0]
+        if info.IP != w.ip.String() || info.RDNS != w.rdns || info.Code != w.code {
+            t.Fatalf("hop %d: %+v, want %s(%s) code %d", i + 1, info, w.ip, w.rdns, w.code)
+        }
+    }
+    if !reflect.DeepEqual(hops[1].IP[0].MPLS, labels) {
+        t.Fatalf("hop 2 MPLS %v, want %v", hops[1].IP[0].MPLS, labels)
+    }
+}
+
+func TestMTRSimUnreachable(t *testing.T) {
+    p, m := newSimProber(1, &network.SimRoute{
+        Hops:        []network.SimHop{{IP: simHop1, Latency: time.Millisecond}},
+        Unreachable: true,
+        Code:        13,
+    })
+    defer m.Close()
+    stat, err := p.MTR(simTarget.String(), &MTRConfig{
+        Count:    2,
+        MaxTTL:   10,
+        Interval: time.Millisecond,
+        Timeout:  50 * time.Millisecond,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    // the hop answers TTL 1 with Time Exceeded, and prohibits what passes it
+    hops := *stat.Stat
+    if len(hops) != 2 || len(hops[1].IP) != 1 {
+        t.Fatalf("hops %+v, want 2 ending at the prohibiting hop", hops)
+    }
+    if info := hops[1].IP[0]; info.Code != 13 || info.String() != "203.0.113.1(hop1.example) !X" {
+        t.Fatalf("hop %q with code %d, want administratively prohibited", info.String(), info.Code)
+    }
+}
+
+func TestMTRSimSummary(t *testing.T) {
+    p, m := newSimProber(1, &network.SimRoute{
+        Hops:    []network.SimHop{{IP: simHop1, Latency: time.Millisecond}},
+        Latency: 2 * time.Millisecond,
+    })
+    defer m.Close()
+    config := &MTRConfig{
+        Count:    3,
+        MaxTTL:   10,
+        Interval: time.Millisecond,
+        Timeout:  50 * time.Millisecond,
+    }
+    stat, err := p.MTR(simTarget.String(), config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i, hop := range *stat.Stat {
+        if hop.Summary != nil {
+            t.Fatalf("hop %d: Summary kept without MTRConfig.Summary", i + 1)
+        }
+    }
+    config.Summary = true
+    if stat, err = p.MTR(simTarget.String(), config); err != nil {
+        t.Fatal(err)
+    }
+    hops := *stat.Stat
+    if len(hops) != 2 {
+        t.Fatalf("%d hops, want 2", len(hops))
+    }
+    for i, hop := range hops {
+        if hop.Summary == nil || hop.Summary.Sketch == nil || hop.Summary.Sketch.Count != 3 {
+            t.Fatalf("hop %d: summary %+v, want a sketch of 3 samples", i + 1, hop.Summary)
+        }
+    }
+    if err = hops[0].Merge(&hops[1]); err != nil || hops[0].Summary.Sketch.Count != 6 {
+        t.Fatalf("merged hops: %v", err)
+    }
+}
+
+func TestNewMTREvent(t *testing.T) {
+    hop := &mtrHopStat{
+        IP: map[string]HopInfo{
+            simHop2.String(): {IP: simHop2.String()},
+            simHop1.String(): {IP: simHop1.String()},
+        },
+        Accumulator: stats.NewAccumulator(true),
+    }
+    hop.Add(1)
+    result := &network.Result{Code: network.CodeTimeExceeded, AddrIP: simHop1, Latency: time.Millisecond}
+    event := newMTREvent(1, 2, result, hop)
+    // later probes of the hop leave the snapshot alone
+    hop.Add(2)
+    hop.Drop()
+    if s := event.Hop.Summary; s.Loss.Total != 1 || s.RTT.N != 1 || s.Sketch.Count != 1 || event.Hop.Total != 1 {
+        t.Fatalf("snapshot %+v changed with the hop", s)
+    }
+    if ips := event.Hop.IP; len(ips) != 2 || ips[0].IP != simHop1.String() || ips[1].IP != simHop2.String() {
+        t.Fatalf("responders %v, want sorted", ips)
+    }
+}
+
+func TestHopInfoTooBig(t *testing.T) {
+    for _, code := range []int{4, network.CodePacketTooBig} {
+        info := &HopInfo{IP: simHop1.String(), Code: code}
+        if s := info.String(); s != "203.0.113.1 !F" {
+            t.Fatalf("code %d: %q, want fragmentation needed", code, s)
+        }
+    }
+}
+
+func TestPMTUSim(t *testing.T) {
+    p, m := newSimProber(1, &network.SimRoute{
+        Hops: []network.SimHop{
+            {IP: simHop1, Latency: time.Millisecond},
+            {IP: simHop2, Latency: time.Millisecond, MTU: 1400},
+        },
+        Latency: time.Millisecond,
+    })
+    defer m.Close()
+    // Fragmentation Needed and Packet Too Big are handled alike
+    for _, ip := range []net.IP{simTarget, simTarget6} {
+        stat, err := p.PMTU(ip.String(), &PMTUConfig{Timeout: 50 * time.Millisecond, MaxSize: 1500})
+        if err != nil {
+            t.Fatalf("%s: %v", ip, err)
+        }
+        if stat.MTU != 1400 || stat.Hop != simHop2.String() || stat.RDNS != "hop2.example" || stat.BlackHole {
+            t.Fatalf("%s: %+v, want MTU 1400 limited by %s", ip, stat, simHop2)
+        }
+    }
+}
+
+func TestPMTUSimMaxSize(t *testing.T) {
+    p, m := newSimProber(1, &network.SimRoute{Latency: time.Millisecond})
+    defer m.Close()
+    // larger sizes can't be sent at all
+    stat, err := p.PMTU(simTarget.String(), &PMTUConfig{Timeout: 50 * time.Millisecond, MaxSize: 65535})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stat.MTU != network.MaxPacketSize || stat.Hop != "" {
+        t.Fatalf("%+v, want MTU %d", stat, network.MaxPacketSize)
+    }
+}
+
+func TestPMTUSimTimeout(t *testing.T) {
+    p, m := newSimProber(1, &network.SimRoute{Loss: 1})
+    defer m.Close()
+    _, err := p.PMTU(simTarget.String(), &PMTUConfig{Timeout: 10 * time.Millisecond, Retry: 1})
+    if err == nil || !strings.HasSuffix(err.Error(), ": timed out") {
+        t.Fatalf("error %v, want timed out", err)
+    }
+}
+
+func TestPingSimPipeline(t *testing.T) {
+    p, m := newSimProber(1, &network.SimRoute{Latency: 5 * time.Millisecond, Duplicate: 1})
+    defer m.Close()
+    const timeout = 100 * time.Millisecond
+    start := time.Now()
+    var replies, duplicates int
+    stat, err := p.PingStream(simTarget.String(), &PingConfig{
+        Count:    10,
+        Interval: time.Millisecond,
+        Timeout:  timeout,
+        Pipeline: true,
+    }, func(e *PingEvent) {
+        if e.Duplicates != 0 {
+            duplicates += e.Duplicates
+            return
+        }
+        // replies are handed over as they come, not at timeout
+        if e.Code != network.CodeOK || time.Since(start) > timeout / 2 {
+            t.Errorf("#%d: code %d after %v", e.Seq, e.Code, time.Since(start))
+        }
+        replies++
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if replies != 10 || duplicates != 10 || stat.Stat.Duplicates != 10 || stat.Stat.Drop != 0 {
+        t.Fatalf("%d replies, %d duplicates, stat %d duplicates %d drop", replies, duplicates, stat.Stat.Duplicates, stat.Stat.Drop)
+    }
+    // duplicates are counted until timeout of each probe
+    if elapsed := time.Since(start); elapsed < timeout {
+        t.Fatalf("finished after %v, before timeout", elapsed)
+    }
+}
+
+func TestPingSimReorder(t *testing.T) {
+    p, m := newSimProber(7, &network.SimRoute{Latency: time.Millisecond, Jitter: 30 * time.Millisecond})
+    defer m.Close()
+    stat, err := p.Ping(simTarget.String(), &PingConfig{
+        Count:    20,
+        Interval: 2 * time.Millisecond,
+        Timeout:  100 * time.Millisecond,
+        Pipeline: true,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    // jitter beyond the interval reorders some replies, never all
+    if stat.Stat.Reordered == 0 || stat.Stat.Reordered >= 20 || stat.Stat.Drop != 0 {
+        t.Fatalf("%d reordered, %d dropped", stat.Stat.Reordered, stat.Stat.Drop)
+    }
+}
+
+func TestReordered(t *testing.T) {
+    at := time.Now()
+    ms := time.Millisecond
+    results := []*network.Result{
+        {Code: network.CodeOK, IssueTime: at, Latency: 30 * ms},
+        {Code: network.CodeOK, IssueTime: at.Add(10 * ms), Latency: 5 * ms},
+        {Code: network.CodeTimeout},
+        {Code: network.CodeOK, IssueTime: at.Add(20 * ms), Latency: 5 * ms},
+    }
+    // seq 0 arrives at 30ms, after seq 1 and 3 at 15ms and 25ms
+    if n := reordered(results); n != 1 {
+        t.Fatalf("%d reordered, want 1", n)
+    }
+}
+
+func TestPingSimStream(t *testing.T) {
+    p, m := newSimProber(3, &network.SimRoute{Latency: time.Millisecond, Loss: 0.3})
+    defer m.Close()
+    var events []*PingEvent
+    stat, err := p.PingStream(simTarget.String(), &PingConfig{
+        Count:    20,
+        Interval: time.Millisecond,
+        Timeout:  20 * time.Millisecond,
+    }, func(e *PingEvent) {
+        events = append(events, e)
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    // one event per probe, in sequence, as each probe waits for the last
+    if len(events) != 20 {
+        t.Fatalf("%d events of 20 probes", len(events))
+    }
+    timeouts := 0
+    for i, e := range events {
+        if e.Seq != i + 1 || e.Duplicates != 0 {
+            t.Fatalf("event %d of seq %d with %d duplicates", i, e.Seq, e.Duplicates)
+        }
+        switch e.Code {
+        case network.CodeTimeout:
+            timeouts++
+            if e.Responder != nil || e.RTT != 0 {
+                t.Fatalf("#%d: timeout from %s in %v", e.Seq, e.Responder, e.RTT)
+            }
+        case network.CodeOK:
+            if !e.Responder.Equal(simTarget) || e.RTT != e.Result.Latency || e.Message != codeMessage(network.CodeOK) {
+                t.Fatalf("#%d: %+v", e.Seq, e)
+            }
+        default:
+            t.Fatalf("#%d: code %d", e.Seq, e.Code)
+        }
+    }
+    if timeouts != stat.Stat.Drop || timeouts == 0 {
+        t.Fatalf("%d timeouts, %d dropped", timeouts, stat.Stat.Drop)
+    }
+}
+
+func TestPingSimPipelineStream(t *testing.T) {
+    p, m := newSimProber(7, &network.SimRoute{
+        Latency:   time.Millisecond,
+        Jitter:    30 * time.Millisecond,
+        Duplicate: 0.5,
+    })
+    defer m.Close()
+    const count = 20
+    // by sequence number, from 1
+    results := make([]*network.Result, count + 1)
+    duplicated := make([]bool, count + 1)
+    replies, duplicates := 0, 0
+    stat, err := p.PingStream(simTarget.String(), &PingConfig{
+        Count:    count,
+        Interval: 2 * time.Millisecond,
+        Timeout:  100 * time.Millisecond,
+        Pipeline: true,
+    }, func(e *PingEvent) {
+        if e.Seq < 1 || e.Seq > count {
+            t.Fatalf("event of seq %d", e.Seq)
+        }
+        if e.Duplicates != 0 {
+            // once per probe, after its reply. Each reply is duplicated
+            // at most once.
+            if results[e.Seq] == nil || duplicated[e.Seq] || e.Duplicates != 1 {
+                t.Fatalf("#%d: %d duplicates, replied %v, duplicated %v", e.Seq, e.Duplicates, results[e.Seq] != nil, duplicated[e.Seq])
+            }
+            duplicated[e.Seq] = true
+            duplicates += e.Duplicates
+            return
+        }
+        if results[e.Seq] != nil || e.Code != network.CodeOK {
+            t.Fatalf("#%d: code %d, replied %v", e.Seq, e.Code, results[e.Seq] != nil)
+        }
+        results[e.Seq] = e.Result
+        replies++
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if replies != count || stat.Stat.Drop != 0 {
+        t.Fatalf("%d replies, %d dropped", replies, stat.Stat.Drop)
+    }
+    if duplicates != stat.Stat.Duplicates || duplicates == 0 || duplicates == count {
+        t.Fatalf("%d duplicates in events, %d counted", duplicates, stat.Stat.Duplicates)
+    }
+    // a reply is reordered if a reply of a later probe arrived before it
+    arrival := func(r *network.Result) time.Time {
+        return r.IssueTime.Add(r.Latency)
+    }
+    reorder := 0
+    for seq := 1; seq <= count; seq++ {
+        for later := seq + 1; later <= count; later++ {
+            if arrival(results[later]).Before(arrival(results[seq])) {
+                reorder++
+                break
+            }
+        }
+    }
+    if stat.Stat.Reordered != reorder || reorder == 0 || reorder == count {
+        t.Fatalf("%d reordered, want %d", stat.Stat.Reordered, reorder)
+    }
+}
+
+func TestMTRSimStream(t *testing.T) {
+    p, m := newSimProber(1, &network.SimRoute{
+        Hops: []network.SimHop{
+            {IP: simHop1, Latency: time.Millisecond},
+            {IP: simHop2, Latency: 2 * time.Millisecond},
+        },
+        Latency: 3 * time.Millisecond,
+    })
+    defer m.Close()
+    var events []*MTREvent
+    _, err := p.MTRStream(simTarget.String(), &MTRConfig{
+        Count:    3,
+        MaxTTL:   10,
+        Interval: time.Millisecond,
+        Timeout:  50 * time.Millisecond,
+    }, func(e *MTREvent) {
+        events = append(events, e)
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    // round by round, TTL up to the target
+    path := []net.IP{simHop1, simHop2, simTarget}
+    codes := []int{network.CodeTimeExceeded, network.CodeTimeExceeded, network.CodeOK}
+    if len(events) != 3 * len(path) {
+        t.Fatalf("%d events, want %d", len(events), 3 * len(path))
+    }
+    for i, e := range events {
+        round, ttl := i / len(path) + 1, i % len(path) + 1
+        if e.Round != round || e.TTL != ttl {
+            t.Fatalf("event %d of round %d TTL %d, want %d %d", i, e.Round, e.TTL, round, ttl)
+        }
+        if !e.Responder.Equal(path[ttl - 1]) || e.Code != codes[ttl - 1] {
+            t.Fatalf("round %d TTL %d: code %d from %s", round, ttl, e.Code, e.Responder)
+        }
+        // hop statistics include the probe of the event
+        if e.Hop.Index != ttl || e.Hop.Total != round || len(e.Hop.IP) != 1 || e.Hop.Summary.RTT.N != round {
+            t.Fatalf("round %d TTL %d: hop %+v", round, ttl, e.Hop)
+        }
+    }
+}
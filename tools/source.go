@@ -0,0 +1,60 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tools
+
+import (
+    "fmt"
+    "net"
+    "starping/network"
+)
+
+// parseSource parses source address and outgoing interface of probes toward
+// dst. It returns the source address to set on probes, nil to let kernel
+// choose, and the address probes leave from to echo in reports, empty if
+// unknown.
+func parseSource(dst net.IP, source, iface string) (net.IP, string, error) {
+    var ip net.IP
+    if source != "" {
+        if ip = net.ParseIP(source); ip == nil {
+            return nil, "", fmt.Errorf("bad source address: %s", source)
+        }
+        if (ip.To4() != nil) != (dst.To4() != nil) {
+            return nil, "", network.ErrSourceFamily
+        }
+    }
+    if iface != "" {
+        if _, err := net.InterfaceByName(iface); err != nil {
+            return nil, "", err
+        }
+    }
+    used := ""
+    if addr, err := network.ProbeSource(dst, &network.Probe{Source: ip, Interface: iface}); err == nil {
+        used = addr.String()
+    }
+    return ip, used, nil
+}
+
+// sourceString formats where probes leave from for String of reports
+func sourceString(source, iface string) (s string) {
+    if source != "" {
+        s += fmt.Sprintf(" from %s", source)
+    }
+    if iface != "" {
+        s += fmt.Sprintf(" via %s", iface)
+    }
+    return
+}
@@ -0,0 +1,141 @@
+// StarPing Planet
+// Copyright (C) 2020  Yuan Tong
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tools
+
+import (
+    "fmt"
+    "io"
+    "net"
+    "sort"
+    "starping/network"
+    "time"
+)
+
+// A PingEvent is the outcome of a ping probe, handed to PingStream handler
+type PingEvent struct {
+    // Seq is the sequence number of the probe, from 1
+    Seq int `json:"seq"`
+    // address of the responder, nil without response
+    Responder net.IP `json:"responder,omitempty"`
+    RTT time.Duration `json:"rtt"`
+    Code int `json:"code"`
+    // Message describes Code, see network.IcmpUnreachableMsg
+    Message string `json:"message"`
+    // Duplicates is only set on an extra event of Seq in pipeline mode,
+    // once duplicate replies to the probe are counted. The other fields are
+    // of its first reply.
+    Duplicates int `json:"duplicates,omitempty"`
+    // Result of the probe, for details like Truncated
+    Result *network.Result `json:"-"`
+}
+
+// codeMessage describes Result code
+func codeMessage(code int) string {
+    if msg, ok := network.IcmpUnreachableMsg[code]; ok {
+        return msg
+    }
+    return fmt.Sprintf("Unknown destination unreachable code <%d>", code)
+}
+
+func newPingEvent(seq int, result *network.Result) *PingEvent {
+    event := &PingEvent{
+        Seq:     seq,
+        Code:    result.Code,
+        Message: codeMessage(result.Code),
+        Result:  result,
+    }
+    if result.Replied() {
+        event.Responder, event.RTT = result.AddrIP, result.Latency
+    }
+    return event
+}
+
+// PingConsole returns a PingStream handler writing each event to w like ping
+// does, which is the output of PingInfo.
+func PingConsole(w io.Writer) func(*PingEvent) {
+    return func(e *PingEvent) {
+        if e.Duplicates != 0 {
+            _, _ = fmt.Fprintf(w, "#%2d: %d more replies from %s (DUP!).\n", e.Seq, e.Duplicates, e.Responder)
+            return
+        }
+        result := e.Result
+        rtt := float64(e.RTT) / float64(time.Millisecond)
+        switch {
+        case e.Code == network.CodeTimeout:
+            _, _ = fmt.Fprintf(w, "#%2d: Timeout.\n", e.Seq)
+        case !result.Replied():
+            _, _ = fmt.Fprintf(w, "#%2d: %s.\n", e.Seq, e.Message)
+        case e.Code == network.CodeOK && (result.Truncated || result.Corrupted):
+            state := "Truncated"
+            if result.Corrupted {
+                state = "Corrupted"
+            }
+            _, _ = fmt.Fprintf(w, "#%2d: Reply from %s (%.2fms): %s Echo Reply.\n", e.Seq, e.Responder, rtt, state)
+        case e.Code != network.CodeOK:
+            _, _ = fmt.Fprintf(w, "#%2d: Reply from %s (%.2fms): %s.\n", e.Seq, e.Responder, rtt, e.Message)
+        default:
+            _, _ = fmt.Fprintf(w, "#%2d: Reply from %s (%.2fms): Echo Reply.\n", e.Seq, e.Responder, rtt)
+        }
+    }
+}
+
+// An MTREvent is the outcome of an MTR probe, handed to MTRStream handler
+type MTREvent struct {
+    // Round of probing toward the target, from 1, and TTL of the probe
+    Round int `json:"round"`
+    TTL int `json:"ttl"`
+    // address of the responder, nil without response
+    Responder net.IP `json:"responder,omitempty"`
+    RTT time.Duration `json:"rtt"`
+    Code int `json:"code"`
+    // Message describes Code, see network.IcmpUnreachableMsg
+    Message string `json:"message"`
+    // Hop is the statistics of TTL so far, without reverse DNS of responders
+    Hop *MTRHopStat `json:"hop"`
+    // Result of the probe, for details like MPLS labels
+    Result *network.Result `json:"-"`
+}
+
+// newMTREvent creates MTREvent of result, with a snapshot of hop statistics
+// from hop, responders sorted
+func newMTREvent(round, ttl int, result *network.Result, hop *mtrHopStat) *MTREvent {
+    event := &MTREvent{
+        Round:   round,
+        TTL:     ttl,
+        Code:    result.Code,
+        Message: codeMessage(result.Code),
+        Result:  result,
+    }
+    if result.Replied() {
+        event.Responder, event.RTT = result.AddrIP, result.Latency
+    }
+    event.Hop = &MTRHopStat{
+        Index:   ttl,
+        IP:      make([]HopInfo, 0, len(hop.IP)),
+        Summary: hop.Accumulator.Clone(),
+    }
+    keys := make([]string, 0, len(hop.IP))
+    for k := range hop.IP {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        event.Hop.IP = append(event.Hop.IP, hop.IP[k])
+    }
+    event.Hop.summarize()
+    return event
+}